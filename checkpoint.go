@@ -0,0 +1,391 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+const checkpointVersion = 1
+const DefaultCheckpointInterval = 5 * time.Minute
+
+// checkpointData is saved in the CheckpointFile.  It holds the walk position
+// (the completed dirs), the fsDev indexes, the remaining link groups, and
+// the Results gathered so far.
+type checkpointData struct {
+	Version    int
+	Roots      []string
+	Match      checkpointOptions
+	Phase      RunPhases
+	DoneDirs   []string
+	Devices    []deviceCheckpoint
+	Results    []byte // JSON
+	DirSavings map[string]*DirSavings
+	UIDSavings map[uint32]*OwnerSavings
+	GIDSavings map[uint32]*OwnerSavings
+}
+
+// checkpointOptions are the Options that must be unchanged when resuming,
+// since they affect which files were indexed and found linkable.
+type checkpointOptions struct {
+	SameName       bool
+	IgnoreTime     bool
+	IgnorePerm     bool
+	IgnoreOwner    bool
+	IgnoreXAttr    bool
+	LinkingEnabled bool
+	UseNewestLink  bool
+	MinFileSize    uint64
+	MaxFileSize    uint64
+	FileIncludes   []string
+	FileExcludes   []string
+	DirExcludes    []string
+	PolicyRules    []PolicyRule
+}
+
+func newCheckpointOptions(o *Options) checkpointOptions {
+	return checkpointOptions{
+		SameName:       o.SameName,
+		IgnoreTime:     o.IgnoreTime,
+		IgnorePerm:     o.IgnorePerm,
+		IgnoreOwner:    o.IgnoreOwner,
+		IgnoreXAttr:    o.IgnoreXAttr,
+		LinkingEnabled: o.LinkingEnabled,
+		UseNewestLink:  o.UseNewestLink,
+		MinFileSize:    o.MinFileSize,
+		MaxFileSize:    o.MaxFileSize,
+		FileIncludes:   o.FileIncludes,
+		FileExcludes:   o.FileExcludes,
+		DirExcludes:    o.DirExcludes,
+		PolicyRules:    o.PolicyRules,
+	}
+}
+
+type deviceCheckpoint struct {
+	Dev       uint64
+	MaxNLinks uint64
+	Inodes    []inodeCheckpoint
+	Linkable  [][2]I.Ino // Pairs of linkable inodes, in groups not yet linked
+}
+
+type inodeCheckpoint struct {
+	StatInfo  I.StatInfo
+	Paths     []string
+	InHash    bool // A representative of its inode hash
+	Digest    I.Digest
+	HasDigest bool
+}
+
+// checkpointer periodically saves the state of the Run to the
+// CheckpointFile, and restores it when resuming.
+type checkpointer struct {
+	ls       *linkableState
+	pathname string
+	roots    []string
+	walk     walkCheckpoint
+	doneDirs []string         // Compacted walk.doneDirs at the last pause
+	doneInos map[uint64]I.Set // Inodes of the link groups already processed
+}
+
+func newCheckpointer(ls *linkableState, roots []string) *checkpointer {
+	interval := ls.Options.CheckpointInterval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	return &checkpointer{
+		ls:       ls,
+		pathname: ls.Options.CheckpointFile,
+		roots:    roots,
+		walk: walkCheckpoint{
+			doneDirs: make(map[string]struct{}),
+			interval: interval,
+			last:     time.Now(),
+		},
+		doneInos: make(map[uint64]I.Set),
+	}
+}
+
+// walkPaused saves a checkpoint while the walk is paused, after the files
+// of its completed dirs have been indexed.
+func (c *checkpointer) walkPaused() error {
+	c.doneDirs = c.doneDirs[:0]
+	for dirname := range c.walk.doneDirs {
+		// Subdirs of completed dirs are skipped along with them
+		parent := filepath.Dir(dirname)
+		if _, ok := c.walk.doneDirs[parent]; !ok || parent == dirname {
+			c.doneDirs = append(c.doneDirs, dirname)
+		}
+	}
+	return c.save(WalkPhase)
+}
+
+// linkSetDone records a processed link group, and saves a checkpoint if due.
+// Only done when linking, since otherwise the indexes are changed to the
+// (hypothetical) linked state, which couldn't be validated when resuming.
+func (c *checkpointer) linkSetDone(dev uint64, set I.Set) error {
+	if !c.ls.Options.LinkingEnabled {
+		return nil
+	}
+	done, ok := c.doneInos[dev]
+	if !ok {
+		done = I.NewSet()
+		c.doneInos[dev] = done
+	}
+	for ino := range set {
+		done.Add(ino)
+	}
+	return c.saveIfDue(LinkPhase)
+}
+
+func (c *checkpointer) saveIfDue(phase RunPhases) error {
+	if time.Since(c.walk.last) < c.walk.interval {
+		return nil
+	}
+	return c.save(phase)
+}
+
+func (c *checkpointer) save(phase RunPhases) error {
+	ls := c.ls
+	data := checkpointData{
+		Version:  checkpointVersion,
+		Roots:    c.roots,
+		Match:    newCheckpointOptions(ls.Options),
+		Phase:    phase,
+		DoneDirs: c.doneDirs,
+	}
+	for dev, fsdev := range ls.fsDevs {
+		data.Devices = append(data.Devices, fsdev.checkpoint(c.doneInos[dev]))
+	}
+	var err error
+	if data.Results, err = json.Marshal(ls.Results); err != nil {
+		return err
+	}
+	r := ls.Results
+	if r.dirTally != nil {
+		data.DirSavings = r.dirTally.savings
+	}
+	if r.ownerTally != nil {
+		data.UIDSavings = r.ownerTally.uids
+		data.GIDSavings = r.ownerTally.gids
+	}
+	if err := saveGob(c.pathname, &data); err != nil {
+		return fmt.Errorf("Couldn't save checkpoint: %v", err)
+	}
+	c.walk.last = time.Now()
+	return nil
+}
+
+// remove deletes the checkpoint, once the Run has completed
+func (c *checkpointer) remove() {
+	os.Remove(c.pathname)
+}
+
+func (f *fsDev) checkpoint(done I.Set) deviceCheckpoint {
+	dc := deviceCheckpoint{Dev: f.Dev, MaxNLinks: f.MaxNLinks}
+	inHash := I.NewSet()
+	for _, set := range f.inoHashes {
+		for ino := range set {
+			inHash.Add(ino)
+		}
+	}
+	for ino, fp := range f.InoPaths {
+		si, ok := f.inoStatInfo[ino]
+		if !ok {
+			continue
+		}
+		ic := inodeCheckpoint{StatInfo: *si, InHash: inHash.Has(ino)}
+		ic.Digest, ic.HasDigest = f.InoDigests.Get(ino)
+		for _, ps := range fp.PathsAsSlice() {
+			ic.Paths = append(ic.Paths, ps.Join())
+		}
+		dc.Inodes = append(dc.Inodes, ic)
+	}
+	// Inodes removed by linking are still in the LinkableInos (possibly
+	// joining the rest of their set), so each set's remaining inodes are
+	// saved as pairs with its first remaining inode.
+	seen := I.NewSet()
+	for ino := range f.LinkableInos {
+		if seen.Has(ino) || done.Has(ino) {
+			continue
+		}
+		var first I.Ino
+		for ino2 := range f.LinkableInos.Containing(ino) {
+			seen.Add(ino2)
+			if _, ok := f.inoStatInfo[ino2]; !ok {
+				continue
+			}
+			if first == 0 {
+				first = ino2
+			} else {
+				dc.Linkable = append(dc.Linkable, [2]I.Ino{first, ino2})
+			}
+		}
+	}
+	return dc
+}
+
+// resume loads the checkpoint, and restores the indexes and Results from
+// it.  The saved stat info of every path is checked against the
+// filesystem, and changed paths are indexed again.  The phase to resume is
+// returned.
+func (c *checkpointer) resume(dirsAndFiles []string) (RunPhases, error) {
+	var data checkpointData
+	if err := loadGob(c.pathname, &data); err != nil {
+		if os.IsNotExist(err) {
+			return StartPhase, fmt.Errorf("No checkpoint to resume from: %v", c.pathname)
+		}
+		return StartPhase, fmt.Errorf("Couldn't load checkpoint: %v", err)
+	}
+	if data.Version != checkpointVersion {
+		return StartPhase, fmt.Errorf("Unsupported checkpoint version: %v", data.Version)
+	}
+	if !reflect.DeepEqual(data.Roots, dirsAndFiles) {
+		return StartPhase, fmt.Errorf("Checkpoint was made with different dirs and files: %v", data.Roots)
+	}
+	if !reflect.DeepEqual(data.Match, newCheckpointOptions(c.ls.Options)) {
+		return StartPhase, fmt.Errorf("Checkpoint was made with different matching or linking options")
+	}
+
+	ls := c.ls
+	r := ls.Results
+	opts, roots, start, phaseSeconds := r.Opts, r.Roots, r.StartTime, r.PhaseSeconds
+	if err := json.Unmarshal(data.Results, r); err != nil {
+		return StartPhase, fmt.Errorf("Couldn't load checkpoint: %v", err)
+	}
+	// The combined Results have the counts of both runs, but the times of
+	// this one.
+	r.Opts, r.Roots, r.StartTime = opts, roots, start
+	for phase, secs := range r.PhaseSeconds {
+		phaseSeconds[phase] += secs
+	}
+	r.PhaseSeconds = phaseSeconds
+	r.RunSuccessful = false
+	r.Resumed = true
+	if r.dirTally != nil && data.DirSavings != nil {
+		r.dirTally.savings = data.DirSavings
+	}
+	if r.ownerTally != nil && data.UIDSavings != nil {
+		r.ownerTally.uids = data.UIDSavings
+		r.ownerTally.gids = data.GIDSavings
+	}
+
+	for _, dirname := range data.DoneDirs {
+		c.walk.doneDirs[dirname] = struct{}{}
+	}
+	c.doneDirs = data.DoneDirs
+
+	var changed []string
+	for _, dc := range data.Devices {
+		fsdev := newFSDev(ls.status, dc.Dev, dc.MaxNLinks)
+		ls.fsDevs[dc.Dev] = fsdev
+		changed = append(changed, fsdev.restore(dc)...)
+	}
+	// Changed paths are indexed again, so they aren't lost when in a
+	// completed dir (they were already counted by the interrupted walk)
+	fileCount := r.FileCount
+	defer func() { r.FileCount = fileCount }()
+	for _, pathname := range changed {
+		fi, err := ls.fsys.Lstat(pathname)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := ls.walkFile(pathname, nil); err != nil {
+			return StartPhase, err
+		}
+	}
+	return data.Phase, nil
+}
+
+// restore rebuilds the indexes from the checkpoint, and then checks the
+// paths.  A path that now links to another indexed (and unchanged) inode,
+// such as when it was linked after the checkpoint, is moved to it.  Other
+// changed paths are removed, and returned.
+func (f *fsDev) restore(dc deviceCheckpoint) []string {
+	for i := range dc.Inodes {
+		ic := &dc.Inodes[i]
+		si := ic.StatInfo
+		f.inoStatInfo[si.Ino] = &si
+		for _, pathname := range ic.Paths {
+			f.InoPaths.AppendPath(si.Ino, P.Split(pathname, f.pool))
+		}
+		if ic.InHash {
+			f.addInoHash(si.Ino, &si)
+		}
+		if ic.HasDigest {
+			f.InoDigests.Add(I.PathInfo{StatInfo: si}, ic.Digest)
+		}
+	}
+	for _, pair := range dc.Linkable {
+		f.LinkableInos.Add(pair[0], pair[1])
+	}
+
+	type move struct {
+		ps       P.Pathsplit
+		from, to I.Ino
+		moved    bool // Otherwise removed
+	}
+	var moves []move
+	var changed []string
+	for ino, fp := range f.InoPaths {
+		for _, ps := range fp.PathsAsSlice() {
+			di, err := I.LStatInfo(f.fsys, ps.Join())
+			if err == nil && di.Dev == f.Dev {
+				cur, ok := f.inoStatInfo[di.Ino]
+				if ok && !statChanged(cur, &di.StatInfo) {
+					cur.Nlink = di.Nlink
+					if di.Ino != ino {
+						moves = append(moves, move{ps, ino, di.Ino, true})
+					}
+					continue
+				}
+			}
+			moves = append(moves, move{ps, ino, 0, false})
+			changed = append(changed, ps.Join())
+		}
+	}
+	for _, m := range moves {
+		fp := f.InoPaths[m.from]
+		fp.Remove(m.ps)
+		if m.moved {
+			f.InoPaths.AppendPath(m.to, m.ps)
+		}
+		if fp.IsEmpty() {
+			// Keep the rest of its linkable set connected
+			var others []I.Ino
+			for ino := range f.LinkableInos[m.from] {
+				others = append(others, ino)
+			}
+			f.forgetIno(m.from)
+			for i := 1; i < len(others); i++ {
+				f.LinkableInos.Add(others[0], others[i])
+			}
+		}
+	}
+	return changed
+}
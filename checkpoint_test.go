@@ -0,0 +1,217 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// newCheckpointMemFS returns a MemFS with 5 dirs, each with a file from 4
+// groups of identical files
+func newCheckpointMemFS(t *testing.T) (*vfs.MemFS, []string) {
+	m := vfs.NewMemFS()
+	mtime := time.Now().Add(-time.Hour)
+	var paths []string
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 4; j++ {
+			pathname := fmt.Sprintf("d%d/f%d", i, j)
+			if err := m.WriteFile(pathname, []byte(fmt.Sprintf("content %d", j)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Chtimes(pathname, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, pathname)
+		}
+	}
+	return m, paths
+}
+
+func countMemInodes(t *testing.T, m *vfs.MemFS, paths []string) int {
+	inos := make(map[uint64]struct{})
+	for _, p := range paths {
+		inos[memIno(t, m, p)] = struct{}{}
+	}
+	return len(inos)
+}
+
+// stopObserver cancels the Run after the given number of accepted files, or
+// links
+type stopObserver struct {
+	NopObserver
+	files, links int
+	cancel       func()
+}
+
+func (s *stopObserver) FileAccepted(pathname string, size uint64) {
+	if s.files--; s.files == 0 {
+		s.cancel()
+	}
+}
+
+func (s *stopObserver) LinkDone(src, dst string, size uint64, err error) {
+	if s.links--; s.links == 0 {
+		s.cancel()
+	}
+}
+
+// checkpointRun runs with a checkpoint after every dir and link group, and
+// is stopped by the observer (if given)
+func checkpointRun(t *testing.T, m *vfs.MemFS, ckpt string, resume bool, stop *stopObserver) (Results, error) {
+	opts := SetupOptions(LinkingEnabled, Checkpoint(ckpt))
+	opts.CheckpointInterval = time.Nanosecond
+	opts.Resume = resume
+	opts.FS = m
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if stop != nil {
+		stop.cancel = cancel
+		opts.Observer = stop
+	}
+	return RunContext(ctx, []string{"."}, opts)
+}
+
+func TestRunCheckpointResume(t *testing.T) {
+	topdir := setUp("Checkpoint", t)
+	defer os.RemoveAll(topdir)
+
+	ref, paths := newCheckpointMemFS(t)
+	refResults, err := checkpointRun(t, ref, "ref.ckpt", false, nil)
+	if err != nil {
+		t.Fatalf("Reference run failed: %v", err)
+	}
+	if _, err := os.Stat("ref.ckpt"); !os.IsNotExist(err) {
+		t.Errorf("Checkpoint wasn't removed after a successful run")
+	}
+
+	tests := []struct {
+		name  string
+		stop  stopObserver
+		phase RunPhases
+	}{
+		{"walk", stopObserver{files: 9}, WalkPhase},
+		{"link", stopObserver{links: 6}, LinkPhase},
+	}
+	for _, tc := range tests {
+		m, _ := newCheckpointMemFS(t)
+		ckpt := tc.name + ".ckpt"
+		r, err := checkpointRun(t, m, ckpt, false, &tc.stop)
+		if err != context.Canceled || r.Phase != tc.phase {
+			t.Fatalf("%v: expected to be stopped in phase %v, got %v (%v)", tc.name, tc.phase, r.Phase, err)
+		}
+		if _, err := os.Stat(ckpt); err != nil {
+			t.Fatalf("%v: no checkpoint was saved: %v", tc.name, err)
+		}
+
+		r, err = checkpointRun(t, m, ckpt, true, nil)
+		if err != nil {
+			t.Fatalf("%v: resumed run failed: %v", tc.name, err)
+		}
+		if !r.Resumed || !r.RunSuccessful {
+			t.Errorf("%v: expected a successful resumed run", tc.name)
+		}
+		if r.FileCount != refResults.FileCount || r.NewLinkCount != refResults.NewLinkCount ||
+			r.InodeRemovedByteAmount != refResults.InodeRemovedByteAmount {
+			t.Errorf("%v: combined results differ: files %v/%v, links %v/%v, bytes %v/%v", tc.name,
+				r.FileCount, refResults.FileCount, r.NewLinkCount, refResults.NewLinkCount,
+				r.InodeRemovedByteAmount, refResults.InodeRemovedByteAmount)
+		}
+		if n := countMemInodes(t, m, paths); n != 4 {
+			t.Errorf("%v: expected 4 inodes after resuming, got %v", tc.name, n)
+		}
+	}
+}
+
+// panicObserver panics after a link, simulating a crash before the next
+// checkpoint is saved
+type panicObserver struct {
+	NopObserver
+	links int
+}
+
+func (p *panicObserver) LinkDone(src, dst string, size uint64, err error) {
+	if p.links--; p.links == 0 {
+		panic("crash")
+	}
+}
+
+func TestRunCheckpointRevalidate(t *testing.T) {
+	topdir := setUp("Checkpoint", t)
+	defer os.RemoveAll(topdir)
+
+	m, paths := newCheckpointMemFS(t)
+	opts := SetupOptions(LinkingEnabled, Checkpoint("crash.ckpt"))
+	opts.CheckpointInterval = time.Nanosecond
+	opts.FS = m
+	opts.Observer = &panicObserver{links: 6}
+	if _, err := Run([]string{"."}, opts); err == nil {
+		t.Fatalf("Expected the crashed run to fail")
+	}
+
+	// The link made after the last checkpoint is found when revalidating
+	// (and a file changed since the checkpoint is indexed again)
+	if err := m.WriteFile("d4/f3", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Chtimes("d4/f3", time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := checkpointRun(t, m, "crash.ckpt", true, nil)
+	if err != nil {
+		t.Fatalf("Resumed run failed: %v", err)
+	}
+	if n := countMemInodes(t, m, paths); n != 5 {
+		t.Errorf("Expected 5 inodes after resuming, got %v", n)
+	}
+	if r.FileCount != int64(len(paths)) {
+		t.Errorf("Expected %v files, got %v", len(paths), r.FileCount)
+	}
+}
+
+func TestRunCheckpointMismatch(t *testing.T) {
+	topdir := setUp("Checkpoint", t)
+	defer os.RemoveAll(topdir)
+
+	m, _ := newCheckpointMemFS(t)
+	if _, err := checkpointRun(t, m, "none.ckpt", true, nil); err == nil {
+		t.Errorf("Expected an error when resuming without a checkpoint")
+	}
+
+	checkpointRun(t, m, "mismatch.ckpt", false, &stopObserver{files: 5})
+	opts := SetupOptions(LinkingEnabled, IgnoreTime, Checkpoint("mismatch.ckpt"))
+	opts.Resume = true
+	opts.FS = m
+	if _, err := Run([]string{"."}, opts); err == nil {
+		t.Errorf("Expected an error when resuming with different options")
+	}
+	opts = SetupOptions(LinkingEnabled, Checkpoint("mismatch.ckpt"))
+	opts.Resume = true
+	opts.FS = m
+	if _, err := Run([]string{"d0"}, opts); err == nil {
+		t.Errorf("Expected an error when resuming with different dirs")
+	}
+}
@@ -23,34 +23,41 @@ package hardlinkable
 import (
 	"bytes"
 	"io"
-	"os"
 
 	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 func areFileContentsEqual(s status, pathname1, pathname2 string) (bool, error) {
-	f1, openErr := os.Open(pathname1)
+	f1, openErr := s.fsys.Open(pathname1)
 	if openErr != nil {
 		return false, openErr
 	}
 	defer f1.Close()
 
-	f2, openErr := os.Open(pathname2)
+	f2, openErr := s.fsys.Open(pathname2)
 	if openErr != nil {
 		return false, openErr
 	}
 	defer f2.Close()
 
 	eq, err := fileContentsEqual(s, f1, f2)
+	if err == nil {
+		s.observer.Compared(pathname1, pathname2, eq)
+	}
 	return eq, err
 }
 
 // Return true if f1 and f2 have identical contents. Otherwise return false.
-func fileContentsEqual(s status, f1, f2 *os.File) (bool, error) {
+func fileContentsEqual(s status, f1, f2 vfs.File) (bool, error) {
 	var atEnd bool
 	bufSize := minCmpBufSize
 
 	for {
+		// Stop in-flight comparisons of large files when cancelled
+		if err := s.ctx.Err(); err != nil {
+			return false, err
+		}
 		n1, err1 := I.ReadChunk(f1, s.cmpBuf1)
 		n2, err2 := I.ReadChunk(f2, s.cmpBuf2)
 
@@ -72,7 +79,7 @@ func fileContentsEqual(s status, f1, f2 *os.File) (bool, error) {
 
 			eq := bytes.Equal(s.cmpBuf1, s.cmpBuf2)
 			s.Results.addBytesCompared(uint64(n1 + n2))
-			s.Progress.Show()
+			s.observer.Show()
 			if !eq {
 				return false, nil
 			}
@@ -53,7 +53,6 @@ func TestFileContentComparison(t *testing.T) {
 
 	ls := newLinkableState(&Options{})
 	s := ls.status
-	s.Progress = &disabledProgress{}
 
 	var tests = []struct {
 		content       [2]string
@@ -0,0 +1,192 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+)
+
+// CrossDeviceGroup is a group of files with identical content that are found
+// on more than one device (and so can't be hardlinked together).
+// SaveableBytes is the amount that keeping only one copy would save (ie. by
+// consolidating the data onto one filesystem, or by replacing the copies on
+// the other devices with symlinks).
+type CrossDeviceGroup struct {
+	Size          uint64   `json:"size"`
+	Devices       []uint64 `json:"devices"`
+	SaveableBytes uint64   `json:"saveableBytes"`
+	Paths         []string `json:"paths"`
+}
+
+// crossDevCandidate is an inode (representing its set of linkable inodes) on
+// a device, that may be identical to inodes on other devices.
+type crossDevCandidate struct {
+	f    *fsDev
+	ino  I.Ino
+	inos I.Set
+}
+
+func (c crossDevCandidate) pathname() string {
+	return c.f.InoPaths.ArbitraryPath(c.ino).Join()
+}
+
+// findCrossDeviceDuplicates finds identical files on different devices, using
+// an index of the inode sizes shared by the devices, then content digests,
+// then full comparisons.  It only reports on them, and never links them.  It
+// must be called after the walk, but before the link phase modifies the inode
+// and path information.
+func (ls *linkableState) findCrossDeviceDuplicates() error {
+	if len(ls.fsDevs) < 2 {
+		return nil
+	}
+	devs := make([]uint64, 0, len(ls.fsDevs))
+	for dev := range ls.fsDevs {
+		devs = append(devs, dev)
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i] < devs[j] })
+
+	bySize := make(map[uint64][]crossDevCandidate)
+	for _, dev := range devs {
+		f := ls.fsDevs[dev]
+		reps := f.inoSetReps()
+		inos := make([]I.Ino, 0, len(reps))
+		for ino := range reps {
+			inos = append(inos, ino)
+		}
+		sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+		for _, ino := range inos {
+			size := f.inoStatInfo[ino].Size
+			bySize[size] = append(bySize[size], crossDevCandidate{&f, ino, reps[ino]})
+		}
+	}
+
+	sizes := make([]uint64, 0, len(bySize))
+	for size, candidates := range bySize {
+		if candidates[0].f.Dev != candidates[len(candidates)-1].f.Dev {
+			sizes = append(sizes, size) // Found on multiple devices
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+
+	for _, size := range sizes {
+		if err := ls.ctx.Err(); err != nil {
+			return err
+		}
+		byDigest := make(map[I.Digest][]crossDevCandidate)
+		var digests []I.Digest
+		for _, c := range bySize[size] {
+			// Digests computed during the walk are reused
+			d, err := c.f.inoDigest(c.ino)
+			if err != nil {
+				ls.Results.addError(errOp(err, OpRead), c.pathname(), err)
+				if !ls.Options.IgnoreWalkErrors {
+					return err
+				}
+				continue
+			}
+			if _, ok := byDigest[d]; !ok {
+				digests = append(digests, d)
+			}
+			byDigest[d] = append(byDigest[d], c)
+		}
+		for _, d := range digests {
+			if err := ls.groupCrossDevCandidates(size, byDigest[d]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// groupCrossDevCandidates compares the contents of the candidates (which have
+// equal size and digest), and records the identical groups that span devices.
+func (ls *linkableState) groupCrossDevCandidates(size uint64, candidates []crossDevCandidate) error {
+	if len(candidates) < 2 || candidates[0].f.Dev == candidates[len(candidates)-1].f.Dev {
+		return nil
+	}
+	var groups [][]crossDevCandidate
+CandidateLoop:
+	for _, c := range candidates {
+		for i, g := range groups {
+			ls.Results.didComparison()
+			eq, err := areFileContentsEqual(ls.status, g[0].pathname(), c.pathname())
+			if ctxErr := ls.ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err != nil {
+				ls.Results.addError(errOp(err, OpRead), c.pathname(), err)
+				if !ls.Options.IgnoreWalkErrors {
+					return err
+				}
+				continue CandidateLoop
+			}
+			if eq {
+				groups[i] = append(g, c)
+				continue CandidateLoop
+			}
+		}
+		groups = append(groups, []crossDevCandidate{c})
+	}
+
+	for _, g := range groups {
+		cdg := CrossDeviceGroup{Size: size}
+		for _, c := range g {
+			if len(cdg.Devices) == 0 || cdg.Devices[len(cdg.Devices)-1] != c.f.Dev {
+				cdg.Devices = append(cdg.Devices, c.f.Dev)
+			}
+			for ino := range c.inos {
+				for _, p := range c.f.InoPaths[ino].PathsAsSlice() {
+					cdg.Paths = append(cdg.Paths, p.Join())
+				}
+			}
+		}
+		if len(cdg.Devices) < 2 {
+			continue
+		}
+		sort.Strings(cdg.Paths)
+		cdg.SaveableBytes = size * uint64(len(cdg.Devices)-1)
+		ls.Results.foundCrossDeviceGroup(cdg)
+	}
+	return nil
+}
+
+// OutputCrossDevice shows in text form the groups of identical files found on
+// more than one device.
+func (r *Results) OutputCrossDevice() {
+	if len(r.CrossDeviceGroups) == 0 {
+		return
+	}
+	fmt.Println("Identical files on multiple devices (not linkable)")
+	fmt.Println("--------------------------------------------------")
+	s := make([]string, 0)
+	for _, g := range r.CrossDeviceGroups {
+		s = append(s, fmt.Sprintf("Filesize: %v  Devices: %v  Saveable: %v",
+			Humanize(g.Size), len(g.Devices), Humanize(g.SaveableBytes)))
+		for _, p := range g.Paths {
+			s = append(s, "  "+p)
+		}
+	}
+	fmt.Println(strings.Join(s, "\n"))
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// otherDeviceDir returns a temporary dir on a different device than dir, or
+// the empty string if none can be found.
+func otherDeviceDir(dir string) string {
+	devOf := func(pathname string) (uint64, bool) {
+		fi, err := os.Stat(pathname)
+		if err != nil {
+			return 0, false
+		}
+		return uint64(fi.Sys().(*syscall.Stat_t).Dev), true
+	}
+	dev, _ := devOf(dir)
+	for _, candidate := range []string{"/dev/shm", "/run/user", "/var/tmp"} {
+		if d, ok := devOf(candidate); !ok || d == dev {
+			continue
+		}
+		if other, err := ioutil.TempDir(candidate, "hardlinkable"); err == nil {
+			return other
+		}
+	}
+	return ""
+}
+
+func TestRunCrossDevice(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	otherdir := otherDeviceDir(topdir)
+	if otherdir == "" {
+		t.Skip("No writable dir found on a second device")
+	}
+	defer os.RemoveAll(otherdir)
+
+	opts := SetupOptions(ReportCrossDevice, LinkingEnabled)
+
+	name := "testname: 'Cross Device'"
+
+	m := pathContents{
+		"f1": "XXX", "f2": "XXX", // Linkable on this device
+		"g1":                          "YYY",
+		filepath.Join(otherdir, "f3"): "XXX",
+		filepath.Join(otherdir, "g2"): "ZZZ", // Same size, different content
+	}
+	simpleFileMaker(t, m)
+	result := simpleRun(name, t, opts, 1, ".", otherdir)
+
+	if len(result.CrossDeviceGroups) != 1 {
+		t.Fatalf("%v: Expected 1 CrossDeviceGroup, got: %+v", name, result.CrossDeviceGroups)
+	}
+	g := result.CrossDeviceGroups[0]
+	want := []string{filepath.Join(otherdir, "f3"), "f1", "f2"}
+	if g.Size != 3 || len(g.Devices) != 2 || len(g.Paths) != 3 {
+		t.Errorf("%v: Unexpected CrossDeviceGroup: %+v", name, g)
+	}
+	for i, p := range want {
+		if i < len(g.Paths) && g.Paths[i] != p {
+			t.Errorf("%v: Expected path %v, got: %v", name, p, g.Paths[i])
+		}
+	}
+	if g.SaveableBytes != 3 || result.CrossDeviceByteAmount != 3 {
+		t.Errorf("%v: Expected 3 saveable bytes, got: %v %v", name,
+			g.SaveableBytes, result.CrossDeviceByteAmount)
+	}
+	// Digests computed during the walk are reused, so no inode is read
+	// for its digest twice
+	if result.DigestComputedCount > result.InodeCount {
+		t.Errorf("%v: Expected at most %v computed digests, got: %v", name,
+			result.InodeCount, result.DigestComputedCount)
+	}
+	// Never linked across devices
+	if n := nlinkVal(filepath.Join(otherdir, "f3")); n != 1 {
+		t.Errorf("%v: Expected nlink 1 for f3, got: %v", name, n)
+	}
+	verifyContents(name, t, m)
+}
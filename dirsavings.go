@@ -0,0 +1,169 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+// DirSavings holds the amount of bytes saved by existing links, new links and
+// removed inodes, for pathnames within a directory (including all of its
+// subdirectories).
+type DirSavings struct {
+	Dir               string `json:"dir"`
+	ExistingLinkBytes uint64 `json:"existingLinkBytes"`
+	NewLinkBytes      uint64 `json:"newLinkBytes"`
+	InodeRemovedBytes uint64 `json:"inodeRemovedBytes"`
+}
+
+// TotalBytes returns the bytes saved by existing links and removed inodes
+// (the same way that the total saved bytes is computed for the whole Run).
+func (d DirSavings) TotalBytes() uint64 {
+	return d.ExistingLinkBytes + d.InodeRemovedBytes
+}
+
+// dirSavingsTally accumulates DirSavings during the Run, rolled up to the
+// directory prefixes at the chosen depth below each root.
+type dirSavingsTally struct {
+	roots    []string // Cleaned, and with a trailing "/" (except for ".")
+	depth    int
+	prefixes map[string]string // Pathsplit Dirname -> rolled up prefix
+	savings  map[string]*DirSavings
+}
+
+func newDirSavingsTally(roots []string, depth int) *dirSavingsTally {
+	t := dirSavingsTally{
+		depth:    depth,
+		prefixes: make(map[string]string),
+		savings:  make(map[string]*DirSavings),
+	}
+	for _, root := range roots {
+		root = path.Clean(root)
+		if root != "." && root != "/" {
+			root += "/"
+		}
+		t.roots = append(t.roots, root)
+	}
+	// Check longest roots first, so that nested roots are preferred
+	sort.Slice(t.roots, func(i, j int) bool { return len(t.roots[i]) > len(t.roots[j]) })
+	return &t
+}
+
+// prefix returns the directory (at most depth components below its root) that
+// the given dirname is rolled up into.
+func (t *dirSavingsTally) prefix(dirname string) string {
+	if p, ok := t.prefixes[dirname]; ok {
+		return p
+	}
+	root, rest := "", strings.TrimSuffix(dirname, "/")
+	for _, r := range t.roots {
+		if r == "." && !strings.HasPrefix(dirname, "/") {
+			root, rest = ".", strings.TrimPrefix(rest, "./")
+			break
+		}
+		if r == "/" && strings.HasPrefix(dirname, r) {
+			root, rest = "/", dirname
+			break
+		}
+		if strings.HasPrefix(dirname, r) {
+			root, rest = strings.TrimSuffix(r, "/"), strings.TrimPrefix(dirname, r)
+			break
+		}
+	}
+	var p string
+	components := strings.FieldsFunc(rest, func(c rune) bool { return c == '/' })
+	if len(components) > t.depth {
+		components = components[:t.depth]
+	}
+	if root == "" {
+		p = path.Join(components...)
+	} else if root == "/" {
+		p = "/" + path.Join(components...)
+	} else {
+		p = path.Join(append([]string{root}, components...)...)
+	}
+	t.prefixes[dirname] = p
+	return p
+}
+
+func (t *dirSavingsTally) get(ps P.Pathsplit) *DirSavings {
+	p := t.prefix(ps.Dirname)
+	d, ok := t.savings[p]
+	if !ok {
+		d = &DirSavings{Dir: p}
+		t.savings[p] = d
+	}
+	return d
+}
+
+// top returns the N directories with the largest TotalBytes (or NewLinkBytes,
+// as a tie breaker), in descending order.
+func (t *dirSavingsTally) top(N int) []DirSavings {
+	s := make([]DirSavings, 0, len(t.savings))
+	for _, d := range t.savings {
+		s = append(s, *d)
+	}
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].TotalBytes() != s[j].TotalBytes() {
+			return s[i].TotalBytes() > s[j].TotalBytes()
+		}
+		if s[i].NewLinkBytes != s[j].NewLinkBytes {
+			return s[i].NewLinkBytes > s[j].NewLinkBytes
+		}
+		return s[i].Dir < s[j].Dir
+	})
+	if len(s) > N {
+		s = s[:N]
+	}
+	return s
+}
+
+// OutputDirSavings shows in text form the directories holding the most
+// linked (or linkable) bytes.
+func (r *Results) OutputDirSavings() {
+	if len(r.DirSavings) == 0 {
+		return
+	}
+	var s1, s2 string
+	if r.Opts.LinkingEnabled {
+		s1 = "New linked"
+		s2 = "Removed"
+	} else {
+		s1 = "New linkable"
+		s2 = "Removable"
+	}
+	title := fmt.Sprintf("Savings by directory (depth %v)", r.Opts.DirSavingsDepth)
+	fmt.Println(title)
+	fmt.Println(strings.Repeat("-", len(title)))
+	a := make([][]string, 0)
+	a = statStr(a, "Directory", "Total saved", "Currently linked", s1, s2)
+	for _, d := range r.DirSavings {
+		a = statStr(a, d.Dir, Humanize(d.TotalBytes()),
+			Humanize(d.ExistingLinkBytes), Humanize(d.NewLinkBytes),
+			Humanize(d.InodeRemovedBytes))
+	}
+	printSlices(a)
+}
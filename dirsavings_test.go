@@ -0,0 +1,64 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"reflect"
+	"testing"
+
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+func TestDirSavingsPrefix(t *testing.T) {
+	tally := newDirSavingsTally([]string{".", "/srv/", "/srv/mirror", "/"}, 2)
+	prefixes := map[string]string{
+		"":                       ".",
+		"a/":                     "a",
+		"a/b/c/":                 "a/b",
+		"/srv/":                  "/srv",
+		"/srv/home/u1/docs/":     "/srv/home/u1",
+		"/srv/mirror/x/y/z/":     "/srv/mirror/x/y",
+		"/srv/mirror/":           "/srv/mirror",
+		"/other/dir/and/deeper/": "/other/dir",
+	}
+	for dirname, want := range prefixes {
+		if got := tally.prefix(dirname); got != want {
+			t.Errorf("prefix(%q) expected: %q, got: %q", dirname, want, got)
+		}
+	}
+}
+
+func TestDirSavingsTop(t *testing.T) {
+	tally := newDirSavingsTally([]string{"top"}, 1)
+	tally.get(P.Split("top/a/f1", nil)).ExistingLinkBytes += 10
+	tally.get(P.Split("top/a/b/f1", nil)).InodeRemovedBytes += 5
+	tally.get(P.Split("top/b/f1", nil)).NewLinkBytes += 30
+	tally.get(P.Split("top/b/f1", nil)).InodeRemovedBytes += 20
+	tally.get(P.Split("top/c/f1", nil)).NewLinkBytes += 1
+
+	want := []DirSavings{
+		{Dir: "top/b", NewLinkBytes: 30, InodeRemovedBytes: 20},
+		{Dir: "top/a", ExistingLinkBytes: 10, InodeRemovedBytes: 5},
+	}
+	if got := tally.top(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("top(2) expected: %+v, got: %+v", want, got)
+	}
+}
@@ -27,12 +27,13 @@ import (
 	"strconv"
 
 	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 // haveNotBeenModified returns an error if a given PathInfo has changed on disk
 func (fs *fsDev) haveNotBeenModified(paths ...I.PathInfo) error {
 	for _, p := range paths {
-		if hasBeenModified(p, fs.Dev) {
+		if hasBeenModified(fs.fsys, p, fs.Dev) {
 			return fmt.Errorf("Detected modified file before linking: %v", p.Pathsplit.Join())
 		}
 	}
@@ -44,11 +45,11 @@ func (fs *fsDev) hardlinkFiles(src, dst I.PathInfo) error {
 	// Add some randomness to the tmpName to minimize chances of collisions
 	// with deliberately targeted matching names
 	tmpName := dst.Pathsplit.Join() + ".tmp" + strconv.FormatUint(rand.Uint64(), 36)
-	if err := os.Link(src.Pathsplit.Join(), tmpName); err != nil {
+	if err := fs.fsys.Link(src.Pathsplit.Join(), tmpName); err != nil {
 		return err
 	}
-	if err := os.Rename(tmpName, dst.Pathsplit.Join()); err != nil {
-		os.Remove(tmpName)
+	if err := fs.fsys.Rename(tmpName, dst.Pathsplit.Join()); err != nil {
+		fs.fsys.Remove(tmpName)
 		return err
 	}
 
@@ -56,9 +57,10 @@ func (fs *fsDev) hardlinkFiles(src, dst I.PathInfo) error {
 		// Use destination file times if it's most recently modified
 		dstTime := dst.Mtim
 		if dstTime.After(src.Mtim) {
-			err := os.Chtimes(src.Pathsplit.Join(), dstTime, dstTime)
+			err := fs.fsys.Chtimes(src.Pathsplit.Join(), dstTime, dstTime)
 			if err != nil {
 				fs.Results.FailedLinkChtimesCount++
+				fs.Results.addError(OpChtimes, src.Pathsplit.Join(), err)
 				// Ignore this error, and just return early, as we
 				// don't want to abort the Run().
 				return nil
@@ -69,12 +71,14 @@ func (fs *fsDev) hardlinkFiles(src, dst I.PathInfo) error {
 			si.Mtim = dst.Mtim
 
 			// Change uid/gid if possible
-			err = os.Lchown(src.Pathsplit.Join(), int(src.Uid), int(src.Gid))
+			err = fs.fsys.Lchown(src.Pathsplit.Join(), int(dst.Uid), int(dst.Gid))
 			if err != nil {
 				fs.Results.FailedLinkChownCount++
+				fs.Results.addError(OpChown, src.Pathsplit.Join(), err)
 				return nil
 			}
 			// Chown succeeded, so update the cached stat structures
+			fs.Results.changedOwner(si, &dst.StatInfo)
 			si.Uid = dst.Uid
 			si.Gid = dst.Gid
 		}
@@ -82,21 +86,35 @@ func (fs *fsDev) hardlinkFiles(src, dst I.PathInfo) error {
 	return nil
 }
 
-func hasBeenModified(pi I.PathInfo, dev uint64) bool {
-	newDSI, err := I.LStatInfo(pi.Pathsplit.Join())
-	if err != nil {
-		return true
+func hasBeenModified(fsys vfs.FS, pi I.PathInfo, dev uint64) bool {
+	return modifiedReason(fsys, pi, dev) != ""
+}
+
+// modifiedReason describes how the file on disk differs from the given
+// PathInfo, or returns "" if it doesn't
+func modifiedReason(fsys vfs.FS, pi I.PathInfo, dev uint64) string {
+	newDSI, err := I.LStatInfo(fsys, pi.Pathsplit.Join())
+	if os.IsNotExist(err) {
+		return "file removed"
+	} else if err != nil {
+		return err.Error()
 	}
 
-	if newDSI.Dev != dev ||
-		newDSI.Ino != pi.Ino ||
-		newDSI.Nlink != pi.Nlink ||
-		newDSI.Size != pi.Size ||
-		!newDSI.Mtim.Equal(pi.Mtim) ||
-		newDSI.Mode != pi.Mode ||
-		newDSI.Uid != pi.Uid ||
-		newDSI.Gid != pi.Gid {
-		return true
+	switch {
+	case newDSI.Dev != dev:
+		return "device changed"
+	case newDSI.Ino != pi.Ino:
+		return "inode changed"
+	case newDSI.Nlink != pi.Nlink:
+		return "link count changed"
+	case newDSI.Size != pi.Size:
+		return "size changed"
+	case !newDSI.Mtim.Equal(pi.Mtim):
+		return "mtime changed"
+	case newDSI.Mode != pi.Mode:
+		return "mode changed"
+	case newDSI.Uid != pi.Uid || newDSI.Gid != pi.Gid:
+		return "owner changed"
 	}
-	return false
+	return ""
 }
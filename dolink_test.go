@@ -28,6 +28,7 @@ import (
 
 	I "github.com/chadnetzer/hardlinkable/internal/inode"
 	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 func TestDoLink(t *testing.T) {
@@ -56,12 +57,12 @@ func TestDoLink(t *testing.T) {
 	}
 	defer os.Remove(f2.Name())
 
-	dsi1, err := I.LStatInfo(f1.Name())
+	dsi1, err := I.LStatInfo(vfs.OS, f1.Name())
 	if err != nil {
 		t.Fatalf("Couldn't run LStatInfo(f1.Name()): %v", err)
 	}
 
-	dsi2, err := I.LStatInfo(f2.Name())
+	dsi2, err := I.LStatInfo(vfs.OS, f2.Name())
 	if err != nil {
 		t.Fatalf("Couldn't run LStatInfo(f2.Name()): %v", err)
 	}
@@ -81,11 +82,11 @@ func TestDoLink(t *testing.T) {
 		t.Errorf("Linking ps1 and ps2 failed: %v %v", dsi1, dsi2)
 	}
 
-	dsi11, err := I.LStatInfo(f1.Name())
+	dsi11, err := I.LStatInfo(vfs.OS, f1.Name())
 	if err != nil {
 		t.Fatalf("Error Stat()ing file: %v", f1.Name())
 	}
-	dsi12, err := I.LStatInfo(f2.Name())
+	dsi12, err := I.LStatInfo(vfs.OS, f2.Name())
 	if err != nil {
 		t.Fatalf("Error Stat()ing file: %v", f1.Name())
 	}
@@ -103,7 +104,7 @@ func TestDoLink(t *testing.T) {
 	}
 	defer os.Remove(f3.Name())
 
-	dsi3, err := I.LStatInfo(f3.Name())
+	dsi3, err := I.LStatInfo(vfs.OS, f3.Name())
 	if err != nil {
 		t.Fatalf("Couldn't run LStatInfo(f3.Name()): %v", err)
 	}
@@ -137,7 +138,7 @@ func TestHasBeenModified(t *testing.T) {
 	}
 
 	// Make PathInfo for created file
-	dsi, err := I.LStatInfo(filename)
+	dsi, err := I.LStatInfo(vfs.OS, filename)
 	if err != nil {
 		t.Fatalf("Couldn't stat test file '%v'", filename)
 	}
@@ -145,54 +146,54 @@ func TestHasBeenModified(t *testing.T) {
 	pi := I.PathInfo{Pathsplit: p, StatInfo: dsi.StatInfo}
 
 	// Change Dev so that hasBeenModified() returns true
-	if !hasBeenModified(pi, dsi.Dev+1) {
+	if !hasBeenModified(vfs.OS, pi, dsi.Dev+1) {
 		t.Errorf("Failed to detect Dev modification to file: '%v'", filename)
 	}
 
 	// Change Ino on the PathInfo, so that hasBeenModified() returns true
 	newPI := pi
 	newPI.Ino++
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect Ino modification to file: '%v'", filename)
 	}
 
 	// Change Nlink on the PathInfo, so that hasBeenModified() returns true
 	newPI = pi
 	newPI.Nlink++
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect Nlink modification to file: '%v'", filename)
 	}
 
 	// Change PathInfo time, so that hasBeenModified() returns true
 	newPI = pi
 	newPI.Mtim = newPI.Mtim.Add(-24 * time.Hour)
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect time modification to file: '%v'", filename)
 	}
 
 	// Change PathInfo ownership, so that hasBeenModified() returns true
 	newPI = pi
 	newPI.Uid++
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect UID modification to file: '%v'", filename)
 	}
 	newPI = pi
 	newPI.Gid++
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect GID modification to file: '%v'", filename)
 	}
 
 	// Change PathInfo ownership, so that hasBeenModified() returns true
 	newPI = pi
 	newPI.Mode ^= 1
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect Mode modification to file: '%v'", filename)
 	}
 
 	// Change PathInfo Size, so that hasBeenModified() returns true
 	newPI = pi
 	newPI.Size *= 2
-	if !hasBeenModified(newPI, dsi.Dev) {
+	if !hasBeenModified(vfs.OS, newPI, dsi.Dev) {
 		t.Errorf("Failed to detect Size modification to file: '%v'", filename)
 	}
 }
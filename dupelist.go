@@ -0,0 +1,308 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+// fdupes and jdupes (with -S) print the file size before each group
+var dupeSizeLine = regexp.MustCompile(`^[0-9]+ bytes? each:$`)
+
+// ReadDuplicateGroups reads the groups of duplicate files listed by fdupes
+// or jdupes (one pathname per line, with the groups separated by blank
+// lines), or in an rdfind results.txt file.  The format is detected from the
+// first line.
+func ReadDuplicateGroups(r io.Reader) ([][]string, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(len("DUPTYPE_"))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if s := string(first); strings.HasPrefix(s, "#") || s == "DUPTYPE_" {
+		return readRdfindGroups(br)
+	}
+	return readFdupesGroups(br)
+}
+
+// readFdupesGroups reads the blank line separated groups of fdupes/jdupes
+func readFdupesGroups(r io.Reader) ([][]string, error) {
+	groups := [][]string{}
+	var group []string
+	endGroup := func() {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group = nil
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			endGroup()
+		case len(group) == 0 && dupeSizeLine.MatchString(line):
+		default:
+			group = append(group, line)
+		}
+	}
+	endGroup()
+	return groups, scanner.Err()
+}
+
+// readRdfindGroups reads the rdfind results.txt format, whose lines are:
+//
+//	duptype id depth size device inode priority name
+//
+// The first file of each group has a positive id, and its duplicates have
+// the negated id.
+func readRdfindGroups(r io.Reader) ([][]string, error) {
+	groups := [][]string{}
+	index := make(map[int64]int)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 8)
+		if len(fields) != 8 || !strings.HasPrefix(fields[0], "DUPTYPE_") {
+			return nil, fmt.Errorf("Invalid rdfind line %v: %q", lineNum, line)
+		}
+		id, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rdfind id on line %v: %v", lineNum, err)
+		}
+		if id < 0 {
+			id = -id
+		}
+		i, ok := index[id]
+		if !ok {
+			i = len(groups)
+			index[id] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], fields[7])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Files without duplicates can be listed (ie. with -outputname)
+	dups := groups[:0]
+	for _, g := range groups {
+		if len(g) > 1 {
+			dups = append(dups, g)
+		}
+	}
+	return dups, nil
+}
+
+// LoadDuplicateGroupsFile reads the groups of duplicate files from an
+// fdupes, jdupes or rdfind output file.
+func LoadDuplicateGroupsFile(pathname string) ([][]string, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	groups, err := ReadDuplicateGroups(f)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read duplicate groups from %v: %v", pathname, err)
+	}
+	return groups, nil
+}
+
+// RunDuplicateGroups is like Run, but rather than walking dirs to find
+// identical files, only the files within each of the given groups (ie. as
+// listed by another duplicate finder) are compared and linked.  The files are
+// statted and compared as in a Run, so the listed files that have changed,
+// or that the Options don't allow to be linked, are left alone.  The
+// StateFile, CheckpointFile and SQLiteFile Options aren't used.
+func RunDuplicateGroups(groups [][]string, opts Options) (Results, error) {
+	return RunDuplicateGroupsContext(context.Background(), groups, opts)
+}
+
+// RunDuplicateGroupsContext is like RunDuplicateGroups, but stops early when
+// the given context is done (as with RunContext).
+func RunDuplicateGroupsContext(ctx context.Context, groups [][]string, opts Options) (Results, error) {
+	opts.StateFile, opts.CheckpointFile, opts.SQLiteFile = "", "", ""
+	opts.Resume = false
+
+	ls := newLinkableState(&opts)
+	ls.ctx = ctx
+	if err := opts.Validate(); err != nil {
+		return *ls.Results, err
+	}
+	err := ls.runGroups(groups)
+	return *ls.Results, err
+}
+
+func (ls *linkableState) runGroups(groups [][]string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Run stopped early: %v ", r)
+		}
+	}()
+
+	// Pathnames listed more than once in a group are only walked once.
+	// Pathnames also listed in an earlier group aren't walked again, but
+	// their (already indexed) inodes are compared with the later group.
+	seen := make(map[string]struct{})
+	var files []string
+	cleaned := make([][]string, len(groups))
+	for i, g := range groups {
+		var paths []string
+		inGroup := make(map[string]struct{})
+		for _, pathname := range g {
+			pathname = path.Clean(pathname)
+			if _, ok := inGroup[pathname]; ok {
+				continue
+			}
+			inGroup[pathname] = struct{}{}
+			paths = append(paths, pathname)
+			if _, ok := seen[pathname]; !ok {
+				seen[pathname] = struct{}{}
+				files = append(files, pathname)
+			}
+		}
+		cleaned[i] = paths
+	}
+	ls.Results.setRoots(nil, files)
+	ls.Results.start()
+	defer ls.Results.end()
+
+	ls.setPhase(WalkPhase)
+	walked := make(map[string]struct{})
+	for _, paths := range cleaned {
+		// Forgetting the inode hashes of the previous groups keeps
+		// their files from being compared with this group's
+		for dev, fsdev := range ls.fsDevs {
+			fsdev.inoHashes = make(I.InoHashes)
+			ls.fsDevs[dev] = fsdev
+		}
+		for _, pathname := range paths {
+			if err := ls.ctx.Err(); err != nil {
+				return err
+			}
+			if _, ok := walked[pathname]; ok {
+				if err := ls.groupWalkedFile(pathname); err != nil {
+					return err
+				}
+				continue
+			}
+			walked[pathname] = struct{}{}
+			if isPolicyExcluded(ls.policy, pathname, ls.Results) ||
+				!isFileIncluded(pathname, ls.Options, ls.Results) {
+				ls.observer.FileRejected(pathname, RejectExcluded)
+				continue
+			}
+			if err := ls.walkFile(pathname, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ls.report(); err != nil {
+		return err
+	}
+
+	ls.setPhase(LinkPhase)
+	for _, fsdev := range ls.fsDevs {
+		if err := fsdev.generateLinks(); err != nil {
+			return err
+		}
+	}
+	if err := ls.ctx.Err(); err != nil {
+		return err
+	}
+	ls.Results.runCompletedSuccessfully()
+	ls.observer.PhaseChanged(EndPhase)
+	return nil
+}
+
+// groupWalkedFile compares the inode of a pathname that was walked in an
+// earlier group with the inodes of the current group.  Pathnames that weren't
+// indexed when walked (ie. excluded or rejected), or whose inode has since
+// changed, are left alone.
+func (ls *linkableState) groupWalkedFile(pathname string) error {
+	di, err := I.LStatInfo(ls.fsys, pathname)
+	if err != nil {
+		return nil // Already reported, or removed since it was walked
+	}
+	fsdev, ok := ls.fsDevs[di.Dev]
+	if !ok || !fsdev.InoPaths.HasPath(di.Ino, P.Split(pathname, ls.pool)) {
+		return nil
+	}
+	cmpErr := fsdev.groupInode(di.Ino)
+	if err := ls.ctx.Err(); err != nil {
+		return err
+	}
+	if cmpErr != nil {
+		ls.Results.addError(errOp(cmpErr, OpRead), pathname, cmpErr)
+		if ls.Options.IgnoreWalkErrors {
+			ls.Results.SkippedFileErrCount++
+		} else {
+			return cmpErr
+		}
+	}
+	return nil
+}
+
+// groupInode compares an already indexed inode with the inodes of the same
+// hash, as FindIdenticalFiles does for a newly found inode, and adds it to the
+// inode hashes if it isn't linkable to any of them.
+func (f *fsDev) groupInode(ino I.Ino) error {
+	pi := f.PathInfoFromIno(ino)
+	H := f.inoHash(&pi.StatInfo)
+	hi, ok := f.inoHashes[H]
+	if !ok {
+		f.inoHashes[H] = I.NewSet(ino)
+		return nil
+	}
+	if hi.Has(ino) || f.LinkableInos.Containing(ino).Overlaps(hi) {
+		return nil // Already compared with this group
+	}
+	cachedSeq, useDigest := f.cachedInos(H, pi)
+	for _, cachedIno := range cachedSeq {
+		areLinkable, err := f.areFilesLinkable(f.PathInfoFromIno(cachedIno), pi, useDigest)
+		if err != nil {
+			return err
+		}
+		if areLinkable {
+			f.LinkableInos.Add(cachedIno, ino)
+			return nil
+		}
+	}
+	hi.Add(ino)
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadDuplicateGroups(t *testing.T) {
+	fdupes := `6 bytes each:
+a/f1
+b/f1
+c/f1
+
+a/f2
+b/f 2
+`
+	rdfind := `# Automatically generated
+# duptype id depth size device inode priority name
+DUPTYPE_FIRST_OCCURRENCE 1 0 6 2049 10 1 a/f1
+DUPTYPE_FIRST_OCCURRENCE 3 0 6 2049 12 1 a/f2
+DUPTYPE_WITHIN_SAME_TREE -1 0 6 2049 11 1 b/f1
+DUPTYPE_UNIQUE 4 0 6 2049 14 1 c/f3
+DUPTYPE_OUTSIDE_TREE -3 1 6 2049 13 2 b/f 2
+# end of file
+`
+	expected := map[string][][]string{
+		fdupes: {{"a/f1", "b/f1", "c/f1"}, {"a/f2", "b/f 2"}},
+		rdfind: {{"a/f1", "b/f1"}, {"a/f2", "b/f 2"}},
+	}
+	for text, groups := range expected {
+		got, err := ReadDuplicateGroups(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, groups) {
+			t.Errorf("Expected groups %v, got %v", groups, got)
+		}
+	}
+
+	bad := "# rdfind\nDUPTYPE_FIRST_OCCURRENCE x 0 6 2049 10 1 a/f1\n"
+	if _, err := ReadDuplicateGroups(strings.NewReader(bad)); err == nil {
+		t.Errorf("Expected an error for an invalid rdfind id")
+	}
+}
+
+func TestRunDuplicateGroups(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	opts.LinkingEnabled = true
+	groups := [][]string{
+		{"a/f1", "./b/f1"},       // c/f1 is identical, but in another group
+		{"a/f2", "c/f3", "b/f2"}, // c/f3 isn't identical
+		{"c/f3", "c/f1", "b/f1"}, // Pathnames from earlier groups are compared again
+	}
+	r, err := RunDuplicateGroups(groups, opts)
+	if err != nil {
+		t.Fatalf("RunDuplicateGroups failed: %v", err)
+	}
+	if r.NewLinkCount != 3 || r.InodeRemovedCount != 3 {
+		t.Errorf("Expected 3 links and removed inodes, got %v and %v",
+			r.NewLinkCount, r.InodeRemovedCount)
+	}
+	if memIno(t, m, "a/f1") != memIno(t, m, "b/f1") ||
+		memIno(t, m, "a/f2") != memIno(t, m, "b/f2") {
+		t.Errorf("Listed duplicates weren't linked")
+	}
+	if memIno(t, m, "a/f1") != memIno(t, m, "c/f1") {
+		t.Errorf("Duplicate grouped with a file from an earlier group wasn't linked")
+	}
+	if memIno(t, m, "a/f2") == memIno(t, m, "c/f3") {
+		t.Errorf("Different files were linked")
+	}
+	if groups[0][1] != "./b/f1" {
+		t.Errorf("Given groups were modified")
+	}
+}
+
+func TestRunDuplicateGroupsSameName(t *testing.T) {
+	files := map[string]string{
+		"a/f1": "same",
+		"b/f1": "same",
+		"b/f2": "same",
+	}
+	m := policyMemFS(t, files, nil)
+	opts := SetupOptions(SameName)
+	opts.FS = m
+	opts.LinkingEnabled = true
+	r, err := RunDuplicateGroups([][]string{{"a/f1", "b/f1", "b/f2"}}, opts)
+	if err != nil {
+		t.Fatalf("RunDuplicateGroups failed: %v", err)
+	}
+	if r.NewLinkCount != 1 || memIno(t, m, "a/f1") != memIno(t, m, "b/f1") {
+		t.Errorf("Expected only the same named files to be linked, got %v links", r.NewLinkCount)
+	}
+	if memIno(t, m, "b/f2") == memIno(t, m, "b/f1") {
+		t.Errorf("Differently named file was linked")
+	}
+}
+
+// TestRunDuplicateGroupsOnly checks that identical files are only linked when
+// they are listed in the same group
+func TestRunDuplicateGroupsOnly(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	opts.LinkingEnabled = true
+	groups := [][]string{
+		{"a/f1", "b/f1"},
+		{"c/f1", "c/f3"},
+		{"c/f3", "a/f1"}, // c/f3 isn't identical to either
+	}
+	r, err := RunDuplicateGroups(groups, opts)
+	if err != nil {
+		t.Fatalf("RunDuplicateGroups failed: %v", err)
+	}
+	if r.NewLinkCount != 1 || memIno(t, m, "a/f1") != memIno(t, m, "b/f1") {
+		t.Errorf("Expected only a/f1 and b/f1 to be linked, got %v links", r.NewLinkCount)
+	}
+	if memIno(t, m, "a/f1") == memIno(t, m, "c/f1") {
+		t.Errorf("Duplicate from another group was linked")
+	}
+}
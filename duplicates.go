@@ -0,0 +1,250 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"math/bits"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DuplicateReport shows how the duplicated data is distributed, by file size,
+// by file extension, and by the largest groups of identical inodes.  For each
+// group of linkable inodes, all but one inode is counted as a duplicate.  The
+// counts are gathered after the walk, so they are an upper bound on what the
+// link phase can remove (SameName, or the maximum nlink count, can prevent all
+// the inodes of a group from being linked together).
+type DuplicateReport struct {
+	SizeBuckets []SizeBucket         `json:"sizeBuckets"`
+	Extensions  []ExtensionDuplicate `json:"extensions"`
+	Groups      []DuplicateGroup     `json:"groups"`
+}
+
+// SizeBucket holds the count and bytes of duplicate inodes with a size from
+// MinSize up to (but not including) MaxSize.  The bucket sizes are powers of
+// two.
+type SizeBucket struct {
+	MinSize uint64 `json:"minSize"`
+	MaxSize uint64 `json:"maxSize"`
+	Count   int64  `json:"count"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// ExtensionDuplicate holds the count and bytes of duplicate inodes with the
+// given filename extension (empty if the filename has none)
+type ExtensionDuplicate struct {
+	Ext   string `json:"ext"`
+	Count int64  `json:"count"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// DuplicateGroup is a group of identical inodes (that are all allowed to be
+// linked together), and the pathnames to them.
+type DuplicateGroup struct {
+	Size           uint64   `json:"size"`
+	InodeCount     int      `json:"inodeCount"`
+	DuplicateBytes uint64   `json:"duplicateBytes"`
+	Paths          []string `json:"paths"`
+}
+
+// duplicateTally accumulates the DuplicateReport over all the fsDevs
+type duplicateTally struct {
+	topN    int
+	buckets map[int]*SizeBucket // key = log2 bucket index
+	exts    map[string]*ExtensionDuplicate
+	groups  []DuplicateGroup
+}
+
+func newDuplicateTally(topN int) *duplicateTally {
+	return &duplicateTally{
+		topN:    topN,
+		buckets: make(map[int]*SizeBucket),
+		exts:    make(map[string]*ExtensionDuplicate),
+	}
+}
+
+func (t *duplicateTally) addDuplicate(size uint64, filename string) {
+	i := bits.Len64(size) // 0 for empty files
+	b, ok := t.buckets[i]
+	if !ok {
+		b = &SizeBucket{}
+		if i > 0 {
+			b.MinSize = uint64(1) << uint(i-1)
+			b.MaxSize = b.MinSize << 1 // Zero when overflowed
+		}
+		t.buckets[i] = b
+	}
+	b.Count++
+	b.Bytes += size
+
+	ext := strings.ToLower(path.Ext(filename))
+	e, ok := t.exts[ext]
+	if !ok {
+		e = &ExtensionDuplicate{Ext: ext}
+		t.exts[ext] = e
+	}
+	e.Count++
+	e.Bytes += size
+}
+
+// admits returns true if a group with the given duplicate bytes would be kept
+// by addGroup, so that the paths of the other groups needn't be gathered
+func (t *duplicateTally) admits(duplicateBytes uint64) bool {
+	if t.topN <= 0 {
+		return false
+	}
+	return len(t.groups) < t.topN || duplicateBytes > t.groups[len(t.groups)-1].DuplicateBytes
+}
+
+// addGroup keeps the topN largest groups, by duplicate bytes
+func (t *duplicateTally) addGroup(g DuplicateGroup) {
+	if !t.admits(g.DuplicateBytes) {
+		return
+	}
+	if len(t.groups) == t.topN {
+		t.groups = t.groups[:len(t.groups)-1]
+	}
+	i := sort.Search(len(t.groups), func(i int) bool {
+		return t.groups[i].DuplicateBytes < g.DuplicateBytes
+	})
+	t.groups = append(t.groups, DuplicateGroup{})
+	copy(t.groups[i+1:], t.groups[i:])
+	t.groups[i] = g
+}
+
+func (t *duplicateTally) report() *DuplicateReport {
+	d := DuplicateReport{
+		SizeBuckets: []SizeBucket{},
+		Extensions:  []ExtensionDuplicate{},
+		Groups:      t.groups,
+	}
+	if d.Groups == nil {
+		d.Groups = []DuplicateGroup{}
+	}
+	for _, b := range t.buckets {
+		d.SizeBuckets = append(d.SizeBuckets, *b)
+	}
+	sort.Slice(d.SizeBuckets, func(i, j int) bool {
+		return d.SizeBuckets[i].MinSize < d.SizeBuckets[j].MinSize
+	})
+	for _, e := range t.exts {
+		d.Extensions = append(d.Extensions, *e)
+	}
+	sort.Slice(d.Extensions, func(i, j int) bool {
+		if d.Extensions[i].Bytes != d.Extensions[j].Bytes {
+			return d.Extensions[i].Bytes > d.Extensions[j].Bytes
+		}
+		return d.Extensions[i].Ext < d.Extensions[j].Ext
+	})
+	if len(d.Extensions) > t.topN {
+		d.Extensions = d.Extensions[:t.topN]
+	}
+	return &d
+}
+
+// tallyDuplicates adds the groups of linkable inodes to the duplicateTally.
+// It must be called after the walk, but before the link phase modifies the
+// inode and path information.
+func (f *fsDev) tallyDuplicates(t *duplicateTally) {
+	for linkableSet := range f.LinkableInos.All(f.ctx.Done()) {
+		// The inode with the highest nlink is the one most likely to
+		// be kept, so count the rest as the duplicates
+		sortedInos := f.sortSetByNlink(linkableSet)
+		size := f.inoStatInfo[sortedInos[0]].Size
+		g := DuplicateGroup{
+			Size:           size,
+			InodeCount:     len(sortedInos),
+			DuplicateBytes: size * uint64(len(sortedInos)-1),
+		}
+		for _, ino := range sortedInos[1:] {
+			t.addDuplicate(size, f.InoPaths.ArbitraryPath(ino).Filename)
+		}
+		// Only the paths of the groups that are kept are gathered
+		if !t.admits(g.DuplicateBytes) {
+			continue
+		}
+		for _, ino := range sortedInos {
+			for _, p := range f.InoPaths[ino].PathsAsSlice() {
+				g.Paths = append(g.Paths, p.Join())
+			}
+		}
+		sort.Strings(g.Paths)
+		t.addGroup(g)
+	}
+}
+
+// OutputDuplicateReport shows in text form the distribution of duplicate
+// inodes by size and extension, and the largest groups of identical inodes.
+func (r *Results) OutputDuplicateReport() {
+	d := r.DuplicateReport
+	if d == nil {
+		return
+	}
+	fmt.Println("Duplicates by size")
+	fmt.Println("------------------")
+	a := make([][]string, 0)
+	a = statStr(a, "Size range", "Duplicates", "Bytes")
+	for _, b := range d.SizeBuckets {
+		var rng string
+		if b.MaxSize == 0 && b.MinSize == 0 {
+			rng = "empty"
+		} else if b.MaxSize == 0 {
+			rng = fmt.Sprintf(">= %v", Humanize(b.MinSize))
+		} else {
+			rng = fmt.Sprintf("%v - %v", Humanize(b.MinSize), Humanize(b.MaxSize))
+		}
+		a = statStr(a, rng, b.Count, Humanize(b.Bytes))
+	}
+	printSlices(a)
+
+	fmt.Println("")
+	fmt.Println("Duplicates by extension")
+	fmt.Println("-----------------------")
+	a = make([][]string, 0)
+	a = statStr(a, "Extension", "Duplicates", "Bytes")
+	for _, e := range d.Extensions {
+		ext := e.Ext
+		if ext == "" {
+			ext = "(none)"
+		}
+		a = statStr(a, ext, e.Count, Humanize(e.Bytes))
+	}
+	printSlices(a)
+
+	if len(d.Groups) == 0 {
+		return
+	}
+	fmt.Println("")
+	fmt.Println("Largest duplicate groups")
+	fmt.Println("------------------------")
+	s := make([]string, 0)
+	for _, g := range d.Groups {
+		s = append(s, fmt.Sprintf("Filesize: %v  Inodes: %v  Duplicate bytes: %v",
+			Humanize(g.Size), g.InodeCount, Humanize(g.DuplicateBytes)))
+		for _, p := range g.Paths {
+			s = append(s, "  "+p)
+		}
+		fmt.Println(strings.Join(s, "\n"))
+		s = []string{}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRunDuplicateReport(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(ReportDuplicates(1))
+
+	name := "testname: 'Duplicate Report'"
+
+	m := pathContents{
+		"a.txt": "XXXXX", "b.txt": "XXXXX", "c.txt": "XXXXX",
+		"d.bin": "YY", "e.BIN": "YY",
+		"f.txt": "Z",
+	}
+	simpleFileMaker(t, m)
+	simpleLinkMaker(t, "a.txt", "a2.txt")
+	result := simpleRun(name, t, opts, 2, ".")
+
+	d := result.DuplicateReport
+	if d == nil {
+		t.Fatalf("%v: Expected a DuplicateReport", name)
+	}
+	wantBuckets := []SizeBucket{
+		{MinSize: 2, MaxSize: 4, Count: 1, Bytes: 2},
+		{MinSize: 4, MaxSize: 8, Count: 2, Bytes: 10},
+	}
+	if !reflect.DeepEqual(d.SizeBuckets, wantBuckets) {
+		t.Errorf("%v: SizeBuckets expected: %+v, got: %+v", name, wantBuckets, d.SizeBuckets)
+	}
+	wantExts := []ExtensionDuplicate{{Ext: ".txt", Count: 2, Bytes: 10}}
+	if !reflect.DeepEqual(d.Extensions, wantExts) {
+		t.Errorf("%v: Extensions expected: %+v, got: %+v", name, wantExts, d.Extensions)
+	}
+	wantGroups := []DuplicateGroup{{
+		Size:           5,
+		InodeCount:     3,
+		DuplicateBytes: 10,
+		Paths:          []string{"a.txt", "a2.txt", "b.txt", "c.txt"},
+	}}
+	if !reflect.DeepEqual(d.Groups, wantGroups) {
+		t.Errorf("%v: Groups expected: %+v, got: %+v", name, wantGroups, d.Groups)
+	}
+}
+
+func TestDuplicateTallyTopGroups(t *testing.T) {
+	tally := newDuplicateTally(2)
+	for _, n := range []uint64{3, 1, 5, 2, 4} {
+		tally.addGroup(DuplicateGroup{DuplicateBytes: n})
+	}
+	var got []uint64
+	for _, g := range tally.groups {
+		got = append(got, g.DuplicateBytes)
+	}
+	if !reflect.DeepEqual(got, []uint64{5, 4}) {
+		t.Errorf("Expected the 2 largest groups, got: %v", got)
+	}
+	if tally.admits(4) || !tally.admits(6) {
+		t.Errorf("Expected only groups larger than the smallest kept group to be admitted")
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// fault fails the matching calls of an operation with the given errno
+type fault struct {
+	op    string // One of the Op constants
+	path  string // Only fail pathnames with this prefix (any if empty)
+	after int    // Number of matching calls that succeed first
+	errno syscall.Errno
+	calls int
+}
+
+// faultFS wraps a vfs.FS, and injects faults into the link, rename, remove,
+// chtimes, chown, stat and open operations.  Link and rename calls match
+// the path against both the old and new names (which for hardlinkFiles()
+// are the src and the dst based temp name, or the temp name and dst).
+type faultFS struct {
+	vfs.FS
+	faults []*fault
+}
+
+func (f *faultFS) inject(op string, pathnames ...string) syscall.Errno {
+	for _, ft := range f.faults {
+		if ft.op != op {
+			continue
+		}
+		matched := ft.path == ""
+		for _, p := range pathnames {
+			matched = matched || strings.HasPrefix(p, ft.path)
+		}
+		if !matched {
+			continue
+		}
+		ft.calls++
+		if ft.calls > ft.after {
+			return ft.errno
+		}
+	}
+	return 0
+}
+
+func (f *faultFS) Lstat(pathname string) (os.FileInfo, error) {
+	if errno := f.inject(OpStat, pathname); errno != 0 {
+		return nil, &os.PathError{Op: "lstat", Path: pathname, Err: errno}
+	}
+	return f.FS.Lstat(pathname)
+}
+
+func (f *faultFS) Open(pathname string) (vfs.File, error) {
+	if errno := f.inject(OpOpen, pathname); errno != 0 {
+		return nil, &os.PathError{Op: "open", Path: pathname, Err: errno}
+	}
+	return f.FS.Open(pathname)
+}
+
+func (f *faultFS) Link(oldname, newname string) error {
+	if errno := f.inject(OpLink, oldname, newname); errno != 0 {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errno}
+	}
+	return f.FS.Link(oldname, newname)
+}
+
+func (f *faultFS) Rename(oldname, newname string) error {
+	if errno := f.inject(OpRename, oldname, newname); errno != 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errno}
+	}
+	return f.FS.Rename(oldname, newname)
+}
+
+func (f *faultFS) Chtimes(pathname string, atime, mtime time.Time) error {
+	if errno := f.inject(OpChtimes, pathname); errno != 0 {
+		return &os.PathError{Op: "chtimes", Path: pathname, Err: errno}
+	}
+	return f.FS.Chtimes(pathname, atime, mtime)
+}
+
+func (f *faultFS) Lchown(pathname string, uid, gid int) error {
+	if errno := f.inject(OpChown, pathname); errno != 0 {
+		return &os.PathError{Op: "lchown", Path: pathname, Err: errno}
+	}
+	return f.FS.Lchown(pathname, uid, gid)
+}
+
+// faultTree is the MemFS tree used by the fault tests.  The files are created
+// in sorted order, so that the lowest inode (ie. the src of the links) of
+// each group is the first pathname.
+var faultTree = pathContents{
+	"a/f1": "XXXX", "a/f2": "XXXX", "b/f3": "XXXX", "b/f4": "XXXX",
+	"a/g1": "YYYYY", "b/g2": "YYYYY", "b/g3": "YYYYY",
+	"a/h1": "ZZZ",
+}
+
+func newFaultMemFS(t *testing.T) *vfs.MemFS {
+	m := vfs.NewMemFS()
+	var names []string
+	for name := range faultTree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := m.WriteFile(name, []byte(faultTree[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func memIno(t *testing.T, m *vfs.MemFS, pathname string) uint64 {
+	fi, err := m.Lstat(pathname)
+	if err != nil {
+		t.Fatalf("Lstat(%v) failed: %v", pathname, err)
+	}
+	s, _ := vfs.StatOf(fi)
+	return s.Ino
+}
+
+// verifyFaultResults checks that the Results agree with each other, and with
+// the final state of the MemFS
+func verifyFaultResults(name string, t *testing.T, m *vfs.MemFS, r *Results) {
+	countDsts := func(groups [][]string) int64 {
+		var n int64
+		for _, g := range groups {
+			n += int64(len(g) - 1)
+		}
+		return n
+	}
+	if n := countDsts(r.LinkPaths); n != r.NewLinkCount {
+		t.Errorf("%v: NewLinkCount %v doesn't match LinkPaths dsts %v", name, r.NewLinkCount, n)
+	}
+	if n := countDsts(r.SkippedLinkPaths); n != r.SkippedLinkErrCount {
+		t.Errorf("%v: SkippedLinkErrCount %v doesn't match SkippedLinkPaths dsts %v",
+			name, r.SkippedLinkErrCount, n)
+	}
+
+	// The linked paths share the src inode, and the skipped ones don't
+	for _, g := range r.LinkPaths {
+		for _, dst := range g[1:] {
+			if memIno(t, m, dst) != memIno(t, m, g[0]) {
+				t.Errorf("%v: Expected %v to be linked to %v", name, dst, g[0])
+			}
+		}
+	}
+	for _, g := range r.SkippedLinkPaths {
+		for _, dst := range g[1:] {
+			if memIno(t, m, dst) == memIno(t, m, g[0]) {
+				t.Errorf("%v: Expected skipped %v to not be linked to %v", name, dst, g[0])
+			}
+		}
+	}
+
+	// Every failed link or rename left no temp file behind, and the
+	// removed inodes are gone
+	inos := make(map[uint64]struct{})
+	for _, dir := range []string{"a", "b"} {
+		entries, err := m.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, de := range entries {
+			if strings.Contains(de.Name, ".tmp") {
+				t.Errorf("%v: Temp link file left behind: %v/%v", name, dir, de.Name)
+			}
+			inos[memIno(t, m, dir+"/"+de.Name)] = struct{}{}
+		}
+	}
+	if want := int64(len(faultTree)) - r.InodeRemovedCount; int64(len(inos)) != want {
+		t.Errorf("%v: Expected %v remaining inodes, got: %v", name, want, len(inos))
+	}
+}
+
+func TestRunLinkFaults(t *testing.T) {
+	errnos := []syscall.Errno{syscall.EMLINK, syscall.EXDEV, syscall.EACCES, syscall.ENOSPC, syscall.EIO}
+	for _, op := range []string{OpLink, OpRename} {
+		for _, errno := range errnos {
+			for _, ignore := range []bool{true, false} {
+				name := fmt.Sprintf("testname: '%v %v ignore=%v'", op, errno, ignore)
+				m := newFaultMemFS(t)
+				// Only the links of b/f3 and b/f4 fail
+				fs := &faultFS{FS: m, faults: []*fault{{op: op, path: "b/f", errno: errno}}}
+
+				opts := SetupOptions(LinkingEnabled)
+				opts.IgnoreLinkErrors = ignore
+				opts.FS = fs
+				r, err := Run([]string{"a", "b"}, opts)
+				verifyFaultResults(name, t, m, &r)
+
+				if ignore {
+					if err != nil || !r.RunSuccessful {
+						t.Errorf("%v: Expected successful run, got: %v", name, err)
+					}
+					// Failed dsts are retried with the next src inode
+					// (ie. b/f3 to b/f4)
+					if r.SkippedLinkErrCount != 3 || r.NewLinkCount != 3 {
+						t.Errorf("%v: Expected 3 skipped and 3 new links, got: %v %v",
+							name, r.SkippedLinkErrCount, r.NewLinkCount)
+					}
+				} else {
+					if err == nil || r.RunSuccessful || r.Phase != LinkPhase {
+						t.Errorf("%v: Expected failed run in LinkPhase, got: %v %v", name, err, r.Phase)
+					}
+				}
+				if len(r.Errors) == 0 || len(r.Errors) != int(r.SkippedLinkErrCount) && ignore {
+					t.Errorf("%v: Expected an error per skipped link, got: %+v", name, r.Errors)
+				}
+				for _, e := range r.Errors {
+					if e.Op != op || e.Errno != int(errno) || e.Phase != LinkPhase {
+						t.Errorf("%v: Unexpected error: %+v", name, e)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRunLinkFaultsAfterN(t *testing.T) {
+	name := "testname: 'Link ENOSPC after 2'"
+	m := newFaultMemFS(t)
+	fs := &faultFS{FS: m, faults: []*fault{{op: OpLink, after: 2, errno: syscall.ENOSPC}}}
+
+	opts := SetupOptions(LinkingEnabled, IgnoreLinkErrors)
+	opts.FS = fs
+	r, err := Run([]string{"a", "b"}, opts)
+	if err != nil {
+		t.Fatalf("%v: Run() returned error: %v", name, err)
+	}
+	verifyFaultResults(name, t, m, &r)
+	if r.NewLinkCount != 2 || r.SkippedLinkErrCount != 4 {
+		t.Errorf("%v: Expected 2 new and 4 skipped links, got: %v %v",
+			name, r.NewLinkCount, r.SkippedLinkErrCount)
+	}
+}
+
+func TestRunNewestLinkFaults(t *testing.T) {
+	for _, op := range []string{OpChtimes, OpChown} {
+		for _, errno := range []syscall.Errno{syscall.EACCES, syscall.EIO} {
+			name := fmt.Sprintf("testname: 'Newest link %v %v'", op, errno)
+			m := newFaultMemFS(t)
+			// Make a dst newer than its src, so that the src times and
+			// ownership are updated
+			newer := time.Now().Add(time.Hour)
+			if err := m.Chtimes("a/h1", newer, newer); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.WriteFile("b/h2", []byte("ZZZ"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Chtimes("b/h2", newer.Add(time.Hour), newer.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			fs := &faultFS{FS: m, faults: []*fault{{op: op, errno: errno}}}
+
+			opts := SetupOptions(LinkingEnabled, IgnoreTime)
+			opts.FS = fs
+			r, err := Run([]string{"a", "b"}, opts)
+			if err != nil || !r.RunSuccessful {
+				t.Fatalf("%v: Expected successful run, got: %v", name, err)
+			}
+			if memIno(t, m, "a/h1") != memIno(t, m, "b/h2") {
+				t.Errorf("%v: Expected h files to be linked despite %v failure", name, op)
+			}
+			failed := r.FailedLinkChtimesCount
+			if op == OpChown {
+				failed = r.FailedLinkChownCount
+			}
+			if failed != 1 || len(r.Errors) != 1 || r.Errors[0].Op != op || r.Errors[0].Errno != int(errno) {
+				t.Errorf("%v: Expected 1 failed %v, got: %v %+v", name, op, failed, r.Errors)
+			}
+		}
+	}
+}
+
+// modifyingObserver changes a file when the link phase begins
+type modifyingObserver struct {
+	NopObserver
+	modify func()
+}
+
+func (o *modifyingObserver) PhaseChanged(phase RunPhases) {
+	if phase == LinkPhase {
+		o.modify()
+	}
+}
+
+func TestRunQuiescenceFaults(t *testing.T) {
+	modifications := map[string]func(m *vfs.MemFS) error{
+		"mtime": func(m *vfs.MemFS) error {
+			newer := time.Now().Add(time.Hour)
+			return m.Chtimes("b/f4", newer, newer)
+		},
+		"size":    func(m *vfs.MemFS) error { return m.WriteFile("b/f4", []byte("XXXXX"), 0644) },
+		"removed": func(m *vfs.MemFS) error { return m.Remove("b/f4") },
+		"linked":  func(m *vfs.MemFS) error { return m.Link("b/f4", "b/f5") },
+		"owner":   func(m *vfs.MemFS) error { return m.Lchown("b/f4", -1, os.Getgid()+1) },
+	}
+	for what, modify := range modifications {
+		for _, linking := range []bool{true, false} {
+			name := fmt.Sprintf("testname: 'Quiescence %v linking=%v'", what, linking)
+			m := newFaultMemFS(t)
+			o := &modifyingObserver{modify: func() {
+				if err := modify(m); err != nil {
+					t.Fatal(err)
+				}
+			}}
+
+			opts := SetupOptions(CheckQuiescence)
+			opts.LinkingEnabled = linking
+			opts.FS = m
+			opts.Observer = o
+			r, err := Run([]string{"a", "b"}, opts)
+			if err == nil || !strings.Contains(err.Error(), "modified file") {
+				t.Errorf("%v: Expected modified file error, got: %v", name, err)
+			}
+			if r.RunSuccessful || r.Phase != LinkPhase {
+				t.Errorf("%v: Expected run stopped in LinkPhase, got: %v", name, r.Phase)
+			}
+			if what != "removed" && what != "linked" {
+				verifyFaultResults(name, t, m, &r)
+			}
+		}
+	}
+}
+
+func TestRunWalkFaults(t *testing.T) {
+	for _, op := range []string{OpStat, OpOpen} {
+		name := fmt.Sprintf("testname: 'Walk %v EIO'", op)
+		m := newFaultMemFS(t)
+		fs := &faultFS{FS: m, faults: []*fault{{op: op, path: "b/f3", errno: syscall.EIO}}}
+
+		opts := SetupOptions(LinkingEnabled, IgnoreWalkErrors)
+		opts.FS = fs
+		r, err := Run([]string{"a", "b"}, opts)
+		if err != nil || !r.RunSuccessful {
+			t.Fatalf("%v: Expected successful run, got: %v", name, err)
+		}
+		verifyFaultResults(name, t, m, &r)
+		if r.SkippedFileErrCount == 0 || len(r.Errors) == 0 ||
+			r.Errors[0].Op != op || r.Errors[0].Path != "b/f3" || r.Errors[0].Phase != WalkPhase {
+			t.Errorf("%v: Expected a skipped b/f3 file error, got: %v %+v", name, r.SkippedFileErrCount, r.Errors)
+		}
+		if memIno(t, m, "b/f3") == memIno(t, m, "a/f1") {
+			t.Errorf("%v: Expected b/f3 to not be linked", name)
+		}
+	}
+}
@@ -69,14 +69,13 @@ func (f *fsDev) FindIdenticalFiles(di I.DevStatInfo, pathname string) (err error
 	ino := di.StatInfo.Ino
 
 	if _, ok := f.inoStatInfo[ino]; !ok {
-		f.Results.foundInode(di.StatInfo.Nlink)
+		f.Results.foundInode(f.Dev, di.StatInfo.Nlink)
 	}
 
 	// Compute a "hash" from inode stat info, and store it if new.  If it's
 	// a previously seen inode hash, check to see if one of the previously
 	// seen inodes with that hash also has identical file contents.
-	o := f.Options
-	H := I.HashIno(di.StatInfo, o.IgnoreTime, o.IgnorePerm, o.IgnoreOwner)
+	H := f.inoHash(&di.StatInfo)
 	if _, ok := f.inoHashes[H]; !ok {
 		// Setup for a newly seen hash value
 		f.Results.missedHash()
@@ -91,7 +90,7 @@ func (f *fsDev) FindIdenticalFiles(di I.DevStatInfo, pathname string) (err error
 			}
 			seenPath := f.InoPaths.ArbitraryPath(ino)
 			seenSize := f.inoStatInfo[ino].Size
-			f.Results.foundExistingLink(seenPath, curPath, seenSize)
+			f.Results.foundExistingLink(f.Dev, seenPath, curPath, seenSize)
 		}
 		// See if this inode is already one we've determined can be
 		// linked to another one, in which case we can avoid repeating
@@ -146,14 +145,21 @@ func (f *fsDev) cachedInos(H I.Hash, ps I.PathInfo) ([]I.Ino, bool) {
 	thresh := f.Options.SearchThresh
 	useDigest := thresh >= 0 && len(cachedSet) > thresh
 	if useDigest {
-		digest, err := I.ContentDigest(ps.Pathsplit.Join(), f.digestBuf)
+		// The digest may already be known (ie. from the StateFile)
+		digest, ok := f.InoDigests.Get(ps.Ino)
+		var err error
+		if !ok {
+			digest, err = I.ContentDigest(f.fsys, ps.Pathsplit.Join(), f.digestBuf)
+			if err == nil {
+				f.Results.computedDigest()
+			}
+		}
 		if err == nil {
 			// With digests, we take the (potentially long) set of cached inodes (ie.
 			// those inodes that all have the same InoHash), and remove the inodes that
 			// are definitely not a match because their digests do not match with the
 			// current inode.  We also put the inodes with equal digests before those
 			// that have no digest yet, in hopes of more quickly finding an identical file.
-			f.Results.computedDigest()
 			f.InoDigests.Add(ps, digest)
 			noDigests := cachedSet.Difference(f.InosWithDigest)
 			sameDigests := cachedSet.Intersection(f.InoDigests.GetInos(digest))
@@ -186,17 +192,21 @@ func (f *fsDev) areFilesLinkable(pi1 I.PathInfo, pi2 I.PathInfo, useDigest bool)
 	if pi1.Size != pi2.Size {
 		return false, nil
 	}
-	if !f.Options.IgnoreTime && !pi1.EqualTime(pi2) {
+	pp := f.policy.forPair(pi1.Pathsplit, pi2.Pathsplit)
+	if !pp.ignoreTime && !pi1.EqualTime(pi2) {
 		return false, nil
 	}
-	if !f.Options.IgnorePerm && !pi1.EqualMode(pi2) {
+	if !pp.ignorePerm && !pi1.EqualMode(pi2) {
 		return false, nil
 	}
-	if !f.Options.IgnoreOwner && !pi1.EqualOwnership(pi2) {
+	if !pp.ignoreOwner && !pi1.EqualOwnership(pi2) {
 		return false, nil
 	}
-	if !f.Options.IgnoreXAttr {
-		if eq, _ := I.EqualXAttrs(pi1.Join(), pi2.Join()); !eq {
+	if !pp.ignoreXAttr {
+		if eq, err := I.EqualXAttrs(f.fsys, pi1.Join(), pi2.Join()); !eq {
+			if err != nil {
+				f.Results.addError(OpXAttr, pi2.Join(), err)
+			}
 			return false, nil
 		}
 	}
@@ -204,10 +214,10 @@ func (f *fsDev) areFilesLinkable(pi1 I.PathInfo, pi2 I.PathInfo, useDigest bool)
 	// Compute digest for both files, since they will have to be read in
 	// anyway for comparison.
 	if useDigest {
-		if f.InoDigests.NewDigest(pi1, f.digestBuf) {
+		if f.InoDigests.NewDigest(f.fsys, pi1, f.digestBuf) {
 			f.Results.computedDigest()
 		}
-		if f.InoDigests.NewDigest(pi2, f.digestBuf) {
+		if f.InoDigests.NewDigest(f.fsys, pi2, f.digestBuf) {
 			f.Results.computedDigest()
 		}
 	}
@@ -243,7 +253,7 @@ func (f *fsDev) areFilesLinkable(pi1 I.PathInfo, pi2 I.PathInfo, useDigest bool)
 			f.Results.addMismatchedGIDBytes(pi1.Size)
 			addMismatchTotalBytes = true
 		}
-		eqX, err := I.EqualXAttrs(pi1.Join(), pi2.Join())
+		eqX, err := I.EqualXAttrs(f.fsys, pi1.Join(), pi2.Join())
 		if err == nil && !eqX {
 			f.Results.addMismatchedXAttrBytes(pi1.Size)
 			addMismatchTotalBytes = true
@@ -254,3 +264,78 @@ func (f *fsDev) areFilesLinkable(pi1 I.PathInfo, pi2 I.PathInfo, useDigest bool)
 	}
 	return eq, nil
 }
+
+// statChanged returns true if the inode content or attributes may differ
+func statChanged(si1, si2 *I.StatInfo) bool {
+	return si1.Size != si2.Size || !si1.Mtim.Equal(si2.Mtim) ||
+		si1.Mode != si2.Mode || si1.Uid != si2.Uid || si1.Gid != si2.Gid
+}
+
+func (f *fsDev) inoHash(si *I.StatInfo) I.Hash {
+	p := f.policy.hash
+	return I.HashIno(*si, p.ignoreTime, p.ignorePerm, p.ignoreOwner)
+}
+
+func (f *fsDev) addInoHash(ino I.Ino, si *I.StatInfo) {
+	H := f.inoHash(si)
+	if set, ok := f.inoHashes[H]; ok {
+		set.Add(ino)
+	} else {
+		f.inoHashes[H] = I.NewSet(ino)
+	}
+}
+
+func (f *fsDev) removeInoHash(ino I.Ino, si *I.StatInfo) {
+	H := f.inoHash(si)
+	if set, ok := f.inoHashes[H]; ok {
+		set.Remove(ino)
+		if len(set) == 0 {
+			delete(f.inoHashes, H)
+		}
+	}
+}
+
+// rehash rebuilds the inode hashes and digests after linking, which removes
+// inodes and (with UseNewestLink) can change the stat info of the others.
+func (f *fsDev) rehash() {
+	for H := range f.inoHashes {
+		delete(f.inoHashes, H)
+	}
+	for ino, si := range f.inoStatInfo {
+		f.addInoHash(ino, si)
+	}
+	for _, ino := range f.InosWithDigest.AsSlice() {
+		if _, ok := f.inoStatInfo[ino]; !ok {
+			f.InoDigests.Remove(ino)
+		}
+	}
+	for ino := range f.LinkableInos {
+		delete(f.LinkableInos, ino)
+	}
+}
+
+// forgetIno removes the inode from the indexes, returning its paths
+func (f *fsDev) forgetIno(ino I.Ino) []P.Pathsplit {
+	if si, ok := f.inoStatInfo[ino]; ok {
+		f.removeInoHash(ino, si)
+		delete(f.inoStatInfo, ino)
+	}
+	f.InoDigests.Remove(ino)
+	if linkable, ok := f.LinkableInos[ino]; ok {
+		for other := range linkable {
+			if set, ok := f.LinkableInos[other]; ok {
+				set.Remove(ino)
+				if len(set) == 0 {
+					delete(f.LinkableInos, other)
+				}
+			}
+		}
+		delete(f.LinkableInos, ino)
+	}
+	var paths []P.Pathsplit
+	if fp, ok := f.InoPaths[ino]; ok {
+		paths = fp.PathsAsSlice()
+		delete(f.InoPaths, ino)
+	}
+	return paths
+}
@@ -1,10 +1,13 @@
 module github.com/chadnetzer/hardlinkable
 
+go 1.14
+
 require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/karrick/godirwalk v1.7.5
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/xattr v0.3.1
 	github.com/spf13/cobra v0.0.3
-	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/spf13/pflag v1.0.3
 	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e
 )
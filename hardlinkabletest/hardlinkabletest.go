@@ -0,0 +1,365 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package hardlinkabletest builds trees of files, with given contents,
+// metadata, xattrs and existing hardlinks, for testing code that uses
+// hardlinkable.  A Tree is declared, materialized in a temp dir, and the
+// Results of a Run and the resulting inode layout (ie. which paths share
+// inodes) can then be checked:
+//
+//	f := hardlinkabletest.NewTree().
+//		File("a/f1", "same").
+//		File("b/f1", "same", hardlinkabletest.Mode(0600)).
+//		File("c/f1", "same").
+//		Link("c/f1", "c/f2").
+//		Materialize(t)
+//	r := f.Run(hardlinkable.SetupOptions(hardlinkable.LinkingEnabled))
+//	f.AssertCounts(r, hardlinkabletest.Counts{NewLinks: 1, RemovedInodes: 1})
+//	f.AssertLayout([]string{"a/f1", "c/f1", "c/f2"}, []string{"b/f1"})
+package hardlinkabletest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable"
+	"github.com/chadnetzer/hardlinkable/vfs"
+	"github.com/pkg/xattr"
+)
+
+// DefaultMtime is the modification time of the declared files, unless given
+// with Mtime (so that identical files match by default)
+var DefaultMtime = time.Date(2018, time.October, 28, 0, 0, 0, 0, time.UTC)
+
+// DefaultMode is the permission mode of the declared files, unless given with
+// Mode
+const DefaultMode os.FileMode = 0644
+
+// Tree declares files and their existing hardlinks
+type Tree struct {
+	files  []*file
+	byName map[string]*file
+}
+
+type file struct {
+	pathname string
+	contents string
+	mode     os.FileMode
+	mtime    time.Time
+	owner    *[2]int
+	xattrs   map[string]string
+	links    []string
+}
+
+// FileOption sets the metadata of a declared file
+type FileOption func(*file)
+
+// Mode sets the permission mode of a file
+func Mode(mode os.FileMode) FileOption {
+	return func(f *file) { f.mode = mode }
+}
+
+// Mtime sets the modification time of a file
+func Mtime(t time.Time) FileOption {
+	return func(f *file) { f.mtime = t }
+}
+
+// Owner sets the uid and gid of a file (which usually requires root)
+func Owner(uid, gid int) FileOption {
+	return func(f *file) { f.owner = &[2]int{uid, gid} }
+}
+
+// XAttr sets an extended attribute of a file, such as "user.foo"
+func XAttr(name, value string) FileOption {
+	return func(f *file) { f.xattrs[name] = value }
+}
+
+// NewTree returns an empty Tree
+func NewTree() *Tree {
+	return &Tree{byName: make(map[string]*file)}
+}
+
+// File declares a file with the given relative pathname and contents.
+// Declaring a pathname again replaces it.
+func (tr *Tree) File(pathname, contents string, opts ...FileOption) *Tree {
+	f := &file{
+		pathname: filepath.Clean(pathname),
+		contents: contents,
+		mode:     DefaultMode,
+		mtime:    DefaultMtime,
+		xattrs:   make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if old, ok := tr.byName[f.pathname]; ok {
+		*old = *f
+		return tr
+	}
+	tr.files = append(tr.files, f)
+	tr.byName[f.pathname] = f
+	return tr
+}
+
+// Link declares the dst pathnames as existing hardlinks of the src file,
+// which must be declared with File
+func (tr *Tree) Link(src string, dsts ...string) *Tree {
+	f, ok := tr.byName[filepath.Clean(src)]
+	if !ok {
+		panic("hardlinkabletest: Link of undeclared file " + src)
+	}
+	for _, dst := range dsts {
+		f.links = append(f.links, filepath.Clean(dst))
+	}
+	return tr
+}
+
+// Fixture is a Tree materialized in a temp dir, which is removed when the
+// test completes
+type Fixture struct {
+	// Dir is the temp dir that the Tree's pathnames are relative to
+	Dir string
+
+	tb   testing.TB
+	tree *Tree
+}
+
+// Materialize creates the Tree's files and links in a new temp dir
+func (tr *Tree) Materialize(tb testing.TB) *Fixture {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "hardlinkabletest")
+	if err != nil {
+		tb.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	fx := &Fixture{Dir: dir, tb: tb, tree: tr}
+	for _, f := range tr.files {
+		fx.makeFile(f)
+	}
+	for _, f := range tr.files {
+		for _, dst := range f.links {
+			fx.mkdirs(dst)
+			if err := os.Link(fx.Path(f.pathname), fx.Path(dst)); err != nil {
+				tb.Fatalf("Couldn't link %v to %v: %v", dst, f.pathname, err)
+			}
+		}
+	}
+	return fx
+}
+
+func (fx *Fixture) mkdirs(pathname string) {
+	fx.tb.Helper()
+	if err := os.MkdirAll(filepath.Dir(fx.Path(pathname)), 0755); err != nil {
+		fx.tb.Fatalf("Couldn't create dir for %v: %v", pathname, err)
+	}
+}
+
+func (fx *Fixture) makeFile(f *file) {
+	fx.tb.Helper()
+	fx.mkdirs(f.pathname)
+	p := fx.Path(f.pathname)
+	if err := ioutil.WriteFile(p, []byte(f.contents), f.mode); err != nil {
+		fx.tb.Fatalf("Couldn't create %v: %v", f.pathname, err)
+	}
+	// The umask can mask the WriteFile mode
+	if err := os.Chmod(p, f.mode); err != nil {
+		fx.tb.Fatalf("Couldn't chmod %v: %v", f.pathname, err)
+	}
+	if f.owner != nil {
+		if err := os.Lchown(p, f.owner[0], f.owner[1]); err != nil {
+			fx.tb.Fatalf("Couldn't chown %v: %v", f.pathname, err)
+		}
+	}
+	for name, value := range f.xattrs {
+		if err := xattr.LSet(p, name, []byte(value)); err != nil {
+			fx.tb.Fatalf("Couldn't set xattr %v on %v: %v", name, f.pathname, err)
+		}
+	}
+	if err := os.Chtimes(p, f.mtime, f.mtime); err != nil {
+		fx.tb.Fatalf("Couldn't set the times of %v: %v", f.pathname, err)
+	}
+}
+
+// Path returns the full pathname of a relative pathname of the Tree
+func (fx *Fixture) Path(pathname string) string {
+	return filepath.Join(fx.Dir, pathname)
+}
+
+// Run runs hardlinkable on the Fixture's dir (or on the given relative
+// dirs and files), failing the test if the Run fails
+func (fx *Fixture) Run(opts hardlinkable.Options, dirsAndFiles ...string) hardlinkable.Results {
+	fx.tb.Helper()
+	if len(dirsAndFiles) == 0 {
+		dirsAndFiles = []string{"."}
+	}
+	var paths []string
+	for _, p := range dirsAndFiles {
+		paths = append(paths, fx.Path(p))
+	}
+	r, err := hardlinkable.Run(paths, opts)
+	if err != nil {
+		fx.tb.Fatalf("Run failed: %v", err)
+	}
+	if !r.RunSuccessful {
+		fx.tb.Fatalf("Run was not successful")
+	}
+	return r
+}
+
+// Counts are the Results counts checked by AssertCounts
+type Counts struct {
+	NewLinks      int64
+	ExistingLinks int64
+	RemovedInodes int64
+	RemovedBytes  uint64
+}
+
+// AssertCounts checks the new and existing link counts, and the count and
+// bytes of the removed inodes, of the Results
+func (fx *Fixture) AssertCounts(r hardlinkable.Results, expected Counts) {
+	fx.tb.Helper()
+	got := Counts{
+		NewLinks:      r.NewLinkCount,
+		ExistingLinks: r.ExistingLinkCount,
+		RemovedInodes: r.InodeRemovedCount,
+		RemovedBytes:  r.InodeRemovedByteAmount,
+	}
+	if got != expected {
+		fx.tb.Errorf("Expected Results counts %+v, got %+v", expected, got)
+	}
+}
+
+// Layout returns the relative pathnames of the regular files in the Fixture's
+// dir, grouped by inode.  The pathnames of each group, and the groups (by
+// their first pathname), are sorted.
+func (fx *Fixture) Layout() [][]string {
+	fx.tb.Helper()
+	type devIno struct{ dev, ino uint64 }
+	inos := make(map[devIno][]string)
+	err := filepath.Walk(fx.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		s, ok := vfs.StatOf(fi)
+		if !ok {
+			fx.tb.Fatalf("Couldn't get the inode of %v", p)
+		}
+		rel, err := filepath.Rel(fx.Dir, p)
+		if err != nil {
+			return err
+		}
+		di := devIno{s.Dev, s.Ino}
+		inos[di] = append(inos[di], rel)
+		return nil
+	})
+	if err != nil {
+		fx.tb.Fatalf("Couldn't walk %v: %v", fx.Dir, err)
+	}
+	layout := make([][]string, 0, len(inos))
+	for _, paths := range inos {
+		sort.Strings(paths)
+		layout = append(layout, paths)
+	}
+	sort.Slice(layout, func(i, j int) bool { return layout[i][0] < layout[j][0] })
+	return layout
+}
+
+// AssertLayout checks that the Fixture's files are grouped by inode exactly
+// as given (in any order), with one group per inode
+func (fx *Fixture) AssertLayout(groups ...[]string) {
+	fx.tb.Helper()
+	expected := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		if len(g) == 0 {
+			continue
+		}
+		paths := make([]string, len(g))
+		for i, p := range g {
+			paths[i] = filepath.Clean(p)
+		}
+		sort.Strings(paths)
+		expected = append(expected, paths)
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i][0] < expected[j][0] })
+	if got := fx.Layout(); !reflect.DeepEqual(got, expected) {
+		fx.tb.Errorf("Expected inode layout %v, got %v", expected, got)
+	}
+}
+
+// AssertLinked checks that the given pathnames share an inode
+func (fx *Fixture) AssertLinked(pathnames ...string) {
+	fx.tb.Helper()
+	if len(pathnames) < 2 {
+		return
+	}
+	ino := fx.ino(pathnames[0])
+	for _, p := range pathnames[1:] {
+		if fx.ino(p) != ino {
+			fx.tb.Errorf("Expected %v to be linked to %v", p, pathnames[0])
+		}
+	}
+}
+
+// AssertNotLinked checks that the given pathnames are all on different inodes
+func (fx *Fixture) AssertNotLinked(pathnames ...string) {
+	fx.tb.Helper()
+	seen := make(map[[2]uint64]string)
+	for _, p := range pathnames {
+		ino := fx.ino(p)
+		if other, ok := seen[ino]; ok {
+			fx.tb.Errorf("Expected %v not to be linked to %v", p, other)
+		}
+		seen[ino] = p
+	}
+}
+
+func (fx *Fixture) ino(pathname string) [2]uint64 {
+	fx.tb.Helper()
+	fi, err := os.Lstat(fx.Path(pathname))
+	if err != nil {
+		fx.tb.Fatalf("Couldn't stat %v: %v", pathname, err)
+	}
+	s, ok := vfs.StatOf(fi)
+	if !ok {
+		fx.tb.Fatalf("Couldn't get the inode of %v", pathname)
+	}
+	return [2]uint64{s.Dev, s.Ino}
+}
+
+// AssertContents checks that the declared files (and their links) still have
+// their declared contents
+func (fx *Fixture) AssertContents() {
+	fx.tb.Helper()
+	for _, f := range fx.tree.files {
+		for _, p := range append([]string{f.pathname}, f.links...) {
+			b, err := ioutil.ReadFile(fx.Path(p))
+			if err != nil {
+				fx.tb.Errorf("Couldn't read %v: %v", p, err)
+			} else if string(b) != f.contents {
+				fx.tb.Errorf("Expected %v to contain %q, got %q", p, f.contents, b)
+			}
+		}
+	}
+}
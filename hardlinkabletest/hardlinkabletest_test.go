@@ -0,0 +1,89 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkabletest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable"
+	"github.com/pkg/xattr"
+)
+
+func TestMaterialize(t *testing.T) {
+	mtime := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	fx := NewTree().
+		File("f1", "X", Mode(0600), Mtime(mtime), XAttr("user.foo", "bar")).
+		File("a/b/f2", "Y").
+		Link("a/b/f2", "a/f2", "c/f2").
+		Materialize(t)
+
+	fx.AssertLayout([]string{"f1"}, []string{"a/b/f2", "a/f2", "c/f2"})
+	fx.AssertLinked("a/b/f2", "a/f2", "c/f2")
+	fx.AssertNotLinked("f1", "a/f2")
+	fx.AssertContents()
+
+	fi, err := os.Lstat(fx.Path("f1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected mode 0600 and mtime %v, got %v and %v", mtime, fi.Mode(), fi.ModTime())
+	}
+	if v, err := xattr.LGet(fx.Path("f1"), "user.foo"); err != nil || string(v) != "bar" {
+		t.Errorf("Expected xattr user.foo=bar, got %q (%v)", v, err)
+	}
+	fi, err = os.Lstat(fx.Path("c/f2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != DefaultMode || !fi.ModTime().Equal(DefaultMtime) {
+		t.Errorf("Expected the default mode and mtime, got %v and %v", fi.Mode(), fi.ModTime())
+	}
+}
+
+func TestFixtureRun(t *testing.T) {
+	fx := NewTree().
+		File("a/f1", "same").
+		File("b/f1", "same", Mode(0600)).
+		File("c/f1", "same").
+		Link("c/f1", "c/f2").
+		File("d/f1", "same", XAttr("user.foo", "bar")).
+		File("e/f1", "other").
+		Materialize(t)
+
+	r := fx.Run(hardlinkable.SetupOptions(hardlinkable.LinkingEnabled))
+	fx.AssertCounts(r, Counts{NewLinks: 1, ExistingLinks: 1, RemovedInodes: 1, RemovedBytes: 4})
+	fx.AssertLayout(
+		[]string{"a/f1", "c/f1", "c/f2"},
+		[]string{"b/f1"},
+		[]string{"d/f1"},
+		[]string{"e/f1"},
+	)
+	fx.AssertContents()
+
+	// Only the given dir is run
+	r = fx.Run(hardlinkable.SetupOptions(hardlinkable.LinkingEnabled, hardlinkable.ContentOnly), "b", "d")
+	fx.AssertCounts(r, Counts{NewLinks: 1, RemovedInodes: 1, RemovedBytes: 4})
+	fx.AssertLinked("b/f1", "d/f1")
+	fx.AssertNotLinked("a/f1", "b/f1")
+}
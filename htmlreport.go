@@ -0,0 +1,245 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// htmlReport holds the data used by htmlReportTmpl
+type htmlReport struct {
+	R             *Results
+	Summary       [][]string
+	ExistingLinks []htmlLinkRow
+	NewLinks      []htmlLinkRow
+	Mismatches    []htmlMismatchRow
+	Linked        string // "linked" or "linkable"
+	LinkedTitle   string
+}
+
+type htmlLinkRow struct {
+	Src   string
+	Dsts  []string
+	Size  uint64 // Zero when not known
+	Saved uint64
+}
+
+type htmlMismatchRow struct {
+	Name  string
+	Count int64
+	Bytes uint64
+}
+
+func newHTMLReport(r *Results) htmlReport {
+	h := htmlReport{
+		R:           r,
+		Summary:     r.runStatsRows(),
+		Linked:      "linkable",
+		LinkedTitle: "Linkable",
+	}
+	if r.Opts.LinkingEnabled {
+		h.Linked, h.LinkedTitle = "linked", "Linked"
+	}
+	for src, dsts := range r.ExistingLinks {
+		size := r.ExistingLinkSizes[src]
+		h.ExistingLinks = append(h.ExistingLinks, htmlLinkRow{
+			Src:   src,
+			Dsts:  dsts,
+			Size:  size,
+			Saved: size * uint64(len(dsts)),
+		})
+	}
+	sort.Slice(h.ExistingLinks, func(i, j int) bool {
+		if h.ExistingLinks[i].Saved != h.ExistingLinks[j].Saved {
+			return h.ExistingLinks[i].Saved > h.ExistingLinks[j].Saved
+		}
+		return h.ExistingLinks[i].Src < h.ExistingLinks[j].Src
+	})
+	for _, paths := range r.LinkPaths {
+		h.NewLinks = append(h.NewLinks, htmlLinkRow{Src: paths[0], Dsts: paths[1:]})
+	}
+	h.Mismatches = []htmlMismatchRow{
+		{"Modification time", r.MismatchedMtimeCount, r.MismatchedMtimeBytes},
+		{"Mode", r.MismatchedModeCount, r.MismatchedModeBytes},
+		{"Uid", r.MismatchedUIDCount, r.MismatchedUIDBytes},
+		{"Gid", r.MismatchedGIDCount, r.MismatchedGIDBytes},
+		{"Xattr", r.MismatchedXAttrCount, r.MismatchedXAttrBytes},
+		{"Total", r.MismatchedTotalCount, r.MismatchedTotalBytes},
+	}
+	return h
+}
+
+// WriteHTML outputs the Results as a self-contained HTML report, with sortable
+// tables of the duplicate groups, existing links, new links, directory
+// savings, and inode mismatch stats.
+func (r *Results) WriteHTML(w io.Writer) error {
+	return htmlReportTmpl.Execute(w, newHTMLReport(r))
+}
+
+// OutputHTMLResults outputs the Results as a self-contained HTML report
+func (r *Results) OutputHTMLResults() {
+	if err := r.WriteHTML(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+var htmlReportTmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"humanize": Humanize,
+	"join":     strings.Join,
+}).Parse(htmlReportText))
+
+const htmlReportText = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hardlinkable report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.2em; margin-top: 2em; }
+table { border-collapse: collapse; margin-top: 0.5em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: left; vertical-align: top; }
+th { background: #eee; }
+table.sortable th { cursor: pointer; }
+table.sortable th:after { content: " \2195"; color: #999; }
+td.num { text-align: right; white-space: nowrap; }
+.paths { font-family: monospace; }
+.note { color: #666; }
+</style>
+</head>
+<body>
+<h1>hardlinkable report</h1>
+<p>
+{{- if .R.Roots}}Directories and files: <span class="paths">{{join .R.Roots ", "}}</span><br>{{end}}
+{{- if not .R.EndTime.IsZero}}Run ended: {{.R.EndTime.Format "2006-01-02 15:04:05 MST"}}<br>{{end}}
+Linking enabled: {{.R.Opts.LinkingEnabled}}
+</p>
+
+<h2>Summary</h2>
+<table>
+{{- range .Summary}}
+<tr><th>{{index . 0}}</th>{{range $i, $v := .}}{{if $i}}<td>{{$v}}</td>{{end}}{{end}}</tr>
+{{- end}}
+</table>
+
+<h2>Duplicate groups</h2>
+{{- with .R.DuplicateReport}}
+<table class="sortable">
+<thead><tr><th>File size</th><th>Inodes</th><th>Duplicate bytes</th><th>Paths</th></tr></thead>
+<tbody>
+{{- range .Groups}}
+<tr><td class="num" data-v="{{.Size}}">{{humanize .Size}}</td><td class="num" data-v="{{.InodeCount}}">{{.InodeCount}}</td><td class="num" data-v="{{.DuplicateBytes}}">{{humanize .DuplicateBytes}}</td><td class="paths">{{range $i, $p := .Paths}}{{if $i}}<br>{{end}}{{$p}}{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- else}}
+<p class="note">Not gathered for this run.</p>
+{{- end}}
+
+<h2>Currently hardlinked files</h2>
+{{- if .ExistingLinks}}
+<table class="sortable">
+<thead><tr><th>Path</th><th>File size</th><th>Links</th><th>Saved bytes</th><th>Linked paths</th></tr></thead>
+<tbody>
+{{- range .ExistingLinks}}
+<tr><td class="paths">{{.Src}}</td><td class="num" data-v="{{.Size}}">{{humanize .Size}}</td><td class="num" data-v="{{len .Dsts}}">{{len .Dsts}}</td><td class="num" data-v="{{.Saved}}">{{humanize .Saved}}</td><td class="paths">{{range $i, $p := .Dsts}}{{if $i}}<br>{{end}}{{$p}}{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- else}}
+<p class="note">None found (or not stored).</p>
+{{- end}}
+
+<h2>{{.LinkedTitle}} files</h2>
+{{- if .NewLinks}}
+<table class="sortable">
+<thead><tr><th>Path</th><th>Links</th><th>{{.LinkedTitle}} paths</th></tr></thead>
+<tbody>
+{{- range .NewLinks}}
+<tr><td class="paths">{{.Src}}</td><td class="num" data-v="{{len .Dsts}}">{{len .Dsts}}</td><td class="paths">{{range $i, $p := .Dsts}}{{if $i}}<br>{{end}}{{$p}}{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- else}}
+<p class="note">None found (or not stored).</p>
+{{- end}}
+
+{{- if .R.DirSavings}}
+
+<h2>Savings by directory (depth {{.R.Opts.DirSavingsDepth}})</h2>
+<table class="sortable">
+<thead><tr><th>Directory</th><th>Total saved</th><th>Currently linked</th><th>New {{.Linked}}</th><th>Removed inodes</th></tr></thead>
+<tbody>
+{{- range .R.DirSavings}}
+<tr><td class="paths">{{.Dir}}</td><td class="num" data-v="{{.TotalBytes}}">{{humanize .TotalBytes}}</td><td class="num" data-v="{{.ExistingLinkBytes}}">{{humanize .ExistingLinkBytes}}</td><td class="num" data-v="{{.NewLinkBytes}}">{{humanize .NewLinkBytes}}</td><td class="num" data-v="{{.InodeRemovedBytes}}">{{humanize .InodeRemovedBytes}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+
+<h2>Equal files with mismatched inode parameters</h2>
+<table class="sortable">
+<thead><tr><th>Parameter</th><th>Files</th><th>Bytes</th></tr></thead>
+<tbody>
+{{- range .Mismatches}}
+<tr><td>{{.Name}}</td><td class="num" data-v="{{.Count}}">{{.Count}}</td><td class="num" data-v="{{.Bytes}}">{{humanize .Bytes}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+
+<script>
+(function() {
+	function key(row, col) {
+		var cell = row.cells[col];
+		var v = cell.getAttribute("data-v");
+		return v === null ? cell.textContent : Number(v);
+	}
+	var tables = document.querySelectorAll("table.sortable");
+	for (var t = 0; t < tables.length; t++) {
+		var ths = tables[t].tHead.rows[0].cells;
+		for (var c = 0; c < ths.length; c++) {
+			ths[c].addEventListener("click", function() {
+				var col = this.cellIndex;
+				var tbody = this.closest("table").tBodies[0];
+				var asc = this.getAttribute("data-asc") !== "true";
+				this.setAttribute("data-asc", asc);
+				var rows = Array.prototype.slice.call(tbody.rows);
+				rows.sort(function(a, b) {
+					var x = key(a, col), y = key(b, col);
+					var r = x < y ? -1 : (x > y ? 1 : 0);
+					return asc ? r : -r;
+				});
+				for (var i = 0; i < rows.length; i++) {
+					tbody.appendChild(rows[i]);
+				}
+			});
+		}
+	}
+})();
+</script>
+</body>
+</html>
+`
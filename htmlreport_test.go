@@ -0,0 +1,71 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteHTML(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(ReportDuplicates(5), ReportDirSavings(5, 1))
+	opts.StoreExistingLinkResults = true
+	opts.StoreNewLinkResults = true
+
+	name := "testname: 'HTML report'"
+
+	m := pathContents{"a/<b>.txt": "X", "a/f2": "X", "b/f3": "YY"}
+	simpleFileMaker(t, m)
+	simpleLinkMaker(t, "b/f3", "b/f4")
+	result := simpleRun(name, t, opts, 1, ".")
+
+	var b bytes.Buffer
+	if err := result.WriteHTML(&b); err != nil {
+		t.Fatalf("%v: WriteHTML failed: %v", name, err)
+	}
+	html := b.String()
+	for _, s := range []string{
+		"<h2>Duplicate groups</h2>",
+		"a/&lt;b&gt;.txt", // Escaped pathname
+		`<td class="paths">b/f3</td>`,
+		"<h2>Savings by directory (depth 1)</h2>",
+		"<td>Modification time</td>",
+		`<table class="sortable">`,
+	} {
+		if !strings.Contains(html, s) {
+			t.Errorf("%v: Expected HTML to contain: %v", name, s)
+		}
+	}
+	if strings.Contains(html, "a/<b>.txt") {
+		t.Errorf("%v: Pathname was not escaped", name)
+	}
+	// The report must be self-contained
+	for _, s := range []string{"src=", "href=", "@import"} {
+		if strings.Contains(html, s) {
+			t.Errorf("%v: Unexpected external asset reference: %v", name, s)
+		}
+	}
+}
@@ -21,14 +21,20 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/chadnetzer/hardlinkable"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -42,6 +48,7 @@ import (
 // struct
 type CLIOptions struct {
 	JSONOutputEnabled      bool
+	HTMLOutputEnabled      bool
 	ProgressOutputDisabled bool
 	UseNewLinkDisabled     bool
 	CLIContentOnly         bool
@@ -52,6 +59,12 @@ type CLIOptions struct {
 	CLIDirExcludes         RegexArray
 	CLISearchThresh        intN
 	CLIDebugLevel          int
+	PrometheusFile         string
+	PolicyFile             string
+	PlanFile               string
+
+	// DupesFile is read by the import command, instead of walking dirs
+	DupesFile string
 
 	// Verbosity controls the level of output when calling the output
 	// options.  Verbosity 0 prints a short summary of results (space
@@ -64,6 +77,10 @@ type CLIOptions struct {
 	hardlinkable.Options
 }
 
+// DefaultHTMLDuplicatesTopN is the number of duplicate groups shown in the
+// HTML report, unless --duplicates is given
+const DefaultHTMLDuplicatesTopN = 100
+
 func (c CLIOptions) ToOptions() hardlinkable.Options {
 	o := c.Options
 	o.ShowRunStats = true                   // Default for cli
@@ -86,18 +103,35 @@ func (c CLIOptions) ToOptions() hardlinkable.Options {
 	if c.Verbosity > 0 {
 		o.ShowExtendedRunStats = true
 	}
-	if c.Verbosity > 1 || c.JSONOutputEnabled {
+	if c.Verbosity > 1 || c.JSONOutputEnabled || c.HTMLOutputEnabled {
 		o.StoreNewLinkResults = true
 	}
-	if c.Verbosity > 2 || c.JSONOutputEnabled {
+	if c.Verbosity > 2 || c.JSONOutputEnabled || c.HTMLOutputEnabled {
 		o.StoreExistingLinkResults = true
 	}
+	// The HTML report always includes the full stats and duplicate groups
+	if c.HTMLOutputEnabled {
+		o.ShowExtendedRunStats = true
+		if o.DuplicatesTopN == 0 {
+			o.DuplicatesTopN = DefaultHTMLDuplicatesTopN
+		}
+	}
 	if c.LinkingEnabled {
 		c.CheckQuiescence = true
 	}
 	return o
 }
 
+// loadPolicy reads the PolicyRules from the --policy file, if given
+func (c CLIOptions) loadPolicy(o *hardlinkable.Options) error {
+	if c.PolicyFile == "" {
+		return nil
+	}
+	rules, err := hardlinkable.LoadPolicyFile(c.PolicyFile)
+	o.PolicyRules = rules
+	return err
+}
+
 // Custom pflag Value displays "RE" instead of "stringArray" in usage text
 type RegexArray struct {
 	flag.Value // "inherit" Value interface
@@ -175,23 +209,46 @@ func Execute() {
 }
 
 func CLIRun(args []string, co CLIOptions) {
-	var results hardlinkable.Results
-	var err error
+	if co.JSONOutputEnabled && co.HTMLOutputEnabled {
+		fmt.Fprintln(os.Stderr, "Only one of --json and --html can be given")
+		os.Exit(1)
+	}
 
-	opts := co.ToOptions()
-	if co.ProgressOutputDisabled {
-		results, err = hardlinkable.Run(args, opts)
-	} else {
-		if terminal.IsTerminal(int(os.Stdout.Fd())) {
-			results, err = hardlinkable.RunWithProgress(args, opts)
-		} else {
-			results, err = hardlinkable.Run(args, opts)
-		}
+	if co.PlanFile != "" && co.LinkingEnabled {
+		fmt.Fprintln(os.Stderr, "Only one of --save-plan and --enable-linking can be given")
+		os.Exit(1)
+	}
+	if co.PlanFile != "" && co.DupesFile != "" {
+		fmt.Fprintln(os.Stderr, "--save-plan can't be used with import")
+		os.Exit(1)
 	}
 
-	if err != nil {
+	opts := co.ToOptions()
+	if err := co.loadPolicy(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	results, sig, err := runCatchingSignals(func(ctx context.Context) (hardlinkable.Results, error) {
+		switch {
+		case co.DupesFile != "":
+			return runDupesFile(ctx, co.DupesFile, opts)
+		case co.PlanFile != "":
+			return scanPlan(ctx, args, opts, co.PlanFile)
+		case !co.ProgressOutputDisabled && terminal.IsTerminal(int(os.Stdout.Fd())):
+			return hardlinkable.RunWithProgressContext(ctx, args, opts)
+		default:
+			return hardlinkable.RunContext(ctx, args, opts)
+		}
+	})
+	if err != nil && sig == nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
+	// Written even when the run stops early, so the phase is recorded
+	if co.PrometheusFile != "" {
+		if promErr := results.WritePrometheusFile(co.PrometheusFile); promErr != nil {
+			fmt.Fprintln(os.Stderr, promErr)
+		}
+	}
 	if err != nil || !results.RunSuccessful {
 		var s string
 		switch results.Phase {
@@ -208,6 +265,9 @@ func CLIRun(args []string, co CLIOptions) {
 		default:
 			s = "Stopped early.  Results may be incomplete..."
 		}
+		if len(s) > 0 && sig != nil {
+			s = fmt.Sprintf("Stopped by signal (%v).  Results are incomplete...", sig)
+		}
 		if len(s) > 0 {
 			fmt.Fprintln(os.Stderr, s)
 		}
@@ -216,14 +276,99 @@ func CLIRun(args []string, co CLIOptions) {
 	if results.Phase != hardlinkable.StartPhase {
 		if co.JSONOutputEnabled {
 			results.OutputJSONResults()
+		} else if co.HTMLOutputEnabled {
+			results.OutputHTMLResults()
 		} else {
 			results.OutputResults()
 		}
 	}
+
+	// Follow the shell convention for processes terminated by a signal
+	if s, ok := sig.(syscall.Signal); ok {
+		os.Exit(128 + int(s))
+	}
+}
+
+// scanPlan saves the Plan of the links to the given file, and returns the
+// Results of the scan
+func scanPlan(ctx context.Context, args []string, opts hardlinkable.Options, pathname string) (hardlinkable.Results, error) {
+	plan, err := hardlinkable.ScanContext(ctx, args, opts)
+	if err != nil {
+		if plan != nil {
+			return plan.Results, err // Partial Results, and no plan file
+		}
+		return hardlinkable.Results{}, err
+	}
+	if err := plan.WritePlanFile(pathname); err != nil {
+		return plan.Results, err
+	}
+	return plan.Results, nil
+}
+
+// runDupesFile links the groups of duplicate files listed in the given file
+func runDupesFile(ctx context.Context, pathname string, opts hardlinkable.Options) (hardlinkable.Results, error) {
+	groups, err := hardlinkable.LoadDuplicateGroupsFile(pathname)
+	if err != nil {
+		return hardlinkable.Results{}, err
+	}
+	return hardlinkable.RunDuplicateGroupsContext(ctx, groups, opts)
+}
+
+// runCatchingSignals calls run with a context that is cancelled by the first
+// SIGINT or SIGTERM, and returns the signal that stopped it (or nil), with
+// the StopReason of the partial Results set.
+func runCatchingSignals(run func(context.Context) (hardlinkable.Results, error)) (hardlinkable.Results, os.Signal, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caught, stopCatching := catchSignals(cancel)
+	results, err := run(ctx)
+	stopCatching()
+
+	// The signal is sent before the run is cancelled, so it is available
+	var sig os.Signal
+	if errors.Is(err, context.Canceled) {
+		sig = <-caught
+		results.StopReason = "stopped by signal (" + sig.String() + ")"
+	}
+	return results, sig, err
+}
+
+// catchSignals calls cancel on the first SIGINT or SIGTERM, so that the run
+// can stop after the current link is completed, and sends the signal on the
+// returned channel.  A second signal exits immediately.  The returned func
+// stops catching signals.
+func catchSignals(cancel context.CancelFunc) (<-chan os.Signal, func()) {
+	sigs := make(chan os.Signal, 2)
+	caught := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			caught <- sig
+			fmt.Fprintf(os.Stderr, "\nCaught %v, stopping...  (repeat to exit immediately)\n", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(os.Stderr, "\nCaught %v, exiting\n", sig)
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		case <-done:
+		}
+	}()
+
+	return caught, func() {
+		signal.Stop(sigs)
+		close(done)
+	}
 }
 
 func init() {
 	co := CLIOptions{}
+	cf := configFlags{}
 
 	// rootCmd represents the base command when called without any subcommands
 	rootCmd = &cobra.Command{
@@ -235,19 +380,65 @@ by hardlinking identical files.  It can also perform the linking.`,
 		Args: cobra.MinimumNArgs(1),
 		DisableFlagsInUseLine: true,
 		Run: func(cmd *cobra.Command, args []string) {
+			if err := applyConfig(cmd, cf); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 			CLIRun(args, co)
 		},
 	}
 
 	// Local flags
 	flg := rootCmd.Flags()
+	addRootFlags(flg, &co)
+	addConfigFlags(flg, &cf)
+	flg.SortFlags = false
+
+	rootCmd.AddCommand(newDiffCmd())
+	rootCmd.AddCommand(newWatchCmd())
+	rootCmd.AddCommand(newConfigCmd())
+	rootCmd.AddCommand(newApplyCmd())
+	rootCmd.AddCommand(newVerifyCmd())
+	rootCmd.AddCommand(newImportCmd())
+}
 
+// addRootFlags adds the flags of the main command
+func addRootFlags(flg *pflag.FlagSet, co *CLIOptions) {
 	flg.CountVarP(&co.Verbosity, "verbose", "v", "``Increase verbosity level (up to 3 times)")
 	flg.BoolVar(&co.ProgressOutputDisabled, "no-progress", false, "Disable progress output while processing")
 	flg.BoolVar(&co.JSONOutputEnabled, "json", false, "Output results as JSON")
+	flg.BoolVar(&co.HTMLOutputEnabled, "html", false, "Output results as an HTML report")
 
 	flg.BoolVar(&co.LinkingEnabled, "enable-linking", false, "Perform the actual linking (implies --quiescence)")
 
+	addMatchFlags(flg, co)
+	flg.CountVarP(&co.CLIDebugLevel, "debug", "d", "``Increase debugging level")
+
+	flg.BoolVar(&co.IgnoreWalkErrors, "ignore-walkerr", false, "Continue on file/dir read errs")
+	flg.BoolVar(&co.IgnoreLinkErrors, "ignore-linkerr", false, "Continue when linking fails")
+	flg.BoolVar(&co.CheckQuiescence, "quiescence", false, "Abort if filesystem is being modified")
+	flg.BoolVar(&co.UseNewLinkDisabled, "disable-newest", false, "Disable using newest link mtime/uid/gid")
+	flg.IntVar(&co.DuplicatesTopN, "duplicates", 0, "Report duplicates by size, and the top N extensions and groups")
+	flg.BoolVar(&co.ReportNearDuplicates, "near-duplicates", false, "Report equal files that differ only in time/perm/owner/xattr")
+	flg.BoolVar(&co.ReportCrossDevice, "cross-device", false, "Report identical files on different devices (never linked)")
+	flg.IntVar(&co.DirSavingsTopN, "dir-savings", 0, "Report the N directories with the most savings")
+	flg.IntVar(&co.DirSavingsDepth, "dir-depth", hardlinkable.DefaultDirSavingsDepth, "Directory depth below each root for --dir-savings")
+	flg.BoolVar(&co.ReportOwnerSavings, "owner-savings", false, "Report savings and quota shifts per uid/gid")
+	flg.StringVar(&co.PlanFile, "save-plan", "", "Save the links found to a plan file at `path`, for the apply command")
+	flg.StringVar(&co.SQLiteFile, "sqlite", "", "Export the scan data to a SQLite database at `path`")
+	flg.StringVar(&co.StateFile, "state-file", "", "Save the scan state to `path`, and reuse it for unchanged dirs")
+	flg.StringVar(&co.CheckpointFile, "checkpoint", "", "Periodically save the run's progress to `path`")
+	flg.DurationVar(&co.CheckpointInterval, "checkpoint-interval", hardlinkable.DefaultCheckpointInterval, "Interval between saved checkpoints")
+	flg.BoolVar(&co.Resume, "resume", false, "Resume an interrupted run from the --checkpoint file")
+	flg.StringVar(&co.PrometheusFile, "prometheus-file", "", "Write Prometheus metrics to `path`")
+	flg.IntVar(&co.MaxErrorResults, "max-errors", hardlinkable.DefaultMaxErrorResults, "Maximum errors stored in results (-1 for all, -2 for none)")
+
+	co.CLISearchThresh.n = hardlinkable.DefaultSearchThresh
+	flg.VarP(&co.CLISearchThresh, "search-thresh", "", "Ino search length before enabling digests")
+}
+
+// addMatchFlags adds the flags that select which files are linkable
+func addMatchFlags(flg *pflag.FlagSet, co *CLIOptions) {
 	flg.BoolVarP(&co.SameName, "same-name", "f", false, "Filenames need to be identical")
 	flg.BoolVarP(&co.IgnoreTime, "ignore-time", "t", false, "File modification times need not match")
 	flg.BoolVarP(&co.IgnorePerm, "ignore-perm", "p", false, "File permission (mode) need not match")
@@ -262,15 +453,156 @@ by hardlinking identical files.  It can also perform the linking.`,
 	flg.VarP(&co.CLIFileIncludes, "include", "i", "Regex(es) used to include files (overrides excludes)")
 	flg.VarP(&co.CLIFileExcludes, "exclude", "e", "Regex(es) used to exclude files")
 	flg.VarP(&co.CLIDirExcludes, "exclude-dir", "E", "Regex(es) used to exclude dirs")
-	flg.CountVarP(&co.CLIDebugLevel, "debug", "d", "``Increase debugging level")
-
-	flg.BoolVar(&co.IgnoreWalkErrors, "ignore-walkerr", false, "Continue on file/dir read errs")
-	flg.BoolVar(&co.IgnoreLinkErrors, "ignore-linkerr", false, "Continue when linking fails")
-	flg.BoolVar(&co.CheckQuiescence, "quiescence", false, "Abort if filesystem is being modified")
-	flg.BoolVar(&co.UseNewLinkDisabled, "disable-newest", false, "Disable using newest link mtime/uid/gid")
+	flg.StringVar(&co.PolicyFile, "policy", "", "Read per-subtree matching rules from the policy file at `path`")
+}
 
-	co.CLISearchThresh.n = hardlinkable.DefaultSearchThresh
-	flg.VarP(&co.CLISearchThresh, "search-thresh", "", "Ino search length before enabling digests")
+// newDiffCmd returns the subcommand that compares the JSON Results of two runs
+func newDiffCmd() *cobra.Command {
+	var jsonOutput bool
+	cmd := &cobra.Command{
+		Use:   "diff [OPTIONS] old.json new.json",
+		Short: "Report changes between the JSON results of two runs",
+		Long: `Compare the results of two runs (as output with --json), and report the
+new and removed duplicate groups, paths that were linked in the old run but
+are now separate inodes, and the change in saveable bytes.`,
+		Args:                  cobra.ExactArgs(2),
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			d, err := hardlinkable.DiffResultsFiles(args[0], args[1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if jsonOutput {
+				d.OutputJSONDiff()
+			} else {
+				d.OutputDiff()
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output the changes as JSON")
+	return cmd
+}
 
+// newImportCmd returns the subcommand that links the duplicates listed by
+// another duplicate finder
+func newImportCmd() *cobra.Command {
+	co := CLIOptions{}
+	cf := configFlags{}
+	cmd := &cobra.Command{
+		Use:   "import [OPTIONS] dupes.txt",
+		Short: "Link the duplicate files listed by fdupes, jdupes or rdfind",
+		Long: `Read the groups of duplicate files from fdupes or jdupes output (blank line
+separated groups), or an rdfind results.txt file, instead of walking dirs.  The
+files of each group are statted and compared as in a normal run, and only
+those that the options allow are linked (with --enable-linking).`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := applyConfig(cmd, cf); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			co.DupesFile = args[0]
+			CLIRun(nil, co)
+		},
+	}
+	flg := cmd.Flags()
+	addRootFlags(flg, &co)
+	addConfigFlags(flg, &cf)
 	flg.SortFlags = false
+	return cmd
+}
+
+// newVerifyCmd returns the subcommand that checks the filesystem against the
+// JSON Results of a linking run
+func newVerifyCmd() *cobra.Command {
+	var jsonOutput bool
+	cmd := &cobra.Command{
+		Use:   "verify [OPTIONS] results.json",
+		Short: "Check that the links of a run's JSON results were made",
+		Long: `Check the filesystem against the results of a linking run (as output with
+--enable-linking --json, from the same dir): that each linked dst path shares
+the dev/ino of its src path, that the inodes removed by the run no longer
+exist, and that no temporary link files were left behind.  Exits nonzero
+with a list of the discrepancies if any are found.`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			results, err := hardlinkable.LoadResultsFile(args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			d, err := hardlinkable.VerifyResults(results)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if jsonOutput {
+				b, _ := json.Marshal(d)
+				fmt.Println(string(b))
+			} else {
+				hardlinkable.OutputDiscrepancies(d)
+			}
+			if len(d) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output the discrepancies as JSON")
+	return cmd
+}
+
+// newApplyCmd returns the subcommand that makes the links of a saved plan
+func newApplyCmd() *cobra.Command {
+	var verbosity int
+	var jsonOutput bool
+	var eo hardlinkable.ExecOptions
+	cmd := &cobra.Command{
+		Use:   "apply [OPTIONS] plan.json",
+		Short: "Make the links of a plan saved with --save-plan",
+		Long: `Make exactly the links of a plan saved with --save-plan.  Before each link,
+the src and dst files are checked against the dev/ino/size/mtime/mode/owner
+recorded in the plan, and links whose files have changed are skipped (and
+reported with the reason).  No new links are searched for.`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			plan, err := hardlinkable.LoadPlanFile(args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			o := &plan.Results.Opts
+			o.ShowRunStats = true
+			o.ShowExtendedRunStats = verbosity > 0
+			o.StoreNewLinkResults = verbosity > 1 || jsonOutput
+			eo.SkipDrifted = true
+
+			results, sig, err := runCatchingSignals(func(ctx context.Context) (hardlinkable.Results, error) {
+				return plan.Execute(ctx, eo)
+			})
+			if sig != nil {
+				fmt.Fprintf(os.Stderr, "Stopped by signal (%v).  Results are incomplete...\n", sig)
+			} else if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if jsonOutput {
+				results.OutputJSONResults()
+			} else {
+				results.OutputResults()
+			}
+			if s, ok := sig.(syscall.Signal); ok {
+				os.Exit(128 + int(s))
+			} else if err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+	flg := cmd.Flags()
+	flg.CountVarP(&verbosity, "verbose", "v", "``Increase verbosity level (up to 2 times)")
+	flg.BoolVar(&jsonOutput, "json", false, "Output results as JSON")
+	flg.BoolVar(&eo.IgnoreLinkErrors, "ignore-linkerr", false, "Continue when linking fails")
+	return cmd
 }
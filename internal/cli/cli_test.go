@@ -0,0 +1,150 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable"
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// signalObserver sends SIGINT to the process when the first file is
+// accepted, and waits for the run to be cancelled
+type signalObserver struct {
+	hardlinkable.NopObserver
+	ctx  context.Context
+	sent bool
+}
+
+func (o *signalObserver) FileAccepted(pathname string, size uint64) {
+	if o.sent {
+		return
+	}
+	o.sent = true
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	<-o.ctx.Done()
+}
+
+func TestRunCatchingSignals(t *testing.T) {
+	m := vfs.NewMemFS()
+	for i := 0; i < 10; i++ {
+		if err := m.WriteFile(fmt.Sprintf("d/f%d", i), []byte("X"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, wrap := range []bool{false, true} {
+		results, sig, err := runCatchingSignals(func(ctx context.Context) (hardlinkable.Results, error) {
+			opts := hardlinkable.SetupOptions()
+			opts.FS = m
+			opts.Observer = &signalObserver{ctx: ctx}
+			r, err := hardlinkable.RunContext(ctx, []string{"."}, opts)
+			if wrap {
+				err = fmt.Errorf("wrapped: %w", err)
+			}
+			return r, err
+		})
+		if sig != os.Interrupt || err == nil {
+			t.Fatalf("Expected the run to be stopped by SIGINT, got %v (%v)", sig, err)
+		}
+		if results.StopReason != "stopped by signal (interrupt)" {
+			t.Errorf("Unexpected StopReason: %q", results.StopReason)
+		}
+		if results.RunSuccessful || results.Phase != hardlinkable.WalkPhase || results.FileCount >= 10 {
+			t.Errorf("Expected partial results of the walk, got phase %v with %v files",
+				results.Phase, results.FileCount)
+		}
+	}
+
+	// Without a signal, the error is returned as is
+	results, sig, err := runCatchingSignals(func(ctx context.Context) (hardlinkable.Results, error) {
+		return hardlinkable.Results{}, context.DeadlineExceeded
+	})
+	if sig != nil || err != context.DeadlineExceeded || results.StopReason != "" {
+		t.Errorf("Expected no signal, got %v (%v)", sig, err)
+	}
+}
+
+// TestScanPlanSignal checks that a --save-plan run stopped by a signal returns
+// the partial Results, and doesn't write the plan file
+func TestScanPlanSignal(t *testing.T) {
+	m := vfs.NewMemFS()
+	for i := 0; i < 10; i++ {
+		if err := m.WriteFile(fmt.Sprintf("d/f%d", i), []byte("X"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "hardlinkable-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pathname := filepath.Join(dir, "plan.json")
+
+	results, sig, err := runCatchingSignals(func(ctx context.Context) (hardlinkable.Results, error) {
+		opts := hardlinkable.SetupOptions()
+		opts.FS = m
+		opts.Observer = &signalObserver{ctx: ctx}
+		return scanPlan(ctx, []string{"."}, opts, pathname)
+	})
+	if sig != os.Interrupt || err == nil {
+		t.Fatalf("Expected the scan to be stopped by SIGINT, got %v (%v)", sig, err)
+	}
+	if results.StopReason != "stopped by signal (interrupt)" ||
+		results.Phase != hardlinkable.WalkPhase || results.FileCount == 0 {
+		t.Errorf("Expected partial results of the walk, got %q in phase %v with %v files",
+			results.StopReason, results.Phase, results.FileCount)
+	}
+	if _, err := os.Stat(pathname); !os.IsNotExist(err) {
+		t.Errorf("Expected no plan file from a stopped scan, got: %v", err)
+	}
+}
+
+func TestCatchSignalsSecondExits(t *testing.T) {
+	if os.Getenv("HARDLINKABLE_SIGNAL_HELPER") == "1" {
+		cancelled := make(chan struct{})
+		catchSignals(func() { close(cancelled) })
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		<-cancelled
+		// Repeated, in case signals are merged while pending
+		for {
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCatchSignalsSecondExits$")
+	cmd.Env = append(os.Environ(), "HARDLINKABLE_SIGNAL_HELPER=1")
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 128+int(syscall.SIGINT) {
+		t.Errorf("Expected exit status %v after a second signal, got %v",
+			128+int(syscall.SIGINT), err)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The config file is a JSON object with the long flag names as keys, and an
+// optional "profiles" object of named objects with more flag settings:
+//
+//	{
+//	    "ignore-xattr": true,
+//	    "exclude-dir": ["^\\.git$"],
+//	    "profiles": {
+//	        "backups": {"enable-linking": true, "min-size": "4k"},
+//	        "buildcache": {"content-only": true, "exclude": ["\\.lock$"]}
+//	    }
+//	}
+//
+// The selected profile's settings replace the top level ones, and flags given
+// on the command line replace both.
+
+// profilesKey is the config file key for the named profiles
+const profilesKey = "profiles"
+
+// configFlags selects the config file and profile for a command
+type configFlags struct {
+	file    string
+	profile string
+}
+
+// configSetting is a flag setting from a config file, with the line it was
+// given on for error reporting
+type configSetting struct {
+	name string
+	vals []string
+	line int
+}
+
+// config holds the settings parsed from a config file
+type config struct {
+	pathname string
+	settings []configSetting
+	profiles map[string][]configSetting
+}
+
+// DefaultConfigFile returns the pathname of the config file that is used if
+// it exists and --config isn't given
+func DefaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hardlinkable", "config.json")
+}
+
+// addConfigFlags adds the flags that select the config file and profile
+func addConfigFlags(flg *pflag.FlagSet, cf *configFlags) {
+	flg.StringVar(&cf.file, "config", "", "Read options from the config file at `path`")
+	flg.StringVar(&cf.profile, "profile", "", "Use the options of the `name`d profile in the config file")
+}
+
+// applyConfig sets the flags of the command that weren't given on the command
+// line from the config file, and the selected profile
+func applyConfig(cmd *cobra.Command, cf configFlags) error {
+	pathname := cf.file
+	if pathname == "" {
+		pathname = DefaultConfigFile()
+		if _, err := os.Stat(pathname); pathname == "" || os.IsNotExist(err) {
+			if cf.profile != "" {
+				return fmt.Errorf("No config file for profile %q", cf.profile)
+			}
+			return nil
+		}
+	}
+	c, err := loadConfig(pathname)
+	if err != nil {
+		return err
+	}
+	return c.apply(cmd, cf.profile)
+}
+
+// loadConfig reads and parses the config file
+func loadConfig(pathname string) (*config, error) {
+	data, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(pathname, data)
+}
+
+// parseConfig parses the JSON config, keeping the line of each setting
+func parseConfig(pathname string, data []byte) (*config, error) {
+	p := configParser{
+		dec:  json.NewDecoder(bytes.NewReader(data)),
+		data: data,
+		c:    &config{pathname: pathname, profiles: make(map[string][]configSetting)},
+	}
+	p.dec.UseNumber()
+	settings, err := p.object(true)
+	if err != nil {
+		return nil, err
+	}
+	p.c.settings = settings
+	if _, err := p.dec.Token(); err == nil {
+		return nil, p.errorf("unexpected data after the config object")
+	}
+	return p.c, nil
+}
+
+type configParser struct {
+	dec  *json.Decoder
+	data []byte
+	c    *config
+}
+
+// line returns the line number of the current position of the decoder
+func (p *configParser) line() int {
+	return lineAt(p.data, p.dec.InputOffset())
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func (p *configParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.c.pathname, p.line(), fmt.Sprintf(format, a...))
+}
+
+// token returns the next JSON token, with syntax errors located in the file
+func (p *configParser) token() (json.Token, error) {
+	t, err := p.dec.Token()
+	if err != nil {
+		if se, ok := err.(*json.SyntaxError); ok && se.Offset > 0 {
+			// The Offset is just past the invalid byte
+			return nil, fmt.Errorf("%s:%d: %v", p.c.pathname, lineAt(p.data, se.Offset-1), err)
+		}
+		return nil, p.errorf("%v", err)
+	}
+	return t, nil
+}
+
+// object parses an object of flag settings (and the profiles, if at the top)
+func (p *configParser) object(top bool) ([]configSetting, error) {
+	if t, err := p.token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, p.errorf("expected an object of options")
+	}
+	var settings []configSetting
+	for p.dec.More() {
+		t, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		name := t.(string) // Object keys are always strings
+		line := p.line()
+		if top && name == profilesKey {
+			if err := p.profiles(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		vals, err := p.values(name)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, configSetting{name: name, vals: vals, line: line})
+	}
+	_, err := p.token() // Closing '}'
+	return settings, err
+}
+
+// profiles parses the object of named profiles
+func (p *configParser) profiles() error {
+	if t, err := p.token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return p.errorf("expected an object of profiles")
+	}
+	for p.dec.More() {
+		t, err := p.token()
+		if err != nil {
+			return err
+		}
+		name := t.(string)
+		if _, ok := p.c.profiles[name]; ok {
+			return p.errorf("profile %q given twice", name)
+		}
+		if p.c.profiles[name], err = p.object(false); err != nil {
+			return err
+		}
+	}
+	_, err := p.token()
+	return err
+}
+
+// values parses a scalar value, or an array of them (for the flags that can
+// be repeated), as the strings given to the flag
+func (p *configParser) values(name string) ([]string, error) {
+	t, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('[') {
+		val, err := p.scalar(name, t)
+		if err != nil {
+			return nil, err
+		}
+		return []string{val}, nil
+	}
+	vals := []string{}
+	for p.dec.More() {
+		if t, err = p.token(); err != nil {
+			return nil, err
+		}
+		val, err := p.scalar(name, t)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	_, err = p.token() // Closing ']'
+	return vals, err
+}
+
+func (p *configParser) scalar(name string, t json.Token) (string, error) {
+	switch v := t.(type) {
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return v, nil
+	}
+	return "", p.errorf("invalid value for %q (expected a bool, number or string)", name)
+}
+
+// profileNames returns the sorted names of the profiles in the config
+func (c *config) profileNames() []string {
+	var names []string
+	for name := range c.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// regexFlags are the flags whose values are checked to be valid regexes
+var regexFlags = map[string]bool{"include": true, "exclude": true, "exclude-dir": true}
+
+// apply sets the command's flags from the config, and the named profile.
+// Flags already given on the command line are left unchanged.  Settings for
+// flags that only other commands have are ignored.
+func (c *config) apply(cmd *cobra.Command, profile string) error {
+	settings := c.settings
+	if profile != "" {
+		ps, ok := c.profiles[profile]
+		if !ok {
+			return fmt.Errorf("%s: no profile %q (profiles: %v)", c.pathname, profile, c.profileNames())
+		}
+		settings = append(append([]configSetting{}, settings...), ps...)
+	}
+
+	// Later settings (ie. from the profile) replace earlier ones
+	merged := make(map[string]configSetting)
+	var order []string
+	for _, s := range settings {
+		if !isConfigKey(cmd.Root(), s.name) {
+			return fmt.Errorf("%s:%d: unknown option %q", c.pathname, s.line, s.name)
+		}
+		if regexFlags[s.name] {
+			for _, val := range s.vals {
+				if _, err := regexp.Compile(val); err != nil {
+					return fmt.Errorf("%s:%d: invalid %q regex: %v", c.pathname, s.line, s.name, err)
+				}
+			}
+		}
+		if _, ok := merged[s.name]; !ok {
+			order = append(order, s.name)
+		}
+		merged[s.name] = s
+	}
+
+	flg := cmd.Flags()
+	given := make(map[string]bool)
+	flg.Visit(func(f *pflag.Flag) { given[f.Name] = true })
+	for _, name := range order {
+		s := merged[name]
+		if given[name] || flg.Lookup(name) == nil {
+			continue
+		}
+		for _, val := range s.vals {
+			if err := flg.Set(name, val); err != nil {
+				return fmt.Errorf("%s:%d: invalid %q value %q: %v", c.pathname, s.line, name, val, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isConfigKey returns true if the name is a flag of one of the commands that
+// read the config file (other than those that select it)
+func isConfigKey(root *cobra.Command, name string) bool {
+	if name == "config" || name == "profile" || name == "help" {
+		return false
+	}
+	if root.Flags().Lookup(name) != nil {
+		return true
+	}
+	for _, cmd := range root.Commands() {
+		if cmd.Flags().Lookup("config") != nil && cmd.Flags().Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// newConfigCmd returns the subcommand that shows the merged options
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Show the options from the config file",
+	}
+
+	co := CLIOptions{}
+	cf := configFlags{}
+	showCmd := &cobra.Command{
+		Use:   "show [OPTIONS]",
+		Short: "Print the effective options, merged from the config file and flags",
+		Long: `Print the options that a run with the given flags would use, after merging
+the config file, the selected profile, and the command line flags.  The output
+is in the config file format.`,
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := applyConfig(cmd, cf); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			b, err := effectiveOptionsJSON(cmd.Flags())
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Println(string(b))
+		},
+	}
+	flg := showCmd.Flags()
+	addRootFlags(flg, &co)
+	addConfigFlags(flg, &cf)
+	flg.SortFlags = false
+
+	cmd.AddCommand(showCmd)
+	return cmd
+}
+
+// effectiveOptionsJSON returns the values of the flags as a config file
+// object (ordered by flag name)
+func effectiveOptionsJSON(flg *pflag.FlagSet) ([]byte, error) {
+	opts := make(map[string]interface{})
+	flg.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" || f.Name == "profile" || f.Name == "help" {
+			return
+		}
+		if r, ok := f.Value.(*RegexArray); ok {
+			vals := r.vals
+			if vals == nil {
+				vals = []string{}
+			}
+			opts[f.Name] = vals
+			return
+		}
+		switch f.Value.Type() {
+		case "bool":
+			b, _ := strconv.ParseBool(f.Value.String())
+			opts[f.Name] = b
+		case "count", "int", "N":
+			opts[f.Name] = json.Number(f.Value.String())
+		default:
+			opts[f.Name] = f.Value.String()
+		}
+	})
+	return json.MarshalIndent(opts, "", "    ")
+}
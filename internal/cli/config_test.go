@@ -0,0 +1,121 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+const testConfig = `{
+    "ignore-xattr": true,
+    "min-size": "4k",
+    "exclude-dir": ["^\\.git$"],
+    "settle": "10s",
+    "profiles": {
+        "backups": {
+            "enable-linking": true,
+            "min-size": 100
+        },
+        "buildcache": {"exclude": ["\\.lock$", "\\.tmp$"]}
+    }
+}`
+
+// newTestConfigCmd returns a command with the main flags (alongside the watch
+// command), after parsing the args
+func newTestConfigCmd(t *testing.T, args ...string) (*cobra.Command, *CLIOptions) {
+	co := &CLIOptions{}
+	cmd := &cobra.Command{Use: "test"}
+	addRootFlags(cmd.Flags(), co)
+	addConfigFlags(cmd.Flags(), &configFlags{})
+	root := &cobra.Command{Use: "root"}
+	root.AddCommand(cmd, newWatchCmd())
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, co
+}
+
+func TestConfigApply(t *testing.T) {
+	c, err := parseConfig("test.json", []byte(testConfig))
+	if err != nil {
+		t.Fatalf("Couldn't parse config: %v", err)
+	}
+
+	cmd, co := newTestConfigCmd(t)
+	if err := c.apply(cmd, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !co.IgnoreXAttr || co.CLIMinFileSize.n != 4096 || len(co.CLIDirExcludes.vals) != 1 || co.LinkingEnabled {
+		t.Errorf("Top level settings weren't applied: %+v", co)
+	}
+
+	// The profile replaces the top level settings, and flags replace both
+	cmd, co = newTestConfigCmd(t, "--exclude", "foo", "--ignore-xattr=false")
+	if err := c.apply(cmd, "buildcache"); err != nil {
+		t.Fatal(err)
+	}
+	if co.IgnoreXAttr || len(co.CLIFileExcludes.vals) != 1 || co.CLIFileExcludes.vals[0] != "foo" {
+		t.Errorf("Command line flags were replaced by the config: %+v", co)
+	}
+	cmd, co = newTestConfigCmd(t)
+	if err := c.apply(cmd, "backups"); err != nil {
+		t.Fatal(err)
+	}
+	if !co.LinkingEnabled || co.CLIMinFileSize.n != 100 {
+		t.Errorf("Profile settings weren't applied: %+v", co)
+	}
+
+	cmd, _ = newTestConfigCmd(t)
+	if err := c.apply(cmd, "missing"); err == nil {
+		t.Errorf("Expected an error for a missing profile")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		errStr string
+	}{
+		{"{\n\"ignore-time\": true,\n\"ignore-tme\": true\n}", "test.json:3: unknown option"},
+		{"{\n\"profiles\": {\"p\": {\n\n\"exclude\": [\"(\"]}}}", "test.json:4: invalid \"exclude\" regex"},
+		{"{\n\"min-size\": \"4x\"\n}", "test.json:2: invalid \"min-size\" value"},
+		{"{\n\"json\": true,\n\"html\": tru\n}", "test.json:3: invalid character"},
+		{"{\n\"json\": null\n}", "test.json:2: invalid value"},
+		{"{\"config\": \"other.json\"}", "test.json:1: unknown option"},
+	}
+	for _, tc := range tests {
+		c, err := parseConfig("test.json", []byte(tc.config))
+		if err == nil {
+			cmd, _ := newTestConfigCmd(t)
+			if strings.Contains(tc.config, "profiles") {
+				err = c.apply(cmd, "p")
+			} else {
+				err = c.apply(cmd, "")
+			}
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tc.errStr) {
+			t.Errorf("Expected error starting with %q, got: %v", tc.errStr, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/chadnetzer/hardlinkable"
+
+	"github.com/spf13/cobra"
+)
+
+// newWatchCmd returns the subcommand that links files as they are written
+func newWatchCmd() *cobra.Command {
+	co := CLIOptions{}
+	wo := hardlinkable.WatchOptions{}
+	cf := configFlags{}
+	cmd := &cobra.Command{
+		Use:   "watch [OPTIONS] dir1 [dir2...]",
+		Short: "Keep linking identical files as they are written (Linux only)",
+		Long: `Scan and link the directories, and then keep watching them (with inotify)
+for new files.  Files that are written or moved into the directories are
+linked to an identical file once they have been left unchanged for the settle
+time.  Stats are logged periodically, and when stopped with SIGINT or SIGTERM.`,
+		Args:                  cobra.MinimumNArgs(1),
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := applyConfig(cmd, cf); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			WatchRun(args, co, wo)
+		},
+	}
+
+	flg := cmd.Flags()
+	flg.BoolVar(&co.LinkingEnabled, "enable-linking", false, "Perform the actual linking (required)")
+	addMatchFlags(flg, &co)
+	flg.CountVarP(&co.CLIDebugLevel, "debug", "d", "``Increase debugging level")
+	flg.BoolVar(&co.IgnoreWalkErrors, "ignore-walkerr", false, "Continue on file/dir read errs")
+	flg.BoolVar(&co.IgnoreLinkErrors, "ignore-linkerr", false, "Continue when linking fails")
+	flg.BoolVar(&co.UseNewLinkDisabled, "disable-newest", false, "Disable using newest link mtime/uid/gid")
+	flg.DurationVar(&wo.SettleTime, "settle", hardlinkable.DefaultWatchSettleTime, "Time a new file must be unchanged before linking")
+	flg.DurationVar(&wo.StatsInterval, "stats-interval", hardlinkable.DefaultWatchStatsInterval, "Interval between logged stats (0 to disable)")
+	addConfigFlags(flg, &cf)
+	flg.SortFlags = false
+
+	return cmd
+}
+
+// WatchRun runs the watch subcommand until it is stopped by a signal
+func WatchRun(args []string, co CLIOptions, wo hardlinkable.WatchOptions) {
+	if !co.LinkingEnabled {
+		fmt.Fprintln(os.Stderr, "watch requires --enable-linking")
+		os.Exit(1)
+	}
+
+	opts := co.ToOptions()
+	if err := co.loadPolicy(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	wo.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	results, sig, err := runCatchingSignals(func(ctx context.Context) (hardlinkable.Results, error) {
+		return hardlinkable.Watch(ctx, args, opts, wo)
+	})
+	if sig == nil {
+		fmt.Fprintln(os.Stderr, err)
+		if results.Phase != hardlinkable.StartPhase {
+			results.OutputResults()
+		}
+		os.Exit(1)
+	}
+	results.OutputResults()
+}
@@ -23,7 +23,8 @@ package inode
 import (
 	"hash/fnv"
 	"io"
-	"os"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 type Digest uint32
@@ -31,12 +32,14 @@ type Digest uint32
 type InoDigests struct {
 	InoSets        map[Digest]Set
 	InosWithDigest Set
+	digests        map[Ino]Digest
 }
 
 func NewInoDigests() InoDigests {
 	return InoDigests{
 		InoSets:        make(map[Digest]Set),
 		InosWithDigest: NewSet(),
+		digests:        make(map[Ino]Digest),
 	}
 }
 
@@ -50,11 +53,34 @@ func (id *InoDigests) Add(pi PathInfo, digest Digest) {
 	}
 }
 
-func (id *InoDigests) NewDigest(pi PathInfo, buf []byte) bool {
+// Get returns the digest of the given inode, if it has one
+func (id *InoDigests) Get(ino Ino) (Digest, bool) {
+	d, ok := id.digests[ino]
+	return d, ok
+}
+
+// Remove forgets the digest of the given inode, such as when it has been
+// removed or its content has changed.
+func (id *InoDigests) Remove(ino Ino) {
+	digest, ok := id.digests[ino]
+	if !ok {
+		return
+	}
+	if set, ok := id.InoSets[digest]; ok {
+		set.Remove(ino)
+		if len(set) == 0 {
+			delete(id.InoSets, digest)
+		}
+	}
+	delete(id.digests, ino)
+	id.InosWithDigest.Remove(ino)
+}
+
+func (id *InoDigests) NewDigest(fs vfs.FS, pi PathInfo, buf []byte) bool {
 	var computed bool
 	if !id.InosWithDigest.Has(pi.Ino) {
 		pathname := pi.Pathsplit.Join()
-		digest, err := ContentDigest(pathname, buf)
+		digest, err := ContentDigest(fs, pathname, buf)
 		if err == nil {
 			digestHelper(id, pi, digest)
 			computed = true
@@ -71,6 +97,7 @@ func digestHelper(id *InoDigests, pi PathInfo, digest Digest) {
 		set.Add(pi.Ino)
 	}
 	id.InosWithDigest.Add(pi.Ino)
+	id.digests[pi.Ino] = digest
 }
 
 // ContentDigest returns a short digest of the first part of the given
@@ -79,8 +106,8 @@ func digestHelper(id *InoDigests, pi PathInfo, digest Digest) {
 // file comparison will be performed anyway (incurring the IO overhead), and
 // saving the digest to help quickly reduce the set of possibly equal inodes
 // later (ie. reducing the length of the repeated linear searches).
-func ContentDigest(pathname string, buf []byte) (Digest, error) {
-	f, err := os.Open(pathname)
+func ContentDigest(fs vfs.FS, pathname string, buf []byte) (Digest, error) {
+	f, err := fs.Open(pathname)
 	if err != nil {
 		return 0, err
 	}
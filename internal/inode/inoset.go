@@ -227,7 +227,10 @@ func (l LinkableInoSets) Containing(ino Ino) Set {
 // the Add()s have completed (ie. the path/inode information gathering phase
 // has completed, and moved to the link generation phase), no locking of
 // LinkableInoSets is required.
-func (l LinkableInoSets) All() <-chan Set {
+//
+// Closing the done channel stops the iteration early (a nil done channel never
+// stops it).
+func (l LinkableInoSets) All(done <-chan struct{}) <-chan Set {
 	// Make a slice of the Ino keys in LinkableInoSets, so that we can sort
 	// them.  This allows us to output the full number of linkableInoSets
 	// in a deterministic order (leading to more repeatable ordering of
@@ -251,7 +254,11 @@ func (l LinkableInoSets) All() <-chan Set {
 			if seen.Has(startIno) {
 				continue
 			}
-			out <- linkableInoSetHelper(l, startIno, seen)
+			select {
+			case out <- linkableInoSetHelper(l, startIno, seen):
+			case <-done:
+				return
+			}
 		}
 	}()
 	return out
@@ -238,7 +238,7 @@ func TestLinkableInoSets(t *testing.T) {
 
 	// Simple test (for now) of All() iteration over final sets
 	i := 0
-	for v := range l.All() {
+	for v := range l.All(nil) {
 		if len(v) != 9 {
 			t.Errorf("Expected InoSet %v len to be: %v, got: %v", v, 9, len(v))
 		}
@@ -270,7 +270,7 @@ func TestLinkableInoSets(t *testing.T) {
 	for _, v := range tests2 {
 		l.Add(v.pairs[0], v.pairs[1])
 		i := 0
-		for range l.All() {
+		for range l.All(nil) {
 			i++
 		}
 		if i != v.numSets {
@@ -278,3 +278,24 @@ func TestLinkableInoSets(t *testing.T) {
 		}
 	}
 }
+
+func TestLinkableInoSetsAllDone(t *testing.T) {
+	l := make(LinkableInoSets)
+	l.Add(1, 2)
+	l.Add(3, 4)
+	l.Add(5, 6)
+
+	done := make(chan struct{})
+	c := l.All(done)
+	<-c
+	close(done)
+
+	// The generator must stop, and close the channel
+	n := 0
+	for range c {
+		n++
+	}
+	if n > 1 {
+		t.Errorf("Expected at most 1 more InoSet after done, got: %v", n)
+	}
+}
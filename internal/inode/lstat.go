@@ -23,8 +23,9 @@ package inode
 import (
 	"fmt"
 	"os"
-	"syscall"
 	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 type InoStatInfo map[Ino]*StatInfo
@@ -47,24 +48,24 @@ type DevStatInfo struct {
 	StatInfo
 }
 
-func LStatInfo(pathname string) (DevStatInfo, error) {
-	fi, err := os.Lstat(pathname)
+func LStatInfo(fs vfs.FS, pathname string) (DevStatInfo, error) {
+	fi, err := fs.Lstat(pathname)
 	if err != nil {
 		return DevStatInfo{}, err
 	}
-	stat_t, ok := fi.Sys().(*syscall.Stat_t)
+	stat_t, ok := vfs.StatOf(fi)
 	if !ok {
 		errString := fmt.Errorf("Couldn't convert Stat_t for pathname: %s", pathname)
 		return DevStatInfo{}, errString
 	}
 	di := DevStatInfo{
-		Dev: uint64(stat_t.Dev),
+		Dev: stat_t.Dev,
 		StatInfo: StatInfo{
-			Size:  uint64(stat_t.Size),
+			Size:  uint64(fi.Size()),
 			Ino:   Ino(stat_t.Ino),
-			Nlink: uint64(stat_t.Nlink),
-			Uid:   uint32(stat_t.Uid),
-			Gid:   uint32(stat_t.Gid),
+			Nlink: stat_t.Nlink,
+			Uid:   stat_t.Uid,
+			Gid:   stat_t.Gid,
 			Mode:  fi.Mode(),
 			Mtim:  fi.ModTime(),
 		},
@@ -67,8 +67,9 @@ func (pm PathsMap) AppendPath(ino Ino, path P.Pathsplit) {
 }
 
 // AllPaths returns a channel that can be iterated over to sequentially access
-// all the paths for a given inode.
-func (pm PathsMap) AllPaths(ino Ino) <-chan P.Pathsplit {
+// all the paths for a given inode.  Closing the done channel stops the
+// iteration early (a nil done channel never stops it).
+func (pm PathsMap) AllPaths(ino Ino, done <-chan struct{}) <-chan P.Pathsplit {
 	// To avoid concurrent modification to the PathsMap maps while
 	// iterating from another goroutine, first place all the pathnames into
 	// a slice, in order to send them over the channel.
@@ -78,7 +79,11 @@ func (pm PathsMap) AllPaths(ino Ino) <-chan P.Pathsplit {
 	go func() {
 		defer close(out)
 		for _, path := range paths {
-			out <- path
+			select {
+			case out <- path:
+			case <-done:
+				return
+			}
 		}
 	}()
 	return out
@@ -2,12 +2,13 @@ package inode
 
 import (
 	"fmt"
-	"os"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 // ReadChunk will retry Read() until it fills the buf, or reaches EOF or
 // an error.
-func ReadChunk(f *os.File, buf []byte) (n int, err error) {
+func ReadChunk(f vfs.File, buf []byte) (n int, err error) {
 	// For Posix reads of normal files, Read() will almost certainly return
 	// a maximal Read() (or non-EOF error), but just in case, we make sure
 	// to attempt to return a maximal chunk anyway.  Simple spin protection
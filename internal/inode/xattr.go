@@ -23,17 +23,17 @@ package inode
 import (
 	"bytes"
 
-	"github.com/pkg/xattr"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
-func EqualXAttrs(pathname1, pathname2 string) (bool, error) {
+func EqualXAttrs(fs vfs.FS, pathname1, pathname2 string) (bool, error) {
 	var list1, list2 []string
 	var err error
-	if list1, err = xattr.LList(pathname1); err != nil {
+	if list1, err = fs.ListXattr(pathname1); err != nil {
 		return false, err
 	}
 
-	if list2, err = xattr.LList(pathname2); err != nil {
+	if list2, err = fs.ListXattr(pathname2); err != nil {
 		return false, err
 	}
 
@@ -49,7 +49,7 @@ func EqualXAttrs(pathname1, pathname2 string) (bool, error) {
 
 	d := make(map[string][]byte, len(list1))
 	for _, key := range list1 {
-		d[key], err = xattr.LGet(pathname1, key)
+		d[key], err = fs.GetXattr(pathname1, key)
 		if err != nil {
 			return false, err
 		}
@@ -60,7 +60,7 @@ func EqualXAttrs(pathname1, pathname2 string) (bool, error) {
 		if !ok {
 			return false, nil
 		}
-		v2, err := xattr.LGet(pathname2, key)
+		v2, err := fs.GetXattr(pathname2, key)
 		if err != nil {
 			return false, nil
 		}
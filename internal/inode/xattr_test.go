@@ -25,6 +25,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/chadnetzer/hardlinkable/vfs"
 	"github.com/pkg/xattr"
 )
 
@@ -58,7 +59,7 @@ func TestEqualXAttrs(t *testing.T) {
 		defer os.Remove(f2.Name())
 	}
 
-	if eq, errX1 := EqualXAttrs(f1.Name(), f2.Name()); !eq || errX1 != nil {
+	if eq, errX1 := EqualXAttrs(vfs.OS, f1.Name(), f2.Name()); !eq || errX1 != nil {
 		t.Errorf("Unexpected Xattr mismatch for files %s and %s.  Should have no attributes: %v", f1.Name(), f2.Name(), errX1)
 	}
 
@@ -67,7 +68,7 @@ func TestEqualXAttrs(t *testing.T) {
 		t.Fatalf("Couldn't LSet key 'user.a' to 'a1' on file1 %v: %v", f1, err)
 	}
 
-	if eq, errX2 := EqualXAttrs(f1.Name(), f2.Name()); eq || errX2 != nil {
+	if eq, errX2 := EqualXAttrs(vfs.OS, f1.Name(), f2.Name()); eq || errX2 != nil {
 		t.Errorf("Unexpected Xattr match or error for files %s and %s.: %v", f1.Name(), f2.Name(), errX2)
 	}
 
@@ -76,7 +77,7 @@ func TestEqualXAttrs(t *testing.T) {
 		t.Fatalf("Couldn't LSet key 'user.a' to 'a1' on file2 %v: %v", f1, err)
 	}
 
-	if eq, errX3 := EqualXAttrs(f1.Name(), f2.Name()); !eq || errX3 != nil {
+	if eq, errX3 := EqualXAttrs(vfs.OS, f1.Name(), f2.Name()); !eq || errX3 != nil {
 		t.Errorf("Unexpected Xattr mismatch or error for files %s and %s.: %v", f1.Name(), f2.Name(), errX3)
 	}
 
@@ -85,7 +86,7 @@ func TestEqualXAttrs(t *testing.T) {
 		t.Fatalf("Couldn't LSet key 'user.b' to 'b1' on file %v: %v", f1, err)
 	}
 
-	if eq, errX4 := EqualXAttrs(f1.Name(), f2.Name()); eq || errX4 != nil {
+	if eq, errX4 := EqualXAttrs(vfs.OS, f1.Name(), f2.Name()); eq || errX4 != nil {
 		t.Errorf("Unexpected Xattr match or error for files %s and %s.: %v", f1.Name(), f2.Name(), errX4)
 	}
 }
@@ -0,0 +1,248 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+)
+
+// Inode attributes that can prevent equal files from being linked
+const (
+	AttrMtime = "mtime"
+	AttrMode  = "mode"
+	AttrUID   = "uid"
+	AttrGID   = "gid"
+	AttrXAttr = "xattr"
+)
+
+// NearDuplicate is a pair of files with equal content, that weren't linkable
+// only because of the listed (non-ignored) inode attributes.  Re-running with
+// the matching Ignore options, or fixing the attributes, would allow them to
+// be linked.
+type NearDuplicate struct {
+	Path1   string   `json:"path1"`
+	Path2   string   `json:"path2"`
+	Size    uint64   `json:"size"`
+	Differs []string `json:"differs"`
+}
+
+// blockingAttrs returns the inode attributes that differ between the two
+// files, and that aren't ignored by the policy of their paths.
+func (f *fsDev) blockingAttrs(pi1, pi2 I.PathInfo) []string {
+	pp := f.policy.forPair(pi1.Pathsplit, pi2.Pathsplit)
+	var attrs []string
+	if !pp.ignoreTime && !pi1.EqualTime(pi2) {
+		attrs = append(attrs, AttrMtime)
+	}
+	if !pp.ignorePerm && !pi1.EqualMode(pi2) {
+		attrs = append(attrs, AttrMode)
+	}
+	if !pp.ignoreOwner && pi1.Uid != pi2.Uid {
+		attrs = append(attrs, AttrUID)
+	}
+	if !pp.ignoreOwner && pi1.Gid != pi2.Gid {
+		attrs = append(attrs, AttrGID)
+	}
+	if !pp.ignoreXAttr {
+		if eq, err := I.EqualXAttrs(f.fsys, pi1.Join(), pi2.Join()); err == nil && !eq {
+			attrs = append(attrs, AttrXAttr)
+		}
+	}
+	return attrs
+}
+
+// inoSetReps returns the lowest inode of each set of linkable inodes (mapped to
+// the set), and each walked inode that isn't linkable to any other (mapped to
+// a set of itself).
+func (f *fsDev) inoSetReps() map[I.Ino]I.Set {
+	reps := make(map[I.Ino]I.Set)
+	seen := I.NewSet()
+	for linkableSet := range f.LinkableInos.All(f.ctx.Done()) {
+		var rep I.Ino
+		first := true
+		for ino := range linkableSet {
+			if first || ino < rep {
+				rep, first = ino, false
+			}
+			seen.Add(ino)
+		}
+		reps[rep] = linkableSet
+	}
+	for ino := range f.inoStatInfo {
+		if !seen.Has(ino) {
+			reps[ino] = I.NewSet(ino)
+		}
+	}
+	return reps
+}
+
+// findNearDuplicates compares the walked inodes of equal size and content
+// digest that aren't linkable only because of their inode attributes, and
+// records the equal pairs.  Each set of linkable inodes is represented by one
+// of its inodes.  It must be called after the walk, but before the link phase
+// modifies the inode and path information.
+func (f *fsDev) findNearDuplicates() error {
+	bySize := make(map[uint64][]I.Ino)
+	for ino := range f.inoSetReps() {
+		size := f.inoStatInfo[ino].Size
+		bySize[size] = append(bySize[size], ino)
+	}
+
+	for _, inos := range bySize {
+		if err := f.ctx.Err(); err != nil {
+			return err
+		}
+		if len(inos) < 2 {
+			continue
+		}
+		sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+
+		// Only inodes with equal digests can have equal content, so
+		// the (possibly many) equal sized inodes are split by digest
+		// before any full comparisons.  Digests already computed
+		// during the walk (or loaded from the StateFile) are reused.
+		byDigest := make(map[I.Digest][]I.Ino)
+		var digests []I.Digest
+		for _, ino := range inos {
+			d, err := f.inoDigest(ino)
+			if ctxErr := f.ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err != nil {
+				f.Results.addError(errOp(err, OpRead), f.PathInfoFromIno(ino).Join(), err)
+				if !f.Options.IgnoreWalkErrors {
+					return err
+				}
+				continue
+			}
+			if _, ok := byDigest[d]; !ok {
+				digests = append(digests, d)
+			}
+			byDigest[d] = append(byDigest[d], ino)
+		}
+		for _, d := range digests {
+			if err := f.compareNearDuplicates(byDigest[d]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inoDigest returns the content digest of the inode, computing (and caching)
+// it if it isn't already known.
+func (f *fsDev) inoDigest(ino I.Ino) (I.Digest, error) {
+	if d, ok := f.InoDigests.Get(ino); ok {
+		return d, nil
+	}
+	pi := f.PathInfoFromIno(ino)
+	d, err := I.ContentDigest(f.fsys, pi.Join(), f.digestBuf)
+	if err != nil {
+		return 0, err
+	}
+	f.InoDigests.Add(pi, d)
+	f.Results.computedDigest()
+	return d, nil
+}
+
+// compareNearDuplicates compares the given inodes (of equal size and digest,
+// in ascending order), and records the pairs with equal content that differ
+// in their inode attributes.
+func (f *fsDev) compareNearDuplicates(inos []I.Ino) error {
+	if len(inos) < 2 {
+		return nil
+	}
+
+	// Each cluster leader is the first inode found with some content.
+	// Inodes with no blocking attributes relative to a leader were already
+	// compared during the walk, and so have different content.
+	var leaders []I.PathInfo
+InoLoop:
+	for _, ino := range inos {
+		pi := f.PathInfoFromIno(ino)
+		for _, leader := range leaders {
+			attrs := f.blockingAttrs(leader, pi)
+			if len(attrs) == 0 {
+				continue
+			}
+			f.Results.didComparison()
+			eq, err := areFileContentsEqual(f.status, leader.Join(), pi.Join())
+			if ctxErr := f.ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err != nil {
+				f.Results.addError(errOp(err, OpRead), pi.Join(), err)
+				if !f.Options.IgnoreWalkErrors {
+					return err
+				}
+				continue InoLoop
+			}
+			if eq {
+				f.Results.foundNearDuplicate(NearDuplicate{
+					Path1:   leader.Join(),
+					Path2:   pi.Join(),
+					Size:    pi.Size,
+					Differs: attrs,
+				})
+				continue InoLoop
+			}
+		}
+		leaders = append(leaders, pi)
+	}
+	return nil
+}
+
+// sortNearDuplicates orders the pairs from largest size to smallest (and by
+// pathname as a tie breaker)
+func (r *Results) sortNearDuplicates() {
+	s := r.NearDuplicates
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Size != s[j].Size {
+			return s[i].Size > s[j].Size
+		}
+		if s[i].Path1 != s[j].Path1 {
+			return s[i].Path1 < s[j].Path1
+		}
+		return s[i].Path2 < s[j].Path2
+	})
+}
+
+// OutputNearDuplicates shows in text form the pairs of equal files that
+// weren't linkable because of differing inode attributes.
+func (r *Results) OutputNearDuplicates() {
+	if len(r.NearDuplicates) == 0 {
+		return
+	}
+	fmt.Println("Equal files with differing inode attributes")
+	fmt.Println("-------------------------------------------")
+	s := make([]string, 0)
+	for _, nd := range r.NearDuplicates {
+		s = append(s, fmt.Sprintf("Filesize: %v  Differs: %v",
+			Humanize(nd.Size), strings.Join(nd.Differs, ", ")))
+		s = append(s, "  "+nd.Path1)
+		s = append(s, "  "+nd.Path2)
+	}
+	fmt.Println(strings.Join(s, "\n"))
+}
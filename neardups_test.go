@@ -0,0 +1,144 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunNearDuplicates(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(ReportNearDuplicates, IgnorePerm)
+
+	name := "testname: 'Near Duplicates'"
+
+	m := pathContents{
+		"f1": "XX", "f2": "XX", "f3": "XX", // f2 mtime differs, f3 mode differs
+		"g1": "YY", "g2": "YZ", // different content, same size
+		"h1": "Z", "h2": "Z", // linkable
+	}
+	simpleFileMaker(t, m)
+	then := time.Now().AddDate(-1, 0, 0)
+	for _, fname := range []string{"f2", "g2", "h1", "h2"} {
+		if err := os.Chtimes(fname, then, then); err != nil {
+			t.Fatalf("Failure to set time on test file: '%v'\n", fname)
+		}
+	}
+	if err := os.Chmod("f3", 0755); err != nil {
+		t.Fatalf("Couldn't set file 'f3' mode to '0755': %v", err)
+	}
+	result := simpleRun(name, t, opts, 2, ".")
+
+	// f1 and f3 are linkable (mode is ignored), and f2 differs in mtime.
+	// g1 and g2 have different contents.
+	nd := result.NearDuplicates
+	if len(nd) != 1 {
+		t.Fatalf("%v: Expected 1 NearDuplicate, got: %+v", name, nd)
+	}
+	pair := newSet(nd[0].Path1, nd[0].Path2)
+	_, hasF1 := pair["f1"]
+	_, hasF2 := pair["f2"]
+	_, hasF3 := pair["f3"]
+	if !hasF2 || !(hasF1 || hasF3) {
+		t.Errorf("%v: Unexpected NearDuplicate paths: %+v", name, nd[0])
+	}
+	if nd[0].Size != 2 || !reflect.DeepEqual(nd[0].Differs, []string{AttrMtime}) {
+		t.Errorf("%v: Expected size 2 and differing mtime, got: %+v", name, nd[0])
+	}
+}
+
+func TestRunNearDuplicatesPolicy(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	// Mtimes are ignored, except below "strict"
+	opts := SetupOptions(ReportNearDuplicates, IgnoreTime,
+		Policy(PolicyRule{Path: "strict", IgnoreTime: boolPtr(false)}))
+
+	name := "testname: 'Near Duplicates with PolicyRules'"
+
+	m := pathContents{"strict/f1": "XX", "strict/f2": "XX", "loose/g1": "YY", "loose/g2": "YY"}
+	simpleFileMaker(t, m)
+	then := time.Now().AddDate(-1, 0, 0)
+	for _, fname := range []string{"strict/f2", "loose/g2"} {
+		if err := os.Chtimes(fname, then, then); err != nil {
+			t.Fatalf("Failure to set time on test file: '%v'\n", fname)
+		}
+	}
+	result := simpleRun(name, t, opts, 1, "strict", "loose")
+
+	// Only the strict pair is blocked, by its mtime
+	nd := result.NearDuplicates
+	if len(nd) != 1 {
+		t.Fatalf("%v: Expected 1 NearDuplicate, got: %+v", name, nd)
+	}
+	if !reflect.DeepEqual(newSet(nd[0].Path1, nd[0].Path2), newSet("strict/f1", "strict/f2")) ||
+		!reflect.DeepEqual(nd[0].Differs, []string{AttrMtime}) {
+		t.Errorf("%v: Expected strict pair with differing mtime, got: %+v", name, nd[0])
+	}
+}
+
+func TestRunNearDuplicatesDigests(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(ReportNearDuplicates)
+
+	name := "testname: 'Near Duplicates of equal size and differing content'"
+
+	// Many equal sized files, with differing content and mtimes, and one
+	// equal pair (f00 and same) that differs only in mtime.
+	const numFiles = 50
+	m := pathContents{"same": "content-00"}
+	for i := 0; i < numFiles; i++ {
+		m[fmt.Sprintf("f%02d", i)] = fmt.Sprintf("content-%02d", i)
+	}
+	simpleFileMaker(t, m)
+	now := time.Now()
+	for i := 0; i < numFiles; i++ {
+		then := now.Add(-time.Duration(i+1) * time.Hour)
+		fname := fmt.Sprintf("f%02d", i)
+		if err := os.Chtimes(fname, then, then); err != nil {
+			t.Fatalf("Failure to set time on test file: '%v'\n", fname)
+		}
+	}
+	result := simpleRun(name, t, opts, 0, ".")
+
+	nd := result.NearDuplicates
+	if len(nd) != 1 {
+		t.Fatalf("%v: Expected 1 NearDuplicate, got: %+v", name, nd)
+	}
+	if !reflect.DeepEqual(newSet(nd[0].Path1, nd[0].Path2), newSet("f00", "same")) {
+		t.Errorf("%v: Unexpected NearDuplicate paths: %+v", name, nd[0])
+	}
+
+	// Only the files with equal digests are compared, rather than every
+	// pair of equal sized files.
+	if result.ComparisonCount != 1 {
+		t.Errorf("%v: Expected 1 comparison, got: %v", name, result.ComparisonCount)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+// The reasons that a walked file can be rejected, as passed to
+// Observer.FileRejected
+const (
+	RejectExcluded    = "excluded"
+	RejectSetuid      = "setuid"
+	RejectSetgid      = "setgid"
+	RejectNonPermBits = "non-perm mode bits"
+	RejectTooSmall    = "too small"
+	RejectTooLarge    = "too large"
+	RejectError       = "error"
+)
+
+// Observer receives events as a Run progresses, for programs that want to
+// monitor (or control) the Run before it returns.  The methods are called
+// from the goroutine that called Run, so they should return quickly.  Embed
+// NopObserver to implement only some of the methods.
+type Observer interface {
+	// DirEntered is called for each directory that is walked
+	DirEntered(pathname string)
+
+	// FileAccepted is called for each file that is considered for linking
+	FileAccepted(pathname string, size uint64)
+
+	// FileRejected is called for each walked file that is skipped, with
+	// one of the Reject reasons
+	FileRejected(pathname string, reason string)
+
+	// Compared is called after the contents of two files were compared
+	Compared(pathname1, pathname2 string, equal bool)
+
+	// LinkPlanned is called before each link is made (or counted, when
+	// linking isn't enabled).  Returning false vetoes the link.
+	LinkPlanned(src, dst string, size uint64) bool
+
+	// LinkDone is called after a planned link was made (or counted), with
+	// the error if linking failed
+	LinkDone(src, dst string, size uint64, err error)
+
+	// PhaseChanged is called when the Run moves to the next phase
+	PhaseChanged(phase RunPhases)
+}
+
+// NopObserver implements Observer with methods that do nothing (and allow
+// all links).  It can be embedded to implement only some of the methods.
+type NopObserver struct{}
+
+// DirEntered does nothing
+func (NopObserver) DirEntered(pathname string) {}
+
+// FileAccepted does nothing
+func (NopObserver) FileAccepted(pathname string, size uint64) {}
+
+// FileRejected does nothing
+func (NopObserver) FileRejected(pathname string, reason string) {}
+
+// Compared does nothing
+func (NopObserver) Compared(pathname1, pathname2 string, equal bool) {}
+
+// LinkPlanned allows every link
+func (NopObserver) LinkPlanned(src, dst string, size uint64) bool { return true }
+
+// LinkDone does nothing
+func (NopObserver) LinkDone(src, dst string, size uint64, err error) {}
+
+// PhaseChanged does nothing
+func (NopObserver) PhaseChanged(phase RunPhases) {}
+
+// heartbeat is implemented by Observers that also want to be called
+// periodically during long file comparisons
+type heartbeat interface {
+	Show()
+}
+
+// observers sends the events to each Observer in turn.  A link is vetoed if
+// any of them vetoes it.
+type observers []Observer
+
+func newObservers(o ...Observer) observers {
+	var obs observers
+	for _, x := range o {
+		if x != nil {
+			obs = append(obs, x)
+		}
+	}
+	return obs
+}
+
+func (obs observers) DirEntered(pathname string) {
+	for _, o := range obs {
+		o.DirEntered(pathname)
+	}
+}
+
+func (obs observers) FileAccepted(pathname string, size uint64) {
+	for _, o := range obs {
+		o.FileAccepted(pathname, size)
+	}
+}
+
+func (obs observers) FileRejected(pathname string, reason string) {
+	for _, o := range obs {
+		o.FileRejected(pathname, reason)
+	}
+}
+
+func (obs observers) Compared(pathname1, pathname2 string, equal bool) {
+	for _, o := range obs {
+		o.Compared(pathname1, pathname2, equal)
+	}
+}
+
+func (obs observers) LinkPlanned(src, dst string, size uint64) bool {
+	for _, o := range obs {
+		if !o.LinkPlanned(src, dst, size) {
+			return false
+		}
+	}
+	return true
+}
+
+func (obs observers) LinkDone(src, dst string, size uint64, err error) {
+	for _, o := range obs {
+		o.LinkDone(src, dst, size, err)
+	}
+}
+
+func (obs observers) PhaseChanged(phase RunPhases) {
+	for _, o := range obs {
+		o.PhaseChanged(phase)
+	}
+}
+
+func (obs observers) Show() {
+	for _, o := range obs {
+		if h, ok := o.(heartbeat); ok {
+			h.Show()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// recordingObserver records the events, and vetoes the first planned link
+type recordingObserver struct {
+	NopObserver
+	dirs     int
+	accepted stringSet
+	rejected map[string]string
+	compared int
+	planned  int
+	linked   []string
+	phases   []RunPhases
+}
+
+func (o *recordingObserver) DirEntered(pathname string) { o.dirs++ }
+func (o *recordingObserver) FileAccepted(pathname string, size uint64) {
+	o.accepted[pathname] = struct{}{}
+}
+func (o *recordingObserver) FileRejected(pathname string, reason string) {
+	o.rejected[pathname] = reason
+}
+func (o *recordingObserver) Compared(p1, p2 string, equal bool) { o.compared++ }
+func (o *recordingObserver) LinkPlanned(src, dst string, size uint64) bool {
+	o.planned++
+	return o.planned > 1
+}
+func (o *recordingObserver) LinkDone(src, dst string, size uint64, err error) {
+	if err == nil {
+		o.linked = append(o.linked, dst)
+	}
+}
+func (o *recordingObserver) PhaseChanged(phase RunPhases) {
+	o.phases = append(o.phases, phase)
+}
+
+func TestRunObserver(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	o := &recordingObserver{accepted: newSet(), rejected: make(map[string]string)}
+	opts := SetupOptions(LinkingEnabled, MinFileSize(2))
+	opts.FileExcludes = []string{"^x"}
+	opts.Observer = o
+
+	name := "testname: 'Observer'"
+	m := pathContents{
+		"f1":   "XXX",
+		"f2":   "XXX",
+		"d/f3": "XXX",
+		"g1":   "Y",
+		"x1":   "XXX",
+	}
+	simpleFileMaker(t, m)
+	result := simpleRun(name, t, opts, 1, ".")
+
+	if o.dirs != 2 {
+		t.Errorf("%v: Expected 2 dirs entered, got: %v", name, o.dirs)
+	}
+	if !reflect.DeepEqual(o.accepted, newSet("f1", "f2", "d/f3")) {
+		t.Errorf("%v: Unexpected accepted files: %v", name, o.accepted)
+	}
+	wantRejected := map[string]string{"g1": RejectTooSmall, "x1": RejectExcluded}
+	if !reflect.DeepEqual(o.rejected, wantRejected) {
+		t.Errorf("%v: Expected rejected files %v, got: %v", name, wantRejected, o.rejected)
+	}
+	if o.compared == 0 {
+		t.Errorf("%v: Expected comparisons to be observed", name)
+	}
+	wantPhases := []RunPhases{WalkPhase, LinkPhase, EndPhase}
+	if !reflect.DeepEqual(o.phases, wantPhases) {
+		t.Errorf("%v: Expected phases %v, got: %v", name, wantPhases, o.phases)
+	}
+
+	// The first of the two planned links was vetoed
+	if o.planned != 2 || len(o.linked) != 1 {
+		t.Errorf("%v: Expected 2 planned and 1 done links, got: %v %v", name, o.planned, o.linked)
+	}
+	if result.VetoedLinkCount != 1 || result.NewLinkCount != 1 {
+		t.Errorf("%v: Expected 1 vetoed and 1 new link, got: %v %v",
+			name, result.VetoedLinkCount, result.NewLinkCount)
+	}
+	if nlinkVal(o.linked[0]) != 2 {
+		t.Errorf("%v: Expected %v to be linked", name, o.linked[0])
+	}
+}
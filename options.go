@@ -20,7 +20,12 @@
 
 package hardlinkable
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
 
 const DefaultSearchThresh = 1
 const DefaultMinFileSize = 1
@@ -29,6 +34,10 @@ const DefaultStoreExistingLinkResults = true // Non-cli default
 const DefaultStoreNewLinkResults = true      // Non-cli default
 const DefaultShowExtendedRunStats = false    // Non-cli default
 const DefaultShowRunStats = true             // Non-cli default
+const DefaultMaxErrorResults = 1000
+const AllErrorResults = -1 // MaxErrorResults that stores all errors
+const NoErrorResults = -2  // MaxErrorResults that only counts errors
+const DefaultDirSavingsDepth = 1
 
 // Options is passed to the Run() func, and controls the operation of the
 // hardlinkable algorithm, including what inode parameters much match for files
@@ -87,6 +96,12 @@ type Options struct {
 	// directories will be excluded from the file discovery walk.
 	DirExcludes []string
 
+	// PolicyRules override the matching Options (SameName, the Ignore
+	// options, the file size limits, and exclusion) for the paths that
+	// they match.  Two files are only linked if the policies of both of
+	// their paths allow it.  See LoadPolicyFile.
+	PolicyRules []PolicyRule
+
 	// StoreExistingLinkResults allows controlling whether to store
 	// discovered existing links in Results. Command line option Verbosity
 	// > 2 can override.
@@ -125,6 +140,77 @@ type Options struct {
 	// amount of memory, but potentially at greatly increased runtime in
 	// worst case scenarios with many, many files.
 	SearchThresh int
+
+	// MaxErrorResults limits how many errors (along with their pathnames
+	// and operations) are stored in Results.Errors.  Errors beyond the
+	// limit are only counted.  Zero means DefaultMaxErrorResults,
+	// AllErrorResults stores all errors, and NoErrorResults stores none.
+	MaxErrorResults int
+
+	// DirSavingsTopN enables the per-directory savings report in Results,
+	// limited to the given number of directories with the most savings.
+	DirSavingsTopN int
+
+	// DirSavingsDepth is the number of directory levels below each walked
+	// root that the per-directory savings are rolled up into.
+	DirSavingsDepth int
+
+	// ReportOwnerSavings enables the per-uid and per-gid savings report in
+	// Results, which also shows the bytes whose quota charge moves from
+	// one owner to another when linking files with different owners.
+	ReportOwnerSavings bool
+
+	// DuplicatesTopN enables the duplicate distribution report in
+	// Results, with the given number of top extensions and largest groups
+	// of identical inodes.
+	DuplicatesTopN int
+
+	// SQLiteFile, when not empty, is the pathname of a SQLite database
+	// that the scanned devices, inodes, paths, duplicate groups, planned
+	// links and errors are exported to (replacing any existing file).
+	// The program must import a database/sql driver for SQLiteDriver.
+	SQLiteFile string
+
+	// StateFile, when not empty, is the pathname of a file that the scan
+	// state (dir mtimes, and the stat info and digests of the indexed
+	// files) is saved to.  Later runs read the entries of dirs that are
+	// unchanged since the saved state from it, and reuse the saved stat
+	// info for their files.
+	StateFile string
+
+	// CheckpointFile, when not empty, is the pathname that the state of
+	// the Run (the walk position, the inode indexes, the link groups
+	// already processed and the Results) is periodically saved to, so that
+	// an interrupted Run can be resumed.  It is removed when the Run
+	// completes.
+	CheckpointFile string
+
+	// CheckpointInterval is the minimum time between checkpoints
+	// (DefaultCheckpointInterval if zero).
+	CheckpointInterval time.Duration
+
+	// Resume continues the Run from the CheckpointFile.  The dirs and
+	// files, and the matching and linking Options, must be unchanged.
+	Resume bool
+
+	// ReportNearDuplicates enables comparing the contents of equal sized
+	// files that aren't linkable only because of differing inode
+	// attributes (mtime, mode, uid/gid, or xattrs), and recording the equal
+	// pairs in Results.
+	ReportNearDuplicates bool
+
+	// ReportCrossDevice enables finding identical files on different
+	// devices (which can't be linked), and recording them in Results.
+	ReportCrossDevice bool
+
+	// Observer, when not nil, is called with the events of the Run, and
+	// can veto individual links.  It isn't included in the JSON output.
+	Observer Observer `json:"-"`
+
+	// FS, when not nil, is the filesystem that is walked and linked,
+	// instead of the operating system's (see the vfs package).  It isn't
+	// included in the JSON output.
+	FS vfs.FS `json:"-"`
 }
 
 // SetupOptions returns a Options struct with the defaults initialized and the
@@ -138,6 +224,8 @@ func SetupOptions(args ...func(*Options)) Options {
 		StoreNewLinkResults:      DefaultStoreNewLinkResults,
 		ShowExtendedRunStats:     DefaultShowExtendedRunStats,
 		ShowRunStats:             DefaultShowRunStats,
+		MaxErrorResults:          DefaultMaxErrorResults,
+		DirSavingsDepth:          DefaultDirSavingsDepth,
 	}
 	for _, fn := range args {
 		fn(&o)
@@ -238,14 +326,106 @@ func CheckQuiescence(o *Options) {
 	o.CheckQuiescence = true
 }
 
+// ReportDirSavings enables reporting the topN directories with the most savings,
+// rolled up to the given depth below each walked root.
+func ReportDirSavings(topN int, depth int) func(*Options) {
+	return func(o *Options) {
+		o.DirSavingsTopN = topN
+		o.DirSavingsDepth = depth
+	}
+}
+
+// ReportOwnerSavings enables reporting the savings per uid and gid
+func ReportOwnerSavings(o *Options) {
+	o.ReportOwnerSavings = true
+}
+
+// ReportDuplicates enables reporting the distribution of duplicates by size,
+// with the topN extensions and largest groups of identical inodes.
+func ReportDuplicates(topN int) func(*Options) {
+	return func(o *Options) {
+		o.DuplicatesTopN = topN
+	}
+}
+
+// ReportNearDuplicates enables reporting equal files that can't be linked
+// because of differing inode attributes
+func ReportNearDuplicates(o *Options) {
+	o.ReportNearDuplicates = true
+}
+
+// ReportCrossDevice enables reporting identical files on different devices
+func ReportCrossDevice(o *Options) {
+	o.ReportCrossDevice = true
+}
+
+// ExportSQLite exports the scan data to the given SQLite database file
+func ExportSQLite(pathname string) func(*Options) {
+	return func(o *Options) {
+		o.SQLiteFile = pathname
+	}
+}
+
+// UseStateFile saves the scan state to the given file, and reuses it for
+// the unchanged dirs on later runs
+func UseStateFile(pathname string) func(*Options) {
+	return func(o *Options) {
+		o.StateFile = pathname
+	}
+}
+
+// Checkpoint periodically saves the state of the Run to the given file
+func Checkpoint(pathname string) func(*Options) {
+	return func(o *Options) {
+		o.CheckpointFile = pathname
+	}
+}
+
+// Policy sets the PolicyRules that override the matching Options per path
+func Policy(rules ...PolicyRule) func(*Options) {
+	return func(o *Options) {
+		o.PolicyRules = rules
+	}
+}
+
 // Validate will ensure that contradictory Options aren't set, and that
 // dependent Options are set.  An error will be returned if Options is invalid.
 func (o *Options) Validate() error {
+	if o.MaxErrorResults < NoErrorResults {
+		return fmt.Errorf("MaxErrorResults (%v) must be at least %v", o.MaxErrorResults, NoErrorResults)
+	}
 	if o.MaxFileSize > 0 && o.MaxFileSize < o.MinFileSize {
 		return fmt.Errorf("MinFileSize (%v) cannot be larger than MaxFileSize (%v)",
 			o.MinFileSize, o.MaxFileSize)
 	}
 
+	if o.DuplicatesTopN < 0 {
+		return fmt.Errorf("DuplicatesTopN (%v) cannot be negative", o.DuplicatesTopN)
+	}
+
+	if o.DirSavingsTopN < 0 || o.DirSavingsDepth < 0 {
+		return fmt.Errorf("DirSavingsTopN (%v) and DirSavingsDepth (%v) cannot be negative",
+			o.DirSavingsTopN, o.DirSavingsDepth)
+	}
+
+	for i := range o.PolicyRules {
+		if err := o.PolicyRules[i].validate(); err != nil {
+			return fmt.Errorf("PolicyRules[%d]: %v", i, err)
+		}
+	}
+
+	if o.Resume && o.CheckpointFile == "" {
+		return fmt.Errorf("Resume requires a CheckpointFile")
+	}
+
+	if o.Resume && o.SQLiteFile != "" {
+		return fmt.Errorf("Resume cannot be combined with SQLiteFile")
+	}
+
+	if o.SQLiteFile != "" && !sqliteDriverRegistered() {
+		return fmt.Errorf("SQLiteFile requires a %q database/sql driver to be imported", SQLiteDriver)
+	}
+
 	if o.ShowExtendedRunStats {
 		o.ShowRunStats = true
 	}
@@ -0,0 +1,158 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"os/user"
+	"sort"
+	"strconv"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+)
+
+// OwnerSavings holds the bytes saved for a single uid (or gid), and the bytes
+// whose quota charge moves to or from other owners when inodes with different
+// owners are linked together (ie. with IgnoreOwner enabled).
+//
+// SavedBytes counts the removed inodes that were owned by ID.  When such an
+// inode's paths were moved to an inode with a different owner, its bytes are
+// also counted in ShiftedOutBytes, and in the other owner's ShiftedInBytes.
+// When linking is enabled, ownership changes made by UseNewestLink are also
+// counted as shifted bytes.
+type OwnerSavings struct {
+	ID              uint32 `json:"id"`
+	SavedBytes      uint64 `json:"savedBytes"`
+	ShiftedOutBytes uint64 `json:"shiftedOutBytes"`
+	ShiftedInBytes  uint64 `json:"shiftedInBytes"`
+}
+
+type ownerSavingsMap map[uint32]*OwnerSavings
+
+func (m ownerSavingsMap) get(id uint32) *OwnerSavings {
+	o, ok := m[id]
+	if !ok {
+		o = &OwnerSavings{ID: id}
+		m[id] = o
+	}
+	return o
+}
+
+// shift moves the charge for size bytes from one owner to another
+func (m ownerSavingsMap) shift(from, to uint32, size uint64) {
+	if from != to {
+		m.get(from).ShiftedOutBytes += size
+		m.get(to).ShiftedInBytes += size
+	}
+}
+
+// sorted returns the OwnerSavings ordered from most saved bytes to least (and
+// by ID as a tie breaker)
+func (m ownerSavingsMap) sorted() []OwnerSavings {
+	s := make([]OwnerSavings, 0, len(m))
+	for _, o := range m {
+		s = append(s, *o)
+	}
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].SavedBytes != s[j].SavedBytes {
+			return s[i].SavedBytes > s[j].SavedBytes
+		}
+		return s[i].ID < s[j].ID
+	})
+	return s
+}
+
+// ownerSavingsTally accumulates the per-uid and per-gid OwnerSavings during
+// the link phase.
+type ownerSavingsTally struct {
+	uids ownerSavingsMap
+	gids ownerSavingsMap
+}
+
+func newOwnerSavingsTally() *ownerSavingsTally {
+	return &ownerSavingsTally{
+		uids: make(ownerSavingsMap),
+		gids: make(ownerSavingsMap),
+	}
+}
+
+// removedInode records the dst inode being removed, after all its paths have
+// been moved to the src inode.
+func (t *ownerSavingsTally) removedInode(src, dst *I.StatInfo) {
+	t.uids.get(dst.Uid).SavedBytes += dst.Size
+	t.gids.get(dst.Gid).SavedBytes += dst.Size
+	t.uids.shift(dst.Uid, src.Uid, dst.Size)
+	t.gids.shift(dst.Gid, src.Gid, dst.Size)
+}
+
+// changedOwner records the src inode ownership being changed to that of the
+// dst inode.
+func (t *ownerSavingsTally) changedOwner(src, dst *I.StatInfo) {
+	t.uids.shift(src.Uid, dst.Uid, src.Size)
+	t.gids.shift(src.Gid, dst.Gid, src.Size)
+}
+
+// OutputOwnerSavings shows in text form the bytes saved and shifted for each
+// uid and gid.
+func (r *Results) OutputOwnerSavings() {
+	if len(r.UIDSavings) == 0 && len(r.GIDSavings) == 0 {
+		return
+	}
+	var saved string
+	if r.Opts.LinkingEnabled {
+		saved = "Saved"
+	} else {
+		saved = "Saveable"
+	}
+	fmt.Println("Savings by owner")
+	fmt.Println("----------------")
+	a := make([][]string, 0)
+	a = statStr(a, "Owner", saved, "Shifted out", "Shifted in")
+	for _, o := range r.UIDSavings {
+		a = statStr(a, "user "+userName(o.ID), Humanize(o.SavedBytes),
+			Humanize(o.ShiftedOutBytes), Humanize(o.ShiftedInBytes))
+	}
+	for _, o := range r.GIDSavings {
+		a = statStr(a, "group "+groupName(o.ID), Humanize(o.SavedBytes),
+			Humanize(o.ShiftedOutBytes), Humanize(o.ShiftedInBytes))
+	}
+	printSlices(a)
+}
+
+// userName returns the name of the given uid if it can be found, and the
+// numeric uid otherwise
+func userName(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+// groupName returns the name of the given gid if it can be found, and the
+// numeric gid otherwise
+func groupName(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
+}
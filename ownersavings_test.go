@@ -0,0 +1,138 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+func TestRunOwnerSavings(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping owner savings test, which requires chown permission")
+	}
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(IgnoreOwner, ReportOwnerSavings)
+
+	name := "testname: 'Owner Savings'"
+
+	m := pathContents{"f1": "XX", "f2": "XX", "f3": "XX"}
+	simpleFileMaker(t, m)
+	simpleLinkMaker(t, "f1", "f4") // f1 inode has higher nlink, so is the src
+	if err := os.Lchown("f2", 1000, 100); err != nil {
+		t.Fatalf("Couldn't chown test file 'f2': %v", err)
+	}
+	result := simpleRun(name, t, opts, 1, ".")
+
+	uid0 := OwnerSavings{ID: 0, SavedBytes: 2, ShiftedInBytes: 2}
+	uid1000 := OwnerSavings{ID: 1000, SavedBytes: 2, ShiftedOutBytes: 2}
+	wantUIDs := []OwnerSavings{uid0, uid1000}
+	if !reflect.DeepEqual(result.UIDSavings, wantUIDs) {
+		t.Errorf("%v: UIDSavings expected: %+v, got: %+v", name, wantUIDs, result.UIDSavings)
+	}
+	gid0 := OwnerSavings{ID: 0, SavedBytes: 2, ShiftedInBytes: 2}
+	gid100 := OwnerSavings{ID: 100, SavedBytes: 2, ShiftedOutBytes: 2}
+	wantGIDs := []OwnerSavings{gid0, gid100}
+	if !reflect.DeepEqual(result.GIDSavings, wantGIDs) {
+		t.Errorf("%v: GIDSavings expected: %+v, got: %+v", name, wantGIDs, result.GIDSavings)
+	}
+}
+
+// TestRunNewestLinkOwner checks that the src inode is given the owner of the
+// newer dst inode, when using the newest link
+func TestRunNewestLinkOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping newest link owner test, which requires chown permission")
+	}
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(IgnoreTime, IgnoreOwner, LinkingEnabled)
+
+	name := "testname: 'Newest Link Owner'"
+
+	m := pathContents{"f1": "XX", "f2": "XX"}
+	simpleFileMaker(t, m)
+	simpleLinkMaker(t, "f1", "f3") // f1 inode has higher nlink, so is the src
+	now := time.Now()
+	then := now.Add(-time.Hour)
+	if err := os.Chtimes("f1", then, then); err != nil {
+		t.Fatalf("Failure to set time on test file 'f1': %v", err)
+	}
+	if err := os.Chtimes("f2", now, now); err != nil {
+		t.Fatalf("Failure to set time on test file 'f2': %v", err)
+	}
+	if err := os.Lchown("f2", 1000, 100); err != nil {
+		t.Fatalf("Couldn't chown test file 'f2': %v", err)
+	}
+	simpleRun(name, t, opts, 1, ".")
+
+	for _, fname := range []string{"f1", "f2", "f3"} {
+		fi, err := os.Lstat(fname)
+		if err != nil {
+			t.Fatalf("%v: Couldn't stat '%v': %v", name, fname, err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Nlink != 3 || st.Uid != 1000 || st.Gid != 100 {
+			t.Errorf("%v: Expected '%v' with nlink 3 and owner 1000:100, got: %v %v:%v",
+				name, fname, st.Nlink, st.Uid, st.Gid)
+		}
+	}
+}
+
+// TestRunNewestLinkOwnerMemFS checks the src inode owner after using the
+// newest link, without needing chown permission
+func TestRunNewestLinkOwnerMemFS(t *testing.T) {
+	now := time.Now()
+	m := policyMemFS(t, map[string]string{"f1": "XX", "f2": "XX"},
+		map[string]time.Time{"f1": now.Add(-time.Hour), "f2": now})
+	// f1 inode has higher nlink, so is the src
+	if err := m.Link("f1", "f3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lchown("f2", 1000, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := SetupOptions(IgnoreTime, IgnoreOwner, LinkingEnabled)
+	opts.FS = m
+	if _, err := Run([]string{"."}, opts); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, fname := range []string{"f1", "f2", "f3"} {
+		fi, err := m.Lstat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _ := vfs.StatOf(fi)
+		if st.Nlink != 3 || st.Uid != 1000 || st.Gid != 100 {
+			t.Errorf("Expected '%v' with nlink 3 and owner 1000:100, got: %v %v:%v",
+				fname, st.Nlink, st.Uid, st.Gid)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+// Plan holds the links found by a Scan, which can be inspected, filtered or
+// reordered, and later performed with Execute.
+type Plan struct {
+	// Groups of inodes (on the same device) that are linked together
+	Groups []LinkGroup `json:"groups"`
+
+	// Results of the Scan, as from a Run without linking
+	Results Results `json:"results"`
+}
+
+// LinkGroup is a set of identical inodes, and the links that consolidate
+// them.
+type LinkGroup struct {
+	Dev uint64 `json:"dev"`
+
+	// Inodes are the stat snapshots (and walked paths) of the group's
+	// inodes, as taken by the Scan
+	Inodes []InodeSnapshot `json:"inodes"`
+
+	// Links are made in order, with each Dst path being replaced by a
+	// link to the inode of its Src path
+	Links []PlannedLink `json:"links"`
+}
+
+// InodeSnapshot is the stat info of an inode when it was scanned
+type InodeSnapshot struct {
+	Ino   uint64      `json:"ino"`
+	Nlink uint64      `json:"nlink"`
+	Size  uint64      `json:"size"`
+	Mode  os.FileMode `json:"mode"`
+	Uid   uint32      `json:"uid"`
+	Gid   uint32      `json:"gid"`
+	Mtime time.Time   `json:"mtime"`
+	Paths []string    `json:"paths"`
+}
+
+// PlannedLink replaces the Dst path with a link to the Src path's inode
+type PlannedLink struct {
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	Size uint64 `json:"size"`
+}
+
+// DriftedLink is a planned link that was skipped by Execute, because the
+// Src or Dst file no longer matched its snapshot
+type DriftedLink struct {
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	Reason string `json:"reason"`
+}
+
+// ExecOptions control how a Plan is executed.  The other Options are those
+// the Plan was scanned with.
+type ExecOptions struct {
+	// IgnoreLinkErrors continues with the remaining links when a link
+	// fails
+	IgnoreLinkErrors bool
+
+	// SkipDrifted skips (and records in the Results) the planned links
+	// whose files no longer match their snapshots, rather than stopping
+	SkipDrifted bool
+
+	// Observer, when not nil, is called with the events of the execution,
+	// and can veto individual links
+	Observer Observer
+}
+
+// Scan walks the dirs and files, and returns the Plan of the links that a Run
+// with the given Options would make (without making them).  LinkingEnabled is
+// ignored.
+func Scan(dirsAndFiles []string, opts Options) (*Plan, error) {
+	return ScanContext(context.Background(), dirsAndFiles, opts)
+}
+
+// ScanContext is like Scan, but stops early when the given context is done
+// (returning the context's error, and a Plan with only the partial Results).
+func ScanContext(ctx context.Context, dirsAndFiles []string, opts Options) (*Plan, error) {
+	opts.LinkingEnabled = false
+	ls := newLinkableState(&opts)
+	ls.ctx = ctx
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Plan{}
+	ls.plan = p
+	if err := runHelper(dirsAndFiles, ls); err != nil {
+		// The groups found before stopping are incomplete
+		return &Plan{Results: *ls.Results}, err
+	}
+	p.Results = *ls.Results
+
+	// Groups can end up with no links (ie. when vetoed)
+	groups := p.Groups[:0]
+	for _, g := range p.Groups {
+		if len(g.Links) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	p.Groups = groups
+	return p, nil
+}
+
+// WritePlanFile saves the Plan as JSON, to be loaded with LoadPlanFile
+func (p *Plan) WritePlanFile(pathname string) error {
+	dir, base := filepath.Split(pathname)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+	defer os.Remove(tmpname) // Fails harmlessly after the rename
+
+	if err = json.NewEncoder(f).Encode(p); err != nil {
+		f.Close()
+		return err
+	}
+	// TempFile creates the file readable only by the owner
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
+
+// ReadPlanJSON reads a Plan from JSON, as written by WritePlanFile
+func ReadPlanJSON(r io.Reader) (*Plan, error) {
+	var p Plan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// LoadPlanFile reads a Plan from a JSON file, as written by WritePlanFile
+func LoadPlanFile(pathname string) (*Plan, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := ReadPlanJSON(f)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read Plan from %v: %v", pathname, err)
+	}
+	return p, nil
+}
+
+// addGroup starts a new group, with snapshots of the given inodes
+func (p *Plan) addGroup(f *fsDev, inos []I.Ino) {
+	g := LinkGroup{Dev: f.Dev}
+	for _, ino := range inos {
+		si := f.inoStatInfo[ino]
+		snap := InodeSnapshot{
+			Ino:   uint64(ino),
+			Nlink: si.Nlink,
+			Size:  si.Size,
+			Mode:  si.Mode,
+			Uid:   si.Uid,
+			Gid:   si.Gid,
+			Mtime: si.Mtim,
+		}
+		for _, ps := range f.InoPaths[ino].PathsAsSlice() {
+			snap.Paths = append(snap.Paths, ps.Join())
+		}
+		g.Inodes = append(g.Inodes, snap)
+	}
+	p.Groups = append(p.Groups, g)
+}
+
+// addLink adds a link to the current group
+func (p *Plan) addLink(srcPath, dstPath P.Pathsplit, size uint64) {
+	g := &p.Groups[len(p.Groups)-1]
+	g.Links = append(g.Links, PlannedLink{Src: srcPath.Join(), Dst: dstPath.Join(), Size: size})
+}
+
+func (s *InodeSnapshot) statInfo() I.StatInfo {
+	return I.StatInfo{
+		Size:  s.Size,
+		Ino:   I.Ino(s.Ino),
+		Nlink: s.Nlink,
+		Uid:   s.Uid,
+		Gid:   s.Gid,
+		Mode:  s.Mode,
+		Mtim:  s.Mtime,
+	}
+}
+
+// Execute makes the links of the Plan, in order.  Before each link, the src
+// and dst files are checked against their snapshots (as updated by the
+// previous links), and execution stops with an error if either was modified
+// (unless ExecOptions.SkipDrifted is set).  No links other than those of the
+// Plan are made.  The returned Results are those of the linking.
+func (p *Plan) Execute(ctx context.Context, eo ExecOptions) (Results, error) {
+	opts := p.Results.Opts
+	opts.LinkingEnabled = true
+	opts.IgnoreLinkErrors = eo.IgnoreLinkErrors
+	opts.Observer = eo.Observer
+	opts.StateFile, opts.CheckpointFile, opts.SQLiteFile = "", "", ""
+	opts.Resume = false
+
+	ls := newLinkableState(&opts)
+	ls.ctx = ctx
+	if err := opts.Validate(); err != nil {
+		return *ls.Results, err
+	}
+	err := ls.execute(p, eo.SkipDrifted)
+	return *ls.Results, err
+}
+
+func (ls *linkableState) execute(p *Plan, skipDrifted bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Execute stopped early: %v ", r)
+		}
+	}()
+
+	ls.Results.setRoots(p.Results.Roots, nil)
+	ls.Results.start()
+	defer ls.Results.end()
+
+	ls.setPhase(LinkPhase)
+	for i := range p.Groups {
+		g := &p.Groups[i]
+		fsdev, ok := ls.fsDevs[g.Dev]
+		if !ok {
+			fsdev = newFSDev(ls.status, g.Dev, 0)
+			ls.fsDevs[g.Dev] = fsdev
+			ls.Results.foundDevice(g.Dev)
+		}
+		if err := fsdev.executeGroup(g, skipDrifted); err != nil {
+			return err
+		}
+	}
+	ls.Results.runCompletedSuccessfully()
+	ls.observer.PhaseChanged(EndPhase)
+	return nil
+}
+
+// executeGroup indexes the group's inode snapshots, and makes its links
+func (f *fsDev) executeGroup(g *LinkGroup, skipDrifted bool) error {
+	pathInos := make(map[string]I.Ino)
+	for i := range g.Inodes {
+		si := g.Inodes[i].statInfo()
+		f.inoStatInfo[si.Ino] = &si
+		f.Results.foundInode(f.Dev, si.Nlink)
+		for _, pathname := range g.Inodes[i].Paths {
+			f.Results.foundFile()
+			f.InoPaths.AppendPath(si.Ino, P.Split(pathname, f.pool))
+			pathInos[pathname] = si.Ino
+		}
+	}
+
+	for _, l := range g.Links {
+		if err := f.ctx.Err(); err != nil {
+			return err
+		}
+		srcIno, srcOK := pathInos[l.Src]
+		dstIno, dstOK := pathInos[l.Dst]
+		if !srcOK || !dstOK {
+			return fmt.Errorf("Planned link of %v to %v isn't between paths of its group", l.Dst, l.Src)
+		}
+		if srcIno == dstIno {
+			return fmt.Errorf("Planned link of %v to %v is already linked", l.Dst, l.Src)
+		}
+		srcSI, dstSI := f.inoStatInfo[srcIno], f.inoStatInfo[dstIno]
+		if srcSI == nil || dstSI == nil {
+			return fmt.Errorf("Planned link of %v to %v is to an inode removed by an earlier link", l.Dst, l.Src)
+		}
+		srcPath, dstPath := P.Split(l.Src, f.pool), P.Split(l.Dst, f.pool)
+		if skipDrifted {
+			reason := f.driftReason(srcPath, dstPath, srcSI, dstSI)
+			if reason != "" {
+				f.Results.driftedLink(l.Src, l.Dst, reason)
+				continue
+			}
+		}
+		if err := f.linkPaths(srcPath, dstPath, srcSI, dstSI); err != nil {
+			return err
+		}
+		if f.InoPaths.HasPath(srcIno, dstPath) {
+			pathInos[l.Dst] = srcIno
+		}
+	}
+	return nil
+}
+
+// driftReason describes how the src or dst file differs from its snapshot, or
+// returns "" if neither does
+func (f *fsDev) driftReason(srcPath, dstPath P.Pathsplit, srcSI, dstSI *I.StatInfo) string {
+	src := I.PathInfo{Pathsplit: srcPath, StatInfo: *srcSI}
+	if reason := modifiedReason(f.fsys, src, f.Dev); reason != "" {
+		return "src " + reason
+	}
+	dst := I.PathInfo{Pathsplit: dstPath, StatInfo: *dstSI}
+	if reason := modifiedReason(f.fsys, dst, f.Dev); reason != "" {
+		return "dst " + reason
+	}
+	return ""
+}
@@ -0,0 +1,278 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// planMemFS has two groups of identical files, one of which has an existing
+// link
+func planMemFS(t *testing.T) *vfs.MemFS {
+	files := map[string]string{
+		"a/f1": "group 1",
+		"b/f1": "group 1",
+		"c/f1": "group 1",
+		"a/f2": "group 2",
+		"b/f2": "group 2",
+		"c/f3": "unique",
+	}
+	m := policyMemFS(t, files, nil)
+	if err := m.MkdirAll("d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Link("a/f1", "d/f1"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// planGroup returns the index of the group with the given path
+func planGroup(plan *Plan, pathname string) int {
+	for i, g := range plan.Groups {
+		for _, ino := range g.Inodes {
+			for _, p := range ino.Paths {
+				if p == pathname {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func TestScanExecute(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	plan, err := Scan([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if memIno(t, m, "a/f1") == memIno(t, m, "b/f1") {
+		t.Fatalf("Scan linked files")
+	}
+
+	var numLinks int64
+	for _, g := range plan.Groups {
+		numLinks += int64(len(g.Links))
+	}
+	if len(plan.Groups) != 2 || numLinks != 3 || plan.Results.NewLinkCount != numLinks {
+		t.Fatalf("Expected 2 groups with 3 links, got %v groups with %v links (results %v)",
+			len(plan.Groups), numLinks, plan.Results.NewLinkCount)
+	}
+	// The inode with existing links is the src of its group
+	g := plan.Groups[planGroup(plan, "a/f1")]
+	if len(g.Inodes) != 3 || g.Inodes[0].Nlink != 2 || len(g.Inodes[0].Paths) != 2 {
+		t.Errorf("Unexpected group snapshot: %+v", g.Inodes)
+	}
+
+	r, err := plan.Execute(context.Background(), ExecOptions{})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if !r.RunSuccessful || r.NewLinkCount != 3 || r.InodeRemovedCount != 3 {
+		t.Errorf("Expected 3 new links and removed inodes, got %v and %v", r.NewLinkCount, r.InodeRemovedCount)
+	}
+	for _, pathname := range []string{"b/f1", "c/f1", "d/f1"} {
+		if memIno(t, m, pathname) != memIno(t, m, "a/f1") {
+			t.Errorf("%v wasn't linked", pathname)
+		}
+	}
+	if memIno(t, m, "a/f2") != memIno(t, m, "b/f2") {
+		t.Errorf("a/f2 wasn't linked")
+	}
+}
+
+func TestScanCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := SetupOptions()
+	opts.FS = planMemFS(t)
+	opts.Observer = cancelObserver{dir: "b", cancel: cancel}
+	plan, err := ScanContext(ctx, []string{"."}, opts)
+	if err != context.Canceled || plan == nil {
+		t.Fatalf("Expected a cancelled Scan with a Plan, got %v %v", plan, err)
+	}
+	if plan.Results.Phase != WalkPhase || plan.Results.FileCount == 0 || len(plan.Groups) != 0 {
+		t.Errorf("Expected the partial Results of the walk, and no groups, got phase %v with %v files and %v groups",
+			plan.Results.Phase, plan.Results.FileCount, len(plan.Groups))
+	}
+}
+
+func TestExecuteFiltered(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	plan, err := Scan([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	// Only the second group, with its links saved and restored as JSON
+	i := planGroup(plan, "a/f2")
+	plan.Groups = plan.Groups[i : i+1]
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Plan
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Results.Opts.FS = m // Not included in the JSON
+
+	r, err := loaded.Execute(context.Background(), ExecOptions{})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if r.NewLinkCount != 1 || memIno(t, m, "a/f2") != memIno(t, m, "b/f2") {
+		t.Errorf("Expected the filtered link, got %v links", r.NewLinkCount)
+	}
+	if memIno(t, m, "a/f1") == memIno(t, m, "b/f1") {
+		t.Errorf("Link removed from the plan was made")
+	}
+}
+
+func TestExecuteModified(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	plan, err := Scan([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	// Modified after the scan, so the plan stops before linking it
+	lastGroup := plan.Groups[len(plan.Groups)-1]
+	last := lastGroup.Links[0]
+	expected := plan.Results.NewLinkCount - int64(len(lastGroup.Links))
+	if err := m.Chtimes(last.Dst, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := plan.Execute(context.Background(), ExecOptions{})
+	if err == nil || r.RunSuccessful {
+		t.Fatalf("Expected Execute to fail on a modified file")
+	}
+	if r.NewLinkCount != expected || memIno(t, m, last.Dst) == memIno(t, m, last.Src) {
+		t.Errorf("Expected only the links before the modified file, got %v", r.NewLinkCount)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := plan.Execute(ctx, ExecOptions{}); err != context.Canceled {
+		t.Errorf("Expected a cancelled Execute, got %v", err)
+	}
+}
+
+func TestExecuteSkipDrifted(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	plan, err := Scan([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "hardlinkable-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pathname := filepath.Join(dir, "plan.json")
+	if err := plan.WritePlanFile(pathname); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPlanFile(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.Results.Opts.FS = m
+
+	// The second group's dst is modified, and its link skipped
+	drifted := loaded.Groups[planGroup(loaded, "a/f2")].Links[0]
+	if err := m.Chtimes(drifted.Dst, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := loaded.Execute(context.Background(), ExecOptions{SkipDrifted: true})
+	if err != nil || !r.RunSuccessful {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if r.DriftedLinkCount != 1 || len(r.DriftedLinks) != 1 {
+		t.Fatalf("Expected 1 drifted link, got %v", r.DriftedLinks)
+	}
+	if d := r.DriftedLinks[0]; d.Dst != drifted.Dst || d.Reason != "dst mtime changed" {
+		t.Errorf("Unexpected drifted link: %+v", d)
+	}
+	if r.NewLinkCount != plan.Results.NewLinkCount-1 {
+		t.Errorf("Expected the other links to be made, got %v", r.NewLinkCount)
+	}
+	if memIno(t, m, "a/f1") != memIno(t, m, "b/f1") ||
+		memIno(t, m, "a/f1") != memIno(t, m, "c/f1") {
+		t.Errorf("Unmodified group wasn't linked")
+	}
+	if memIno(t, m, "a/f2") == memIno(t, m, "b/f2") {
+		t.Errorf("Drifted link was made")
+	}
+}
+
+func TestModifiedReason(t *testing.T) {
+	m := planMemFS(t)
+	pi := func(pathname string) I.PathInfo {
+		dsi, err := I.LStatInfo(m, pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return I.PathInfo{Pathsplit: P.Split(pathname, nil), StatInfo: dsi.StatInfo}
+	}
+	dsi, _ := I.LStatInfo(m, "a/f2")
+
+	p := pi("a/f2")
+	if reason := modifiedReason(m, p, dsi.Dev); reason != "" {
+		t.Errorf("Unexpected reason for an unmodified file: %v", reason)
+	}
+	if err := m.WriteFile("a/f2", []byte("group 2 grown"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if reason := modifiedReason(m, p, dsi.Dev); reason != "size changed" {
+		t.Errorf("Expected a size change, got %q", reason)
+	}
+	if err := m.Remove("a/f2"); err != nil {
+		t.Fatal(err)
+	}
+	if reason := modifiedReason(m, p, dsi.Dev); reason != "file removed" {
+		t.Errorf("Expected a removed file, got %q", reason)
+	}
+	p = pi("b/f2")
+	p.Ino++
+	if reason := modifiedReason(m, p, dsi.Dev); reason != "inode changed" {
+		t.Errorf("Expected an inode change, got %q", reason)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+// PolicyRule overrides the matching Options for the paths it matches.  The
+// fields that aren't set keep the value from the Options (or from an earlier
+// matching rule, since later rules override earlier ones).
+type PolicyRule struct {
+	// Path is either a path prefix, matching the path and all the paths
+	// below it, or a glob pattern (with '*', '?' or '[') matching the
+	// paths or any of their parent dirs.  A glob without a path separator
+	// is matched against the base names.  Relative paths are relative to
+	// the current dir.
+	Path string `json:"path"`
+
+	// ContentOnly sets all the Ignore options (before the individual
+	// Ignore fields are applied)
+	ContentOnly bool `json:"contentOnly,omitempty"`
+
+	SameName    *bool   `json:"sameName,omitempty"`
+	IgnoreTime  *bool   `json:"ignoreTime,omitempty"`
+	IgnorePerm  *bool   `json:"ignorePerm,omitempty"`
+	IgnoreOwner *bool   `json:"ignoreOwner,omitempty"`
+	IgnoreXAttr *bool   `json:"ignoreXAttr,omitempty"`
+	MinFileSize *uint64 `json:"minFileSize,omitempty"`
+	MaxFileSize *uint64 `json:"maxFileSize,omitempty"`
+
+	// Exclude skips the matching dirs and files (including dirs given
+	// explicitly), so they are never read or linked
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// policyFile is the format of a policy file
+type policyFile struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// LoadPolicyFile reads the PolicyRules from a JSON file, of the form:
+//
+//	{"rules": [
+//	    {"path": "/home", "sameName": true, "ignoreOwner": false},
+//	    {"path": "/srv/mirror", "contentOnly": true},
+//	    {"path": "/srv/db", "exclude": true}
+//	]}
+func LoadPolicyFile(pathname string) ([]PolicyRule, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pf policyFile
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pf); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %v: %v", pathname, err)
+	}
+	for i := range pf.Rules {
+		if err := pf.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("Invalid policy file %v: rule %d: %v", pathname, i+1, err)
+		}
+	}
+	return pf.Rules, nil
+}
+
+func (r *PolicyRule) validate() error {
+	if r.Path == "" {
+		return fmt.Errorf("empty Path")
+	}
+	if r.isGlob() {
+		if _, err := filepath.Match(r.Path, ""); err != nil {
+			return fmt.Errorf("bad Path pattern %q: %v", r.Path, err)
+		}
+	}
+	if r.MinFileSize != nil && r.MaxFileSize != nil &&
+		*r.MaxFileSize > 0 && *r.MaxFileSize < *r.MinFileSize {
+		return fmt.Errorf("MinFileSize (%v) cannot be larger than MaxFileSize (%v)",
+			*r.MinFileSize, *r.MaxFileSize)
+	}
+	return nil
+}
+
+func (r *PolicyRule) isGlob() bool {
+	return strings.ContainsAny(r.Path, "*?[")
+}
+
+// pathPolicy holds the matching options in effect for a path
+type pathPolicy struct {
+	sameName    bool
+	ignoreTime  bool
+	ignorePerm  bool
+	ignoreOwner bool
+	ignoreXAttr bool
+	minFileSize uint64
+	maxFileSize uint64
+	exclude     bool
+}
+
+// and returns the policy for linking two paths, which only ignores the inode
+// differences that both paths' policies ignore
+func (p pathPolicy) and(q pathPolicy) pathPolicy {
+	p.sameName = p.sameName || q.sameName
+	p.ignoreTime = p.ignoreTime && q.ignoreTime
+	p.ignorePerm = p.ignorePerm && q.ignorePerm
+	p.ignoreOwner = p.ignoreOwner && q.ignoreOwner
+	p.ignoreXAttr = p.ignoreXAttr && q.ignoreXAttr
+	return p
+}
+
+// apply overrides the policy with the fields set in the rule
+func (p *pathPolicy) apply(r *PolicyRule) {
+	if r.ContentOnly {
+		p.ignoreTime, p.ignorePerm, p.ignoreOwner, p.ignoreXAttr = true, true, true, true
+	}
+	setBool := func(dst *bool, src *bool) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setBool(&p.sameName, r.SameName)
+	setBool(&p.ignoreTime, r.IgnoreTime)
+	setBool(&p.ignorePerm, r.IgnorePerm)
+	setBool(&p.ignoreOwner, r.IgnoreOwner)
+	setBool(&p.ignoreXAttr, r.IgnoreXAttr)
+	if r.MinFileSize != nil {
+		p.minFileSize = *r.MinFileSize
+	}
+	if r.MaxFileSize != nil {
+		p.maxFileSize = *r.MaxFileSize
+	}
+	if r.Exclude {
+		p.exclude = true
+	}
+}
+
+// policy finds the pathPolicy of paths from the Options and PolicyRules.  It
+// isn't changed after it is made, so can be used by the walk goroutine.
+type policy struct {
+	base  pathPolicy
+	rules []PolicyRule // With absolute (non base name) Paths
+	cwd   string
+
+	// The inode hash ignores the inode params that any rule ignores, so
+	// that files linkable under a rule are in the same hash
+	hash pathPolicy
+}
+
+func newPolicy(o *Options) *policy {
+	p := &policy{
+		base: pathPolicy{
+			sameName:    o.SameName,
+			ignoreTime:  o.IgnoreTime,
+			ignorePerm:  o.IgnorePerm,
+			ignoreOwner: o.IgnoreOwner,
+			ignoreXAttr: o.IgnoreXAttr,
+			minFileSize: o.MinFileSize,
+			maxFileSize: o.MaxFileSize,
+		},
+	}
+	p.hash = p.base
+	if len(o.PolicyRules) == 0 {
+		return p
+	}
+	p.cwd, _ = os.Getwd()
+	for _, r := range o.PolicyRules {
+		if r.isGlob() && !strings.ContainsRune(r.Path, filepath.Separator) {
+			// Matched against base names
+		} else {
+			r.Path = p.abs(r.Path)
+		}
+		p.rules = append(p.rules, r)
+
+		var q pathPolicy
+		q.apply(&r)
+		p.hash.ignoreTime = p.hash.ignoreTime || q.ignoreTime
+		p.hash.ignorePerm = p.hash.ignorePerm || q.ignorePerm
+		p.hash.ignoreOwner = p.hash.ignoreOwner || q.ignoreOwner
+	}
+	return p
+}
+
+func (p *policy) abs(pathname string) string {
+	if filepath.IsAbs(pathname) {
+		return filepath.Clean(pathname)
+	}
+	return filepath.Join(p.cwd, pathname)
+}
+
+// hasRules returns true if the paths can have differing policies
+func (p *policy) hasRules() bool {
+	return len(p.rules) > 0
+}
+
+// forPath returns the policy for the given pathname
+func (p *policy) forPath(pathname string) pathPolicy {
+	pp := p.base
+	if !p.hasRules() {
+		return pp
+	}
+	abs := p.abs(pathname)
+	for i := range p.rules {
+		if p.rules[i].matches(abs) {
+			pp.apply(&p.rules[i])
+		}
+	}
+	return pp
+}
+
+// forPair returns the policy for linking the two paths
+func (p *policy) forPair(ps1, ps2 P.Pathsplit) pathPolicy {
+	if !p.hasRules() {
+		return p.base
+	}
+	return p.forPath(ps1.Join()).and(p.forPath(ps2.Join()))
+}
+
+// excluded returns true if the path is excluded by a rule
+func (p *policy) excluded(pathname string) bool {
+	return p.hasRules() && p.forPath(pathname).exclude
+}
+
+// matches returns true if the rule applies to the absolute pathname
+func (r *PolicyRule) matches(abs string) bool {
+	if !r.isGlob() {
+		return abs == r.Path || r.Path == string(filepath.Separator) ||
+			strings.HasPrefix(abs, r.Path+string(filepath.Separator))
+	}
+	baseName := !strings.ContainsRune(r.Path, filepath.Separator)
+	for p := abs; ; p = filepath.Dir(p) {
+		name := p
+		if baseName {
+			name = filepath.Base(p)
+		}
+		if ok, _ := filepath.Match(r.Path, name); ok {
+			return true
+		}
+		if parent := filepath.Dir(p); parent == p {
+			return false
+		}
+	}
+}
+
+// linkPolicies caches, for the link phase of a link group, the combined policy
+// of all the paths of each inode, and the xattr comparisons of the inodes, so
+// they aren't found again for each path that is linked.
+type linkPolicies struct {
+	inos   map[I.Ino]pathPolicy
+	xattrs map[[2]I.Ino]bool
+}
+
+func newLinkPolicies() *linkPolicies {
+	return &linkPolicies{
+		inos:   make(map[I.Ino]pathPolicy),
+		xattrs: make(map[[2]I.Ino]bool),
+	}
+}
+
+// inoPolicy returns the policy that all the paths of the inode allow, and
+// false if the inode has no paths
+func (f *fsDev) inoPolicy(lp *linkPolicies, ino I.Ino) (pathPolicy, bool) {
+	if pp, ok := lp.inos[ino]; ok {
+		return pp, true
+	}
+	fp, ok := f.InoPaths[ino]
+	if !ok || fp.IsEmpty() {
+		return pathPolicy{}, false
+	}
+	paths := fp.PathsAsSlice()
+	pp := f.policy.forPath(paths[0].Join())
+	for _, ps := range paths[1:] {
+		pp = pp.and(f.policy.forPath(ps.Join()))
+	}
+	lp.inos[ino] = pp
+	return pp, true
+}
+
+// movedPath updates the cached policies after dstPath was moved from the dst
+// inode to the src inode (by linking it)
+func (f *fsDev) movedPath(lp *linkPolicies, dstPath P.Pathsplit, srcIno, dstIno I.Ino) {
+	if pp, ok := lp.inos[srcIno]; ok {
+		lp.inos[srcIno] = pp.and(f.policy.forPath(dstPath.Join()))
+	}
+	delete(lp.inos, dstIno) // Found again (without the path) if needed
+}
+
+// policyAllowsLink returns true if the policies of the src and dst paths
+// allow linking them (which the link groups found by the walk don't ensure,
+// since the policies of their paths can differ).  The inode params are
+// checked with the policies of all the src inode's paths, since they all
+// share the linked inode.
+func (f *fsDev) policyAllowsLink(lp *linkPolicies, src, dst I.PathInfo) bool {
+	pp := f.policy.forPair(src.Pathsplit, dst.Pathsplit)
+	if pp.sameName && src.Filename != dst.Filename {
+		return false
+	}
+	if inoPP, ok := f.inoPolicy(lp, src.Ino); ok {
+		pp = pp.and(inoPP)
+	}
+	if !pp.ignoreTime && !src.EqualTime(dst) {
+		return false
+	}
+	if !pp.ignorePerm && !src.EqualMode(dst) {
+		return false
+	}
+	if !pp.ignoreOwner && !src.EqualOwnership(dst) {
+		return false
+	}
+	if !pp.ignoreXAttr {
+		key := [2]I.Ino{src.Ino, dst.Ino}
+		eq, ok := lp.xattrs[key]
+		if !ok {
+			eq, _ = I.EqualXAttrs(f.fsys, src.Join(), dst.Join())
+			lp.xattrs[key] = eq
+		}
+		if !eq {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+// policyMemFS writes the files, with their content and mtimes
+func policyMemFS(t *testing.T, files map[string]string, mtimes map[string]time.Time) *vfs.MemFS {
+	m := vfs.NewMemFS()
+	now := time.Now().Add(-time.Hour)
+	for pathname, content := range files {
+		if err := m.WriteFile(pathname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime, ok := mtimes[pathname]
+		if !ok {
+			mtime = now
+		}
+		if err := m.Chtimes(pathname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestRunPolicy(t *testing.T) {
+	older := time.Now().Add(-2 * time.Hour)
+	files := map[string]string{
+		"home/a/same":   "home",
+		"home/b/same":   "home",
+		"home/a/name1":  "name",
+		"home/b/name2":  "name",
+		"home/a/pkg":    "pkg",
+		"mirror/x/pkg":  "pkg",
+		"mirror/y/pkg":  "pkg",
+		"mirror/old":    "old",
+		"mirror/new":    "old",
+		"mirror/t.tmp":  "old",
+		"mirror/small":  "s",
+		"mirror/small2": "s",
+		"db/pkg":        "pkg",
+		"db/old":        "old",
+	}
+	mtimes := map[string]time.Time{
+		"home/a/pkg":   older.Add(-time.Hour),
+		"mirror/y/pkg": older,
+		"mirror/old":   older,
+	}
+	m := policyMemFS(t, files, mtimes)
+	minSize := uint64(2)
+
+	opts := SetupOptions(LinkingEnabled, Policy(
+		PolicyRule{Path: "home", SameName: boolPtr(true)},
+		PolicyRule{Path: "mirror", ContentOnly: true, MinFileSize: &minSize},
+		PolicyRule{Path: "db", Exclude: true},
+		PolicyRule{Path: "*.tmp", Exclude: true},
+	))
+	opts.FS = m
+	r, err := Run([]string{"home", "mirror", "db"}, opts)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	linked := func(p1, p2 string) bool { return memIno(t, m, p1) == memIno(t, m, p2) }
+	tests := []struct {
+		p1, p2 string
+		linked bool
+	}{
+		{"home/a/same", "home/b/same", true},
+		{"home/a/name1", "home/b/name2", false}, // SameName
+		{"mirror/x/pkg", "mirror/y/pkg", true},  // Content only
+		{"mirror/old", "mirror/new", true},
+		{"home/a/pkg", "mirror/x/pkg", false}, // Time must match for home
+		{"home/a/pkg", "mirror/y/pkg", false},
+		{"mirror/new", "mirror/t.tmp", false}, // Excluded by glob
+		{"mirror/small", "mirror/small2", false},
+		{"mirror/x/pkg", "db/pkg", false}, // Excluded
+		{"mirror/old", "db/old", false},
+	}
+	for _, tc := range tests {
+		if linked(tc.p1, tc.p2) != tc.linked {
+			t.Errorf("Expected %v and %v linked: %v", tc.p1, tc.p2, tc.linked)
+		}
+	}
+	if r.ExcludedDirCount != 1 || r.ExcludedFileCount != 1 {
+		t.Errorf("Expected 1 excluded dir and file, got %v and %v",
+			r.ExcludedDirCount, r.ExcludedFileCount)
+	}
+}
+
+// TestRunPolicyLinkGroup checks that a file isn't linked to an inode that
+// also has a path whose policy doesn't allow it
+func TestRunPolicyLinkGroup(t *testing.T) {
+	older := time.Now().Add(-2 * time.Hour)
+	files := map[string]string{
+		"home/q":     "q",
+		"mirror/r/q": "q",
+	}
+	m := policyMemFS(t, files, map[string]time.Time{"mirror/r/q": older})
+	if err := m.Link("home/q", "mirror/q"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := SetupOptions(LinkingEnabled, Policy(PolicyRule{Path: "mirror", IgnoreTime: boolPtr(true)}))
+	opts.FS = m
+	r, err := Run([]string{"mirror", "home"}, opts)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if memIno(t, m, "mirror/q") == memIno(t, m, "mirror/r/q") || r.NewLinkCount != 0 {
+		t.Errorf("File linked to an inode with a home path, despite the home policy")
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	topdir := setUp("Policy", t)
+	defer os.RemoveAll(topdir)
+
+	policy := `{"rules": [
+		{"path": "/home", "sameName": true, "ignoreOwner": false},
+		{"path": "/srv/mirror", "contentOnly": true, "minFileSize": 4096},
+		{"path": "/srv/db", "exclude": true}
+	]}`
+	if err := ioutil.WriteFile("policy.json", []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadPolicyFile("policy.json")
+	if err != nil {
+		t.Fatalf("Couldn't load policy file: %v", err)
+	}
+	if len(rules) != 3 || !*rules[0].SameName || *rules[0].IgnoreOwner ||
+		rules[1].SameName != nil || !rules[1].ContentOnly || *rules[1].MinFileSize != 4096 ||
+		!rules[2].Exclude {
+		t.Errorf("Policy file rules weren't loaded: %+v", rules)
+	}
+
+	invalid := []string{
+		`{"rules": [{"path": "/home", "sameNam": true}]}`,
+		`{"rules": [{"sameName": true}]}`,
+		`{"rules": [{"path": "/home/[a"}]}`,
+		`{"rules": [{"path": "/home", "minFileSize": 10, "maxFileSize": 5}]}`,
+	}
+	for _, s := range invalid {
+		if err := ioutil.WriteFile("policy.json", []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicyFile("policy.json"); err == nil {
+			t.Errorf("Expected an error loading policy: %v", s)
+		}
+	}
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule, path string
+		matches    bool
+	}{
+		{"/srv/db", "/srv/db", true},
+		{"/srv/db", "/srv/db/x/y", true},
+		{"/srv/db", "/srv/dbx", false},
+		{"/", "/srv", true},
+		{"/home/*/cache", "/home/u/cache/f", true},
+		{"/home/*/cache", "/home/u/other/f", false},
+		{"*.iso", "/srv/a.iso", true},
+		{"*.iso", "/srv/a.iso.txt", false},
+		{".git", "/srv/.git/config", false}, // Not a glob, so a prefix
+		{"[.]git", "/srv/.git/config", true},
+	}
+	for _, tc := range tests {
+		r := PolicyRule{Path: tc.rule}
+		if r.matches(tc.path) != tc.matches {
+			t.Errorf("Expected %q matching %q: %v", tc.rule, tc.path, tc.matches)
+		}
+	}
+}
+
+// xattrCountFS counts the ListXattr calls of a MemFS
+type xattrCountFS struct {
+	*vfs.MemFS
+	listXattrs int
+}
+
+func (c *xattrCountFS) ListXattr(pathname string) ([]string, error) {
+	c.listXattrs++
+	return c.MemFS.ListXattr(pathname)
+}
+
+// TestRunPolicyCached checks that the policy and xattrs of an inode aren't
+// found again for each of the paths linked to it
+func TestRunPolicyCached(t *testing.T) {
+	// The src inode (with the most links) has a path more than the dst
+	files := map[string]string{"mirror/src": "X", "mirror/dst": "X"}
+	m := policyMemFS(t, files, nil)
+	const numLinks = 20
+	for i := 0; i < numLinks; i++ {
+		if err := m.Link("mirror/src", fmt.Sprintf("mirror/src%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if err := m.Link("mirror/dst", fmt.Sprintf("mirror/dst%02d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fsys := &xattrCountFS{MemFS: m}
+
+	opts := SetupOptions(LinkingEnabled, Policy(PolicyRule{Path: "mirror", IgnoreTime: boolPtr(true)}))
+	opts.FS = fsys
+	r, err := Run([]string{"mirror"}, opts)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if r.NewLinkCount != numLinks {
+		t.Errorf("Expected %v new links, got: %v", numLinks, r.NewLinkCount)
+	}
+
+	// The walk lists the xattrs of both files twice (when comparing them,
+	// and for the mismatch stats), and the link phase only once for all
+	// the dst inode's paths
+	if fsys.listXattrs != 6 {
+		t.Errorf("Expected 6 xattr lists, got: %v", fsys.listXattrs)
+	}
+}
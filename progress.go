@@ -30,14 +30,11 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-type progress interface {
-	Show()
-	Clear()
-	Done()
-}
-
-// A simple progress meter while scanning directories and performing linking
+// A simple progress meter while scanning directories and performing linking,
+// which is updated by the Observer events
 type ttyProgress struct {
+	NopObserver
+
 	lastLineLen    int
 	lastFPSTime    time.Time
 	updateDelay    time.Duration
@@ -55,8 +52,6 @@ type ttyProgress struct {
 	m runtime.MemStats
 }
 
-type disabledProgress struct{}
-
 // Initialize TTYProgress and return pointer to it
 func newTTYProgress(results *Results, options *Options) *ttyProgress {
 	if options.LinkingEnabled {
@@ -180,6 +175,18 @@ func (p *ttyProgress) line(s string) {
 	p.lastLineLen = thisLen
 }
 
-func (p *disabledProgress) Show()  {}
-func (p *disabledProgress) Clear() {}
-func (p *disabledProgress) Done()  {}
+// DirEntered updates the progress line during the walk
+func (p *ttyProgress) DirEntered(pathname string) { p.Show() }
+
+// FileAccepted updates the progress line during the walk
+func (p *ttyProgress) FileAccepted(pathname string, size uint64) { p.Show() }
+
+// FileRejected updates the progress line during the walk
+func (p *ttyProgress) FileRejected(pathname string, reason string) { p.Show() }
+
+// PhaseChanged erases the progress line when the walk is over
+func (p *ttyProgress) PhaseChanged(phase RunPhases) {
+	if phase != WalkPhase {
+		p.Clear()
+	}
+}
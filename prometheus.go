@@ -0,0 +1,204 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// phaseSecondsBuckets are the upper bounds of the phase duration histogram
+// buckets, in seconds
+var phaseSecondsBuckets = []float64{0.1, 1, 10, 60, 300, 1800, 3600, 14400}
+
+const metricPrefix = "hardlinkable_"
+
+// WritePrometheusFile atomically writes the Results in the Prometheus text
+// exposition format (ie. for the node_exporter textfile collector).  The
+// metrics are written to a temporary file in the same directory, which is
+// then renamed to pathname.
+func (r *Results) WritePrometheusFile(pathname string) error {
+	dir, base := filepath.Split(pathname)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+	defer os.Remove(tmpname) // Fails harmlessly after the rename
+
+	if err = r.WritePrometheus(f); err != nil {
+		f.Close()
+		return err
+	}
+	// TempFile creates the file readable only by the owner
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
+
+// WritePrometheus outputs the Results in the Prometheus text exposition format.
+// The counts of the run are counters, and its byte amounts and status are
+// gauges.  Every series has the run's roots (comma separated, when there are
+// several) as its "root" label, so that the files of runs with different
+// roots can be collected together.  The counts and byte amounts of each
+// device are also output, with a "device" label.
+func (r *Results) WritePrometheus(w io.Writer) error {
+	var b bytes.Buffer
+
+	runLabels := fmt.Sprintf(`root="%s"`, escapeLabel(strings.Join(r.Roots, ",")))
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n", metricPrefix, name, help)
+		fmt.Fprintf(&b, "# TYPE %s%s %s\n", metricPrefix, name, typ)
+	}
+	metric := func(name, typ, help string, v interface{}) {
+		header(name, typ, help)
+		fmt.Fprintf(&b, "%s%s{%s} %v\n", metricPrefix, name, runLabels, v)
+	}
+	counter := func(name, help string, v interface{}) { metric(name, "counter", help, v) }
+	gauge := func(name, help string, v interface{}) { metric(name, "gauge", help, v) }
+
+	counter("dirs_total", "Directories walked.", r.DirCount)
+	counter("files_total", "Files found (not counting excluded files).", r.FileCount)
+	counter("comparisons_total", "File content comparisons.", r.ComparisonCount)
+	counter("compared_bytes_total", "Bytes read during file content comparisons.", r.BytesCompared)
+	counter("inodes_total", "Inodes found.", r.InodeCount)
+	counter("new_links_total", "New links made (or that would be made).", r.NewLinkCount)
+	counter("removed_inodes_total", "Inodes removed (or that would be removed) by linking.", r.InodeRemovedCount)
+	counter("errors_total", "Errors encountered.", int64(len(r.Errors))+r.ErrorOverflowCount)
+
+	saved, saveable := r.savedBytes(r.ExistingLinkByteAmount, r.InodeRemovedByteAmount)
+	gauge("saved_bytes", "Bytes saved by existing links (and new links, when linking is enabled).", saved)
+	gauge("saveable_bytes", "Additional bytes that linking would save.", saveable)
+	gauge("existing_link_bytes", "Bytes saved by links that existed before the run.", r.ExistingLinkByteAmount)
+
+	gauge("run_successful", "Whether the run completed successfully.", boolMetric(r.RunSuccessful))
+	gauge("linking_enabled", "Whether the run performed the linking.", boolMetric(r.Opts.LinkingEnabled))
+	if !r.EndTime.IsZero() {
+		gauge("last_run_timestamp_seconds", "Time that the run ended, in seconds since the epoch.",
+			formatFloat(float64(r.EndTime.UnixNano())/1e9))
+	}
+
+	header("phase", "gauge", "The phase that the run ended in.")
+	for p := StartPhase; p <= EndPhase; p++ {
+		fmt.Fprintf(&b, "%sphase{%s,phase=%q} %v\n", metricPrefix, runLabels, p.String(), boolMetric(p == r.Phase))
+	}
+
+	r.writePhaseHistogram(&b, runLabels)
+
+	deviceMetric := func(name, typ, help string, v func(d *DeviceStats) interface{}) {
+		header(name, typ, help)
+		for i := range r.DeviceStats {
+			d := &r.DeviceStats[i]
+			fmt.Fprintf(&b, "%s%s{%s,device=\"%d\"} %v\n", metricPrefix, name, runLabels, d.Dev, v(d))
+		}
+	}
+	deviceMetric("device_files_total", "counter", "Files found on the device.",
+		func(d *DeviceStats) interface{} { return d.FileCount })
+	deviceMetric("device_inodes_total", "counter", "Inodes found on the device.",
+		func(d *DeviceStats) interface{} { return d.InodeCount })
+	deviceMetric("device_new_links_total", "counter", "New links made (or that would be made) on the device.",
+		func(d *DeviceStats) interface{} { return d.NewLinkCount })
+	deviceMetric("device_saved_bytes", "gauge", "Bytes saved on the device.",
+		func(d *DeviceStats) interface{} {
+			saved, _ := r.savedBytes(d.ExistingLinkByteAmount, d.InodeRemovedByteAmount)
+			return saved
+		})
+	deviceMetric("device_saveable_bytes", "gauge", "Additional bytes that linking would save on the device.",
+		func(d *DeviceStats) interface{} {
+			_, saveable := r.savedBytes(d.ExistingLinkByteAmount, d.InodeRemovedByteAmount)
+			return saveable
+		})
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// savedBytes returns the bytes saved, and the additional bytes that linking
+// would save, from the existing link and removed inode byte amounts
+func (r *Results) savedBytes(existingLinkBytes, inodeRemovedBytes uint64) (saved, saveable uint64) {
+	saved = existingLinkBytes
+	if r.Opts.LinkingEnabled {
+		saved += inodeRemovedBytes
+	} else {
+		saveable = inodeRemovedBytes
+	}
+	return saved, saveable
+}
+
+// writePhaseHistogram outputs a histogram with the duration of each phase that
+// was entered.  Each run makes a single observation per phase.
+func (r *Results) writePhaseHistogram(b *bytes.Buffer, runLabels string) {
+	name := metricPrefix + "phase_duration_seconds"
+	fmt.Fprintf(b, "# HELP %s Time spent in each phase of the run.\n", name)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+
+	phases := make([]string, 0, len(r.PhaseSeconds))
+	for p := range r.PhaseSeconds {
+		phases = append(phases, p)
+	}
+	sort.Strings(phases)
+	for _, p := range phases {
+		secs := r.PhaseSeconds[p]
+		labels := fmt.Sprintf("%s,phase=%q", runLabels, p)
+		for _, le := range phaseSecondsBuckets {
+			var n int
+			if secs <= le {
+				n = 1
+			}
+			fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", name, labels, formatFloat(le), n)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} 1\n", name, labels)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, formatFloat(secs))
+		fmt.Fprintf(b, "%s_count{%s} 1\n", name, labels)
+	}
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value, as required by the exposition format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
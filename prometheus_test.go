@@ -0,0 +1,106 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheusFile(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions()
+
+	name := "testname: 'Prometheus textfile'"
+
+	m := pathContents{"a/f1": "X", "a/f2": "X", "b/f3": "YY"}
+	simpleFileMaker(t, m)
+	result := simpleRun(name, t, opts, 1, "a", "b")
+
+	metricsDir, err := ioutil.TempDir("", "hardlinkable-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(metricsDir)
+
+	pathname := filepath.Join(metricsDir, "hardlinkable.prom")
+	if err := result.WritePrometheusFile(pathname); err != nil {
+		t.Fatalf("%v: WritePrometheusFile failed: %v", name, err)
+	}
+	b, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(b)
+	if len(result.Devices) != 1 {
+		t.Fatalf("%v: Expected 1 device, got: %v", name, result.Devices)
+	}
+	root := `root="a,b"`
+	device := fmt.Sprintf(`%s,device="%d"`, root, result.Devices[0])
+	for _, line := range []string{
+		"hardlinkable_files_total{" + root + "} 3",
+		"hardlinkable_comparisons_total{" + root + "} 1",
+		"hardlinkable_compared_bytes_total{" + root + "} 2",
+		"# TYPE hardlinkable_files_total counter",
+		"# TYPE hardlinkable_comparisons_total counter",
+		"# TYPE hardlinkable_compared_bytes_total counter",
+		"hardlinkable_saveable_bytes{" + root + "} 1",
+		"hardlinkable_saved_bytes{" + root + "} 0",
+		"# TYPE hardlinkable_saveable_bytes gauge",
+		"# TYPE hardlinkable_saved_bytes gauge",
+		"hardlinkable_run_successful{" + root + "} 1",
+		"hardlinkable_phase{" + root + `,phase="end"} 1`,
+		"hardlinkable_phase_duration_seconds_count{" + root + `,phase="walk"} 1`,
+		"hardlinkable_phase_duration_seconds_bucket{" + root + `,phase="link",le="+Inf"} 1`,
+		"# TYPE hardlinkable_phase_duration_seconds histogram",
+		"hardlinkable_device_files_total{" + device + "} 3",
+		"hardlinkable_device_inodes_total{" + device + "} 3",
+		"hardlinkable_device_new_links_total{" + device + "} 1",
+		"hardlinkable_device_saveable_bytes{" + device + "} 1",
+		"# TYPE hardlinkable_device_files_total counter",
+		"# TYPE hardlinkable_device_saveable_bytes gauge",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("%v: Missing metric line: %v", name, line)
+		}
+	}
+	// Every series is labeled with the roots
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if !strings.HasPrefix(line, "#") && !strings.Contains(line, "{"+root) {
+			t.Errorf("%v: Missing root label: %v", name, line)
+		}
+	}
+
+	// Only the renamed file should remain
+	names, err := ioutil.ReadDir(metricsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0].Mode().Perm() != 0644 {
+		t.Errorf("%v: Expected only %v with mode 0644, got: %v", name, pathname, names)
+	}
+}
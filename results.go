@@ -24,11 +24,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
 	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
 )
 
@@ -47,6 +49,20 @@ const (
 	EndPhase
 )
 
+func (p RunPhases) String() string {
+	switch p {
+	case StartPhase:
+		return "start"
+	case WalkPhase:
+		return "walk"
+	case LinkPhase:
+		return "link"
+	case EndPhase:
+		return "end"
+	}
+	return fmt.Sprintf("RunPhases(%d)", int(p))
+}
+
 // RunStats holds information about counts, the number of files found to be
 // linkable, the bytes that linking would save (or did save), and a variety of
 // related, useful, or just interesting information gathered during the Run().
@@ -65,6 +81,10 @@ type RunStats struct {
 	InodeRemovedByteAmount uint64 `json:"inodeRemovedByteAmount"`
 	BytesCompared          uint64 `json:"bytesCompared"`
 
+	// Bytes that keeping only one copy of the identical files found on
+	// multiple devices would save (only with ReportCrossDevice)
+	CrossDeviceByteAmount uint64 `json:"crossDeviceByteAmount"`
+
 	// Some stats on files that compared equal, but which had some
 	// mismatching inode parameters.  This can be helpful for tuning the
 	// command line options on subsequent runs.
@@ -86,6 +106,10 @@ type RunStats struct {
 	SkippedFileErrCount int64 `json:"skippedFileErrCount"`
 	SkippedLinkErrCount int64 `json:"skippedLinkErrCount"`
 
+	// Count of errors that weren't stored in Results.Errors, due to the
+	// MaxErrorResults limit
+	ErrorOverflowCount int64 `json:"errorOverflowCount"`
+
 	// Counts of files and dirs excluded by the Regex matches
 	ExcludedDirCount  int64 `json:"excludedDirCount"`
 	ExcludedFileCount int64 `json:"excludedFileCount"`
@@ -100,6 +124,22 @@ type RunStats struct {
 	// file bits)
 	SkippedNonPermBitCount int64 `json:"skippedNonPermBitCount"`
 
+	// Count of links that were vetoed by the Options.Observer
+	VetoedLinkCount int64 `json:"vetoedLinkCount"`
+
+	// Count of links between files in the same link group that the
+	// PolicyRules of their paths didn't allow
+	PolicySkippedLinkCount int64 `json:"policySkippedLinkCount"`
+
+	// Count of planned links that Plan.Execute skipped, because their
+	// files had changed since the Scan
+	DriftedLinkCount int64 `json:"driftedLinkCount"`
+
+	// Counts of dirs and files whose entries and stat info were reused
+	// from the StateFile
+	CachedDirCount  int64 `json:"cachedDirCount"`
+	CachedFileCount int64 `json:"cachedFileCount"`
+
 	// Debugging counts
 	EqualComparisonCount int64 `json:"equalComparisonCount"`
 	FoundHashCount       int64 `json:"foundHashCount"`
@@ -117,6 +157,26 @@ type RunStats struct {
 	FailedLinkChownCount   int64 `json:"failedLinkChownCount"`
 }
 
+// RemovedInode is an inode whose last path was linked away (and so was freed
+// when linking)
+type RemovedInode struct {
+	Dev   uint64    `json:"dev"`
+	Ino   uint64    `json:"ino"`
+	Size  uint64    `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// DeviceStats holds the counts and byte amounts of the Run for a single device
+// (st_dev)
+type DeviceStats struct {
+	Dev                    uint64 `json:"dev"`
+	FileCount              int64  `json:"fileCount"`
+	InodeCount             int64  `json:"inodeCount"`
+	NewLinkCount           int64  `json:"newLinkCount"`
+	ExistingLinkByteAmount uint64 `json:"existingLinkByteAmount"`
+	InodeRemovedByteAmount uint64 `json:"inodeRemovedByteAmount"`
+}
+
 // Results contains the RunStats information, as well as the found existing and
 // new links.  It also includes a measurement of how long the Run() took to
 // execute, and the Options that were used to perform the Run().
@@ -126,6 +186,18 @@ type Results struct {
 	ExistingLinkSizes map[string]uint64   `json:"existingLinkSizes"`
 	LinkPaths         [][]string          `json:"linkPaths"`
 	SkippedLinkPaths  [][]string          `json:"skippedLinkPaths"` // Skipped when link failed
+	DriftedLinks      []DriftedLink       `json:"driftedLinks,omitempty"`
+	RemovedInodes     []RemovedInode      `json:"removedInodes,omitempty"`
+	Errors            []RunError          `json:"errors"`
+	DuplicateReport   *DuplicateReport    `json:"duplicateReport,omitempty"`
+	NearDuplicates    []NearDuplicate     `json:"nearDuplicates,omitempty"`
+	CrossDeviceGroups []CrossDeviceGroup  `json:"crossDeviceGroups,omitempty"`
+	DirSavings        []DirSavings        `json:"dirSavings,omitempty"`
+	UIDSavings        []OwnerSavings      `json:"uidSavings,omitempty"`
+	GIDSavings        []OwnerSavings      `json:"gidSavings,omitempty"`
+	Roots             []string            `json:"roots"`
+	Devices           []uint64            `json:"devices"`
+	DeviceStats       []DeviceStats       `json:"deviceStats"`
 	RunStats
 	StartTime time.Time `json:"startTime"`
 	EndTime   time.Time `json:"endTime"`
@@ -138,14 +210,35 @@ type Results struct {
 	// Record which 'phase' we've gotten to in the algorithms, in case of
 	// early termination of the run.
 	Phase RunPhases `json:"phase"`
+
+	// Why the run stopped early, if known (ie. "stopped by signal")
+	StopReason string `json:"stopReason,omitempty"`
+
+	// Whether the StateFile was loaded, created, or discarded (and why)
+	StateFileStatus string `json:"stateFileStatus,omitempty"`
+
+	// Set when the Run was resumed from a checkpoint (the counts include
+	// those of the interrupted Run)
+	Resumed bool `json:"resumed,omitempty"`
+
+	// Seconds spent in each phase that was entered, keyed by phase name
+	PhaseSeconds map[string]float64 `json:"phaseSeconds"`
+
+	phaseStart time.Time
+	dirTally   *dirSavingsTally
+	ownerTally *ownerSavingsTally
 }
 
 func newResults(o *Options) *Results {
 	r := Results{
 		ExistingLinks:     make(map[string][]string),
 		ExistingLinkSizes: make(map[string]uint64),
+		Errors:            []RunError{},
 		Opts:              *o,
 	}
+	if o.ReportOwnerSavings {
+		r.ownerTally = newOwnerSavingsTally()
+	}
 	return &r
 }
 
@@ -195,14 +288,40 @@ func (r *Results) addMismatchedTotalBytes(size uint64) {
 	r.MismatchedTotalBytes += size
 }
 
-func (r *Results) foundInode(n uint64) {
+func (r *Results) foundInode(dev uint64, n uint64) {
 	r.InodeCount++
+	r.device(dev).InodeCount++
 	r.NlinkCount += int64(n)
 }
 
-func (r *Results) foundRemovedInode(size uint64) {
+// foundRemovedInode tracks the count and size of inodes that are removed when
+// their last path (dstP) is moved to the src inode.
+func (r *Results) foundRemovedInode(dev uint64, dstP P.Pathsplit, srcSI, dstSI *I.StatInfo) {
 	r.InodeRemovedCount++
-	r.InodeRemovedByteAmount += size
+	r.InodeRemovedByteAmount += dstSI.Size
+	r.device(dev).InodeRemovedByteAmount += dstSI.Size
+	if r.Opts.StoreNewLinkResults {
+		r.RemovedInodes = append(r.RemovedInodes, RemovedInode{
+			Dev:   dev,
+			Ino:   uint64(dstSI.Ino),
+			Size:  dstSI.Size,
+			Mtime: dstSI.Mtim,
+		})
+	}
+	if r.dirTally != nil {
+		r.dirTally.get(dstP).InodeRemovedBytes += dstSI.Size
+	}
+	if r.ownerTally != nil {
+		r.ownerTally.removedInode(srcSI, dstSI)
+	}
+}
+
+// changedOwner tracks the src inode ownership being changed to the dst inode
+// owner when linking.
+func (r *Results) changedOwner(srcSI, dstSI *I.StatInfo) {
+	if r.ownerTally != nil {
+		r.ownerTally.changedOwner(srcSI, dstSI)
+	}
 }
 
 func (r *Results) foundSetuidFile() {
@@ -253,25 +372,84 @@ func (r *Results) computedDigest() {
 	r.DigestComputedCount++
 }
 
+// setRoots records the walked dirs, and the parent dirs of the walked files, as
+// the roots of the Run.
+func (r *Results) setRoots(dirs []string, files []string) {
+	r.Roots = append([]string{}, dirs...)
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		d := path.Dir(f)
+		if _, ok := seen[d]; !ok {
+			seen[d] = struct{}{}
+			r.Roots = append(r.Roots, d)
+		}
+	}
+	if r.Opts.DirSavingsTopN > 0 {
+		r.dirTally = newDirSavingsTally(r.Roots, r.Opts.DirSavingsDepth)
+	}
+}
+
 func (r *Results) start() {
 	r.StartTime = time.Now()
+	r.phaseStart = r.StartTime
+	r.PhaseSeconds = make(map[string]float64)
+}
+
+// setPhase records the time spent in the current phase, and moves to the next
+func (r *Results) setPhase(p RunPhases) {
+	now := time.Now()
+	if r.PhaseSeconds != nil {
+		r.PhaseSeconds[r.Phase.String()] += now.Sub(r.phaseStart).Seconds()
+	}
+	r.phaseStart = now
+	r.Phase = p
+}
+
+func (r *Results) foundDevice(dev uint64) {
+	r.Devices = append(r.Devices, dev)
+	r.device(dev)
+}
+
+// device returns the DeviceStats of the given device, adding them if needed
+func (r *Results) device(dev uint64) *DeviceStats {
+	for i := range r.DeviceStats {
+		if r.DeviceStats[i].Dev == dev {
+			return &r.DeviceStats[i]
+		}
+	}
+	r.DeviceStats = append(r.DeviceStats, DeviceStats{Dev: dev})
+	return &r.DeviceStats[len(r.DeviceStats)-1]
 }
 
 func (r *Results) end() {
+	if r.Phase != EndPhase {
+		r.setPhase(r.Phase) // Record the phase that was stopped early
+	}
 	r.EndTime = time.Now()
 	duration := r.EndTime.Sub(r.StartTime)
 	r.RunTime = duration.Round(time.Millisecond).String()
+	if r.dirTally != nil {
+		r.DirSavings = r.dirTally.top(r.Opts.DirSavingsTopN)
+	}
+	if r.ownerTally != nil {
+		r.UIDSavings = r.ownerTally.uids.sorted()
+		r.GIDSavings = r.ownerTally.gids.sorted()
+	}
 }
 
 func (r *Results) runCompletedSuccessfully() {
-	r.Phase = EndPhase
+	r.setPhase(EndPhase)
 	r.RunSuccessful = true
 }
 
 // Track the count of new links, and optionally keep a list of linkable or
 // linked pathnames for later output.
-func (r *Results) foundNewLink(srcP, dstP P.Pathsplit) {
+func (r *Results) foundNewLink(dev uint64, srcP, dstP P.Pathsplit, size uint64) {
 	r.NewLinkCount++
+	r.device(dev).NewLinkCount++
+	if r.dirTally != nil {
+		r.dirTally.get(dstP).NewLinkBytes += size
+	}
 	if !r.Opts.StoreNewLinkResults {
 		return
 	}
@@ -293,9 +471,13 @@ func (r *Results) foundNewLink(srcP, dstP P.Pathsplit) {
 
 // Track count of existing links found during walk, and optionally keep a list
 // of them and their sizes for later output.
-func (r *Results) foundExistingLink(srcP P.Pathsplit, dstP P.Pathsplit, size uint64) {
+func (r *Results) foundExistingLink(dev uint64, srcP P.Pathsplit, dstP P.Pathsplit, size uint64) {
 	r.ExistingLinkCount++
 	r.ExistingLinkByteAmount += size
+	r.device(dev).ExistingLinkByteAmount += size
+	if r.dirTally != nil {
+		r.dirTally.get(dstP).ExistingLinkBytes += size
+	}
 	if !r.Opts.StoreExistingLinkResults {
 		return
 	}
@@ -315,6 +497,48 @@ func (r *Results) foundExistingLink(srcP P.Pathsplit, dstP P.Pathsplit, size uin
 			src, size, r.ExistingLinkSizes[src]))
 }
 
+// foundNearDuplicate records identical files blocked only by their metadata
+func (r *Results) foundNearDuplicate(nd NearDuplicate) {
+	r.NearDuplicates = append(r.NearDuplicates, nd)
+}
+
+// foundCrossDeviceGroup records identical files on different devices
+func (r *Results) foundCrossDeviceGroup(g CrossDeviceGroup) {
+	r.CrossDeviceGroups = append(r.CrossDeviceGroups, g)
+	r.CrossDeviceByteAmount += g.SaveableBytes
+}
+
+// driftedLink records a planned link skipped because its files had changed
+func (r *Results) driftedLink(src, dst, reason string) {
+	r.DriftedLinkCount++
+	r.DriftedLinks = append(r.DriftedLinks, DriftedLink{Src: src, Dst: dst, Reason: reason})
+}
+
+// addError stores the error, along with the pathname and operation that
+// produced it, as long as the MaxErrorResults limit hasn't been reached.  The
+// pathname is overridden by the one found in the error itself, if any.
+func (r *Results) addError(op, pathname string, err error) {
+	max := r.Opts.MaxErrorResults
+	switch max {
+	case 0:
+		max = DefaultMaxErrorResults
+	case NoErrorResults:
+		max = 0
+	}
+	if max >= 0 && len(r.Errors) >= max {
+		r.ErrorOverflowCount++
+		return
+	}
+	pathname, _, errno := errInfo(err, pathname)
+	r.Errors = append(r.Errors, RunError{
+		Path:  pathname,
+		Op:    op,
+		Phase: r.Phase,
+		Errno: int(errno),
+		Err:   err.Error(),
+	})
+}
+
 // Track the count of skipped new links (ie. those where linking was attempted,
 // but failed), and optionally keep a list of linkable or linked pathnames for
 // later output.
@@ -357,8 +581,46 @@ func (r *Results) OutputResults() {
 		fmt.Println("")
 	}
 
+	r.OutputDuplicateReport()
+	if r.DuplicateReport != nil {
+		fmt.Println("")
+	}
+
+	r.OutputNearDuplicates()
+	if len(r.NearDuplicates) > 0 {
+		fmt.Println("")
+	}
+
+	r.OutputCrossDevice()
+	if len(r.CrossDeviceGroups) > 0 {
+		fmt.Println("")
+	}
+
+	r.OutputDirSavings()
+	if len(r.DirSavings) > 0 &&
+		(len(r.SkippedLinkPaths) > 0 || len(r.Errors) > 0 || showStats) {
+		fmt.Println("")
+	}
+
+	r.OutputOwnerSavings()
+	if len(r.UIDSavings) > 0 &&
+		(len(r.SkippedLinkPaths) > 0 || len(r.Errors) > 0 || showStats) {
+		fmt.Println("")
+	}
+
 	r.OutputSkippedNewLinks()
-	if len(r.SkippedLinkPaths) > 0 && showStats {
+	if len(r.SkippedLinkPaths) > 0 &&
+		(len(r.DriftedLinks) > 0 || len(r.Errors) > 0 || showStats) {
+		fmt.Println("")
+	}
+
+	r.OutputDriftedLinks()
+	if len(r.DriftedLinks) > 0 && (len(r.Errors) > 0 || showStats) {
+		fmt.Println("")
+	}
+
+	r.OutputErrors()
+	if len(r.Errors) > 0 && showStats {
 		fmt.Println("")
 	}
 
@@ -423,6 +685,40 @@ func (r *Results) OutputSkippedNewLinks() {
 	fmt.Println(strings.Join(s, "\n"))
 }
 
+// OutputDriftedLinks shows in text form the planned links that were skipped
+// by Plan.Execute, and why.
+func (r *Results) OutputDriftedLinks() {
+	if len(r.DriftedLinks) == 0 {
+		return
+	}
+	s := make([]string, 0)
+	s = append(s, "Planned links skipped due to changed files")
+	s = append(s, "------------------------------------------")
+	for _, d := range r.DriftedLinks {
+		s = append(s, "from: "+d.Src)
+		s = append(s, fmt.Sprintf("  to: %v  (%v)", d.Dst, d.Reason))
+	}
+	fmt.Println(strings.Join(s, "\n"))
+}
+
+// OutputErrors shows in text form the stored errors that were encountered
+// during the Run, with the operation and pathname that caused them.
+func (r *Results) OutputErrors() {
+	if len(r.Errors) == 0 {
+		return
+	}
+	s := make([]string, 0)
+	s = append(s, "Errors encountered this run")
+	s = append(s, "---------------------------")
+	for _, e := range r.Errors {
+		s = append(s, fmt.Sprintf("%-7v %v: %v", e.Op, e.Path, e.Err))
+	}
+	if r.ErrorOverflowCount > 0 {
+		s = append(s, fmt.Sprintf("(%v additional errors not shown)", r.ErrorOverflowCount))
+	}
+	fmt.Println(strings.Join(s, "\n"))
+}
+
 // outputLinkPaths is a helper for outputting LinkPaths slices
 func outputLinkPaths(s []string, lp [][]string) {
 	for _, paths := range lp {
@@ -450,6 +746,18 @@ func (r *Results) OutputRunStats() {
 	s := make([][]string, 0)
 	s = statStr(s, "Hard linking statistics")
 	s = statStr(s, "-----------------------")
+	s = append(s, r.runStatsRows()...)
+	printSlices(s)
+
+	if r.Opts.DebugLevel > 2 {
+		fmt.Printf("\nOptions%+v\n", r.Opts)
+	}
+}
+
+// runStatsRows returns the rows of stat names and values shown by
+// OutputRunStats
+func (r *Results) runStatsRows() [][]string {
+	s := make([][]string, 0)
 	if !r.RunSuccessful {
 		var phase string
 		switch r.Phase {
@@ -463,9 +771,20 @@ func (r *Results) OutputRunStats() {
 			phase = "End"
 		}
 		s = statStr(s, "Run stopped early in phase", phase)
+		if r.StopReason != "" {
+			s = statStr(s, "Stop reason", r.StopReason)
+		}
 	}
 	s = statStr(s, "Directories", r.DirCount)
 	s = statStr(s, "Files", r.FileCount)
+	if r.StateFileStatus != "" {
+		s = statStr(s, "State file", r.StateFileStatus)
+		s = statStr(s, "Unchanged dirs from state", r.CachedDirCount)
+		s = statStr(s, "Unchanged files from state", r.CachedFileCount)
+	}
+	if r.Resumed {
+		s = statStr(s, "Resumed from checkpoint", "yes")
+	}
 	if r.Opts.LinkingEnabled {
 		s = statStr(s, "Hardlinked this run", r.NewLinkCount)
 		s = statStr(s, "Removed inodes", r.InodeRemovedCount)
@@ -487,6 +806,10 @@ func (r *Results) OutputRunStats() {
 	s = statStr(s, s1, r.InodeRemovedByteAmount, humanizeParens(r.InodeRemovedByteAmount))
 	s = statStr(s, s2, totalBytes, humanizeParens(totalBytes))
 
+	if r.Opts.ReportCrossDevice {
+		s = statStr(s, "Saveable across devices", r.CrossDeviceByteAmount,
+			humanizeParens(r.CrossDeviceByteAmount))
+	}
 	s = statStr(s, "Total run time", r.RunTime)
 
 	totalLinks := r.ExistingLinkCount + r.NewLinkCount
@@ -539,6 +862,9 @@ func (r *Results) OutputRunStats() {
 			s = statStr(s, "Total equal file mismatches", r.MismatchedTotalCount,
 				humanizeParens(r.MismatchedTotalBytes))
 		}
+		if len(r.NearDuplicates) > 0 {
+			s = statStr(s, "Equal files w/ blocking attrs", len(r.NearDuplicates))
+		}
 		if r.BytesCompared > 0 {
 			s = statStr(s, "Total bytes compared", r.BytesCompared,
 				humanizeParens(r.BytesCompared))
@@ -565,6 +891,18 @@ func (r *Results) OutputRunStats() {
 		if r.SkippedLinkErrCount > 0 {
 			s = statStr(s, "Link errors this run", r.SkippedLinkErrCount)
 		}
+		if r.VetoedLinkCount > 0 {
+			s = statStr(s, "Links vetoed by observer", r.VetoedLinkCount)
+		}
+		if r.PolicySkippedLinkCount > 0 {
+			s = statStr(s, "Links skipped by policy", r.PolicySkippedLinkCount)
+		}
+		if r.DriftedLinkCount > 0 {
+			s = statStr(s, "Planned links skipped for drift", r.DriftedLinkCount)
+		}
+		if r.ErrorOverflowCount > 0 {
+			s = statStr(s, "Errors not stored", r.ErrorOverflowCount)
+		}
 	}
 
 	if r.Opts.DebugLevel > 0 {
@@ -600,11 +938,7 @@ func (r *Results) OutputRunStats() {
 		s = statStr(s, "Mem Sys", Humanize(m.Sys))
 		s = statStr(s, "Num live objects", m.Mallocs-m.Frees)
 	}
-	printSlices(s)
-
-	if r.Opts.DebugLevel > 2 {
-		fmt.Printf("\nOptions%+v\n", r.Opts)
-	}
+	return s
 }
 
 // OutputJSONResults outputs a JSON formatted object with all the information
@@ -21,6 +21,12 @@
 package hardlinkable
 
 import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -86,3 +92,44 @@ func TestHumanizedUint64(t *testing.T) {
 		}
 	}
 }
+
+func TestAddError(t *testing.T) {
+	opts := SetupOptions()
+	opts.MaxErrorResults = 2
+	r := newResults(&opts)
+	r.Phase = WalkPhase
+
+	openErr := &os.PathError{Op: "open", Path: "/a/f1", Err: syscall.EACCES}
+	r.addError(errOp(openErr, OpRead), "f1", openErr)
+	linkErr := &os.LinkError{Op: "rename", Old: "/a/f2.tmp", New: "/a/f2", Err: syscall.EXDEV}
+	r.addError(errOp(linkErr, OpLink), "/a/f2", linkErr)
+	r.addError(OpWalk, "/a/d", errors.New("no errno"))
+
+	want := []RunError{
+		{Path: "/a/f1", Op: OpOpen, Phase: WalkPhase, Errno: int(syscall.EACCES), Err: openErr.Error()},
+		{Path: "/a/f2", Op: OpRename, Phase: WalkPhase, Errno: int(syscall.EXDEV), Err: linkErr.Error()},
+	}
+	if !reflect.DeepEqual(r.Errors, want) {
+		t.Errorf("Stored errors expected: %+v, got: %+v", want, r.Errors)
+	}
+	if r.ErrorOverflowCount != 1 {
+		t.Errorf("ErrorOverflowCount expected: 1, got: %v", r.ErrorOverflowCount)
+	}
+
+	// The zero Options use the default limit, and encode no errors as []
+	r = newResults(&Options{})
+	if b, _ := json.Marshal(r); !strings.Contains(string(b), `"errors":[]`) {
+		t.Errorf("Expected empty errors in JSON, got: %s", b)
+	}
+	r.addError(OpWalk, "/a/d", errors.New("no errno"))
+	if len(r.Errors) != 1 {
+		t.Errorf("Expected the zero MaxErrorResults to store errors, got: %v", r.Errors)
+	}
+
+	opts.MaxErrorResults = NoErrorResults
+	r = newResults(&opts)
+	r.addError(OpWalk, "/a/d", errors.New("no errno"))
+	if len(r.Errors) != 0 || r.ErrorOverflowCount != 1 {
+		t.Errorf("Expected NoErrorResults to only count errors, got: %v", r.Errors)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ResultsDiff holds the changes between the Results of two runs.
+//
+// Duplicate groups are the sets of pathnames that the Results show to have
+// identical content (ie. existing links, and new linkable paths).  A new
+// group shares no pathnames with any of the old groups, and a removed group
+// shares no pathnames with any of the new groups.
+//
+// Unlinked holds the pathname pairs that were linked in the old Results, but
+// are separate inodes in the new Results.  Only pathnames that appear in both
+// Results can be reported.
+type ResultsDiff struct {
+	NewGroups     [][]string `json:"newGroups"`
+	RemovedGroups [][]string `json:"removedGroups"`
+	Unlinked      [][]string `json:"unlinked"`
+
+	OldExistingLinkBytes uint64 `json:"oldExistingLinkBytes"`
+	NewExistingLinkBytes uint64 `json:"newExistingLinkBytes"`
+	OldSaveableBytes     uint64 `json:"oldSaveableBytes"`
+	NewSaveableBytes     uint64 `json:"newSaveableBytes"`
+	OldTotalBytes        uint64 `json:"oldTotalBytes"`
+	NewTotalBytes        uint64 `json:"newTotalBytes"`
+}
+
+// ReadResultsJSON reads Results from JSON, as written by OutputJSONResults
+func ReadResultsJSON(r io.Reader) (Results, error) {
+	var results Results
+	if err := json.NewDecoder(r).Decode(&results); err != nil {
+		return results, err
+	}
+	if results.ExistingLinks == nil {
+		results.ExistingLinks = make(map[string][]string)
+	}
+	if results.ExistingLinkSizes == nil {
+		results.ExistingLinkSizes = make(map[string]uint64)
+	}
+	return results, nil
+}
+
+// LoadResultsFile reads Results from a JSON file, as written by
+// OutputJSONResults
+func LoadResultsFile(pathname string) (Results, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return Results{}, err
+	}
+	defer f.Close()
+
+	r, err := ReadResultsJSON(f)
+	if err != nil {
+		return r, fmt.Errorf("Couldn't read Results from %v: %v", pathname, err)
+	}
+	return r, nil
+}
+
+// DiffResultsFiles loads the Results from two JSON files, and returns the
+// changes between them.
+func DiffResultsFiles(oldPathname, newPathname string) (ResultsDiff, error) {
+	oldR, err := LoadResultsFile(oldPathname)
+	if err != nil {
+		return ResultsDiff{}, err
+	}
+	newR, err := LoadResultsFile(newPathname)
+	if err != nil {
+		return ResultsDiff{}, err
+	}
+	return DiffResults(oldR, newR), nil
+}
+
+// DiffResults returns the changes in duplicate groups, linked paths and
+// saveable bytes between two Results.
+func DiffResults(oldR, newR Results) ResultsDiff {
+	d := ResultsDiff{
+		NewGroups:            [][]string{},
+		RemovedGroups:        [][]string{},
+		Unlinked:             [][]string{},
+		OldExistingLinkBytes: oldR.ExistingLinkByteAmount,
+		NewExistingLinkBytes: newR.ExistingLinkByteAmount,
+		OldSaveableBytes:     oldR.InodeRemovedByteAmount,
+		NewSaveableBytes:     newR.InodeRemovedByteAmount,
+		OldTotalBytes:        oldR.ExistingLinkByteAmount + oldR.InodeRemovedByteAmount,
+		NewTotalBytes:        newR.ExistingLinkByteAmount + newR.InodeRemovedByteAmount,
+	}
+
+	oldDups, newDups := oldR.duplicateSets(), newR.duplicateSets()
+	d.NewGroups = newDups.disjointFrom(oldDups)
+	d.RemovedGroups = oldDups.disjointFrom(newDups)
+
+	oldInodes, newInodes := oldR.inodeSets(), newR.inodeSets()
+	for _, g := range oldInodes.groups() {
+		// Report each unlinked path once, paired with the first path of
+		// its old group that is still present
+		var first string
+		for _, p := range g {
+			if _, ok := newDups.parent[p]; !ok {
+				continue
+			}
+			if first == "" {
+				first = p
+			} else if newInodes.find(p) != newInodes.find(first) {
+				d.Unlinked = append(d.Unlinked, []string{first, p})
+			}
+		}
+	}
+	return d
+}
+
+// pathSets is a union-find (disjoint set) structure of pathnames
+type pathSets struct {
+	parent map[string]string
+}
+
+func newPathSets() pathSets {
+	return pathSets{parent: make(map[string]string)}
+}
+
+func (s pathSets) find(p string) string {
+	if _, ok := s.parent[p]; !ok {
+		s.parent[p] = p
+		return p
+	}
+	for s.parent[p] != p {
+		s.parent[p] = s.parent[s.parent[p]] // Path halving
+		p = s.parent[p]
+	}
+	return p
+}
+
+func (s pathSets) union(paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	root := s.find(paths[0])
+	for _, p := range paths[1:] {
+		if r := s.find(p); r != root {
+			s.parent[r] = root
+		}
+	}
+}
+
+// groups returns the sorted pathnames of each set, ordered by first pathname
+func (s pathSets) groups() [][]string {
+	m := make(map[string][]string)
+	for p := range s.parent {
+		r := s.find(p)
+		m[r] = append(m[r], p)
+	}
+	g := make([][]string, 0, len(m))
+	for _, paths := range m {
+		sort.Strings(paths)
+		g = append(g, paths)
+	}
+	sort.Slice(g, func(i, j int) bool { return g[i][0] < g[j][0] })
+	return g
+}
+
+// disjointFrom returns the groups that share no pathnames with other
+func (s pathSets) disjointFrom(other pathSets) [][]string {
+	r := [][]string{}
+GroupLoop:
+	for _, g := range s.groups() {
+		for _, p := range g {
+			if _, ok := other.parent[p]; ok {
+				continue GroupLoop
+			}
+		}
+		r = append(r, g)
+	}
+	return r
+}
+
+// inodeSets returns the sets of pathnames that are linked to the same inode
+// at the end of the Run (ie. the existing links, as well as the new links if
+// linking was enabled)
+func (r *Results) inodeSets() pathSets {
+	s := newPathSets()
+	for src, dsts := range r.ExistingLinks {
+		s.union(append([]string{src}, dsts...)...)
+	}
+	if r.Opts.LinkingEnabled {
+		for _, paths := range r.LinkPaths {
+			s.union(paths...)
+		}
+	}
+	return s
+}
+
+// duplicateSets returns the sets of pathnames with identical content
+func (r *Results) duplicateSets() pathSets {
+	s := r.inodeSets()
+	for _, paths := range r.LinkPaths {
+		s.union(paths...)
+	}
+	for _, paths := range r.SkippedLinkPaths {
+		s.union(paths...)
+	}
+	return s
+}
+
+// OutputDiff shows in text form the changes between two Results
+func (d ResultsDiff) OutputDiff() {
+	outputGroups := func(title string, groups [][]string) {
+		if len(groups) == 0 {
+			return
+		}
+		fmt.Println(title)
+		fmt.Println(strings.Repeat("-", len(title)))
+		for _, g := range groups {
+			for i, p := range g {
+				if i == 0 {
+					fmt.Println("group: " + p)
+				} else {
+					fmt.Println("       " + p)
+				}
+			}
+		}
+		fmt.Println("")
+	}
+	outputGroups("New duplicate groups", d.NewGroups)
+	outputGroups("Removed duplicate groups", d.RemovedGroups)
+
+	if len(d.Unlinked) > 0 {
+		fmt.Println("Previously linked paths that are now separate inodes")
+		fmt.Println("----------------------------------------------------")
+		for _, pair := range d.Unlinked {
+			fmt.Printf("from: %v\n  to: %v\n", pair[0], pair[1])
+		}
+		fmt.Println("")
+	}
+
+	delta := func(oldN, newN uint64) string {
+		if newN >= oldN {
+			return "+" + Humanize(newN-oldN)
+		}
+		return "-" + Humanize(oldN-newN)
+	}
+	s := make([][]string, 0)
+	s = statStr(s, "Results changes")
+	s = statStr(s, "---------------")
+	s = statStr(s, "New duplicate groups", len(d.NewGroups))
+	s = statStr(s, "Removed duplicate groups", len(d.RemovedGroups))
+	s = statStr(s, "Unlinked paths", len(d.Unlinked))
+	s = statStr(s, "Currently linked bytes", Humanize(d.OldExistingLinkBytes),
+		Humanize(d.NewExistingLinkBytes), delta(d.OldExistingLinkBytes, d.NewExistingLinkBytes))
+	s = statStr(s, "Additional saveable bytes", Humanize(d.OldSaveableBytes),
+		Humanize(d.NewSaveableBytes), delta(d.OldSaveableBytes, d.NewSaveableBytes))
+	s = statStr(s, "Total saveable bytes", Humanize(d.OldTotalBytes),
+		Humanize(d.NewTotalBytes), delta(d.OldTotalBytes, d.NewTotalBytes))
+	printSlices(s)
+}
+
+// OutputJSONDiff outputs the ResultsDiff as a JSON formatted object
+func (d ResultsDiff) OutputJSONDiff() {
+	b, _ := json.Marshal(d)
+	fmt.Println(string(b))
+}
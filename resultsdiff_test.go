@@ -0,0 +1,95 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestResultsJSONRoundTrip(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	opts := SetupOptions(ContentOnly, ReportDuplicates(2), ReportDirSavings(2, 1))
+
+	name := "testname: 'Results JSON round trip'"
+
+	m := pathContents{"a/f1": "X", "b/f1": "X", "a/f2": "YY", "b/f2": "YY"}
+	simpleFileMaker(t, m)
+	simpleLinkMaker(t, "a/f1", "a/f3")
+	result := simpleRun(name, t, opts, 2, ".")
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("%v: Couldn't marshal Results: %v", name, err)
+	}
+	loaded, err := ReadResultsJSON(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("%v: Couldn't read Results: %v", name, err)
+	}
+	if !reflect.DeepEqual(loaded.Opts, result.Opts) {
+		t.Errorf("%v: Opts expected: %+v, got: %+v", name, result.Opts, loaded.Opts)
+	}
+	if loaded.Phase != result.Phase {
+		t.Errorf("%v: Phase expected: %v, got: %v", name, result.Phase, loaded.Phase)
+	}
+	b2, err := json.Marshal(loaded)
+	if err != nil {
+		t.Fatalf("%v: Couldn't marshal loaded Results: %v", name, err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Errorf("%v: Round tripped JSON differs:\n%s\n%s", name, b, b2)
+	}
+}
+
+func TestDiffResults(t *testing.T) {
+	oldR := Results{
+		ExistingLinks: map[string][]string{"a": {"b"}, "x": {"y"}},
+		LinkPaths:     [][]string{{"c", "d"}},
+		RunStats:      RunStats{ExistingLinkByteAmount: 10, InodeRemovedByteAmount: 5},
+	}
+	oldR.Opts.LinkingEnabled = true
+	newR := Results{
+		ExistingLinks: map[string][]string{"c": {"d"}},
+		LinkPaths:     [][]string{{"a", "b"}, {"e", "f"}},
+		RunStats:      RunStats{ExistingLinkByteAmount: 5, InodeRemovedByteAmount: 20},
+	}
+
+	d := DiffResults(oldR, newR)
+	want := ResultsDiff{
+		NewGroups:            [][]string{{"e", "f"}},
+		RemovedGroups:        [][]string{{"x", "y"}},
+		Unlinked:             [][]string{{"a", "b"}},
+		OldExistingLinkBytes: 10,
+		NewExistingLinkBytes: 5,
+		OldSaveableBytes:     5,
+		NewSaveableBytes:     20,
+		OldTotalBytes:        15,
+		NewTotalBytes:        25,
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("DiffResults expected: %+v, got: %+v", want, d)
+	}
+}
@@ -21,17 +21,19 @@
 // Package hardlinkable determines which files in the given directories have
 // equal content and compatible inode properties, and returns information on
 // the space that would be saved by hardlinking them all together.  It can
-// also, optionally, perform the hardlinking.
+// also, optionally, perform the hardlinking, or return a Plan of the links
+// (with Scan) that can be examined, and performed later.
 package hardlinkable
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path"
-	"syscall"
 
 	"github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 // RunWithProgress performs a scan of the supplied directories and files, with
@@ -39,15 +41,23 @@ import (
 // save space.  A progress line is continually updated as the directories and
 // files are scanned.
 func RunWithProgress(dirsAndFiles []string, opts Options) (Results, error) {
+	return RunWithProgressContext(context.Background(), dirsAndFiles, opts)
+}
+
+// RunWithProgressContext is like RunWithProgress, but stops early when the
+// given context is done (see RunContext).
+func RunWithProgressContext(ctx context.Context, dirsAndFiles []string, opts Options) (Results, error) {
 	ls := newLinkableState(&opts)
+	ls.ctx = ctx
 
 	var err error
 	if err = opts.Validate(); err != nil {
 		return *ls.Results, err
 	}
 
-	ls.Progress = newTTYProgress(ls.Results, ls.Options)
-	defer ls.Progress.Done()
+	p := newTTYProgress(ls.Results, ls.Options)
+	defer p.Done()
+	ls.observer = newObservers(p, opts.Observer)
 
 	err = runHelper(dirsAndFiles, ls)
 	return *ls.Results, err
@@ -57,15 +67,22 @@ func RunWithProgress(dirsAndFiles []string, opts Options) (Results, error) {
 // Options, and outputs information on which files could be linked to save
 // space.
 func Run(dirsAndFiles []string, opts Options) (Results, error) {
+	return RunContext(context.Background(), dirsAndFiles, opts)
+}
+
+// RunContext is like Run, but stops early when the given context is done.
+// The directory walk, any in-flight file comparison, and the linking are
+// stopped (a link being made is completed first), and the partial Results
+// are returned along with the context's error.  Results.Phase shows the phase
+// that was stopped.
+func RunContext(ctx context.Context, dirsAndFiles []string, opts Options) (Results, error) {
 	ls := newLinkableState(&opts)
+	ls.ctx = ctx
 
 	if err := opts.Validate(); err != nil {
 		return *ls.Results, err
 	}
 
-	ls.Progress = &disabledProgress{}
-	defer ls.Progress.Done()
-
 	err := runHelper(dirsAndFiles, ls)
 	return *ls.Results, err
 }
@@ -79,113 +96,107 @@ func runHelper(dirsAndFiles []string, ls *linkableState) (err error) {
 		}
 	}()
 
-	dirs, files, err := ValidateDirsAndFiles(dirsAndFiles)
+	dirs, files, err := validateDirsAndFiles(ls.fsys, dirsAndFiles)
 	if err != nil {
 		return err
 	}
+	ls.Results.setRoots(dirs, files)
 	ls.Results.start()
 	defer ls.Results.end()
 
-	// Phase 1: Gather path and inode information by walking the dirs and
-	// files, looking for files that can be linked due to identical
-	// contents, and optionally equivalent inode parameters (time,
-	// permission, ownership, etc.)
-	ls.Results.Phase = WalkPhase
-	c := matchedPathnames(*ls.Options, ls.Results, ls.pool, dirs, files)
-	for pe := range c {
-		// Handle early termination of the directory walk.  If
-		// IgnoreWalkErrors is set, we won't get any errors here.
-		if pe.err != nil {
-			return pe.err
-		}
+	// Cancelling on return also stops the walk and generator goroutines,
+	// when returning early.
+	ctx, cancel := context.WithCancel(ls.ctx)
+	defer cancel()
+	ls.ctx = ctx
 
-		ls.Progress.Show()
-		di, statErr := inode.LStatInfo(pe.pathname)
-		if statErr != nil {
-			if !di.Mode.IsRegular() {
-				panic("godirwalk pkg returned non-regular file, which is a bug.")
+	// Restore the state of an interrupted Run, which can skip the walk
+	resumePhase := StartPhase
+	if ls.Options.CheckpointFile != "" {
+		ls.ckpt = newCheckpointer(ls, dirsAndFiles)
+		if ls.Options.Resume {
+			if resumePhase, err = ls.ckpt.resume(dirsAndFiles); err != nil {
+				return err
 			}
-			if ls.Options.IgnoreWalkErrors {
-				ls.Results.SkippedFileErrCount++
-				if ls.Options.DebugLevel > 0 {
-					log.Printf("\r%v  Skipping...", statErr)
+		}
+		defer func() {
+			// Save the progress of a stopped link phase, so it can be
+			// resumed.  A stopped walk resumes from the last checkpoint.
+			if err != nil && ls.ctx.Err() != nil && ls.Results.Phase == LinkPhase &&
+				ls.Options.LinkingEnabled {
+				if saveErr := ls.ckpt.save(LinkPhase); saveErr != nil {
+					ls.Results.addError(OpCheckpoint, ls.Options.CheckpointFile, saveErr)
 				}
-				continue
-			} else {
-				return statErr
 			}
-		}
+		}()
+	}
 
-		// Ignore files with setuid/setgid bits.  Linking them could
-		// have security implications.
-		if di.Mode&os.ModeSetuid != 0 {
-			ls.Results.foundSetuidFile()
-			continue
-		}
-		if di.Mode&os.ModeSetgid != 0 {
-			ls.Results.foundSetgidFile()
-			continue
+	if resumePhase != LinkPhase {
+		if err := ls.walk(dirs, files); err != nil {
+			return err
 		}
-
-		// Also exclude files with any other non-perm mode bits set
-		if di.Mode != (di.Mode & os.ModePerm) {
-			ls.Results.foundNonPermBitFile()
-			continue
+		if err := ls.report(); err != nil {
+			return err
 		}
+	}
 
-		// Ensure the files fall within the allowed Size range
-		if di.Size < ls.Options.MinFileSize {
-			ls.Results.foundFileTooSmall()
-			continue
-		}
-		if ls.Options.MaxFileSize > 0 &&
-			di.Size > ls.Options.MaxFileSize {
-			ls.Results.foundFileTooLarge()
-			continue
+	// Export the scan data before the link phase modifies it.  The export
+	// is completed (with the links and errors) even if linking stops early.
+	if ls.sqlite != nil {
+		if err := ls.sqlite.begin(); err != nil {
+			return err
 		}
-		// If the file hasn't been rejected by this
-		// point, add it to the found count
-		ls.Results.foundFile()
-
-		fsdev := ls.dev(di, pe.pathname)
-		cmpErr := fsdev.FindIdenticalFiles(di, pe.pathname)
-		if cmpErr != nil {
-			if ls.Options.IgnoreWalkErrors {
-				ls.Results.SkippedFileErrCount++
-				if ls.Options.DebugLevel > 0 {
-					log.Printf("\r%v  Skipping...", cmpErr)
-				}
-			} else {
-				return cmpErr
+		defer func() {
+			if endErr := ls.sqlite.end(ls.Results); err == nil {
+				err = endErr
 			}
+		}()
+		for _, fsdev := range ls.fsDevs {
+			ls.sqlite.addDevice(&fsdev)
 		}
 	}
 
-	ls.Progress.Clear()
-
-	// Calculate and store the number of unique paths encountered by the
-	// walk, overwriting the possibly less accurate counts gathered during
-	// the walk (if files specified twice, for example, they will only be
-	// counted once here)
-	var numPaths int64
-	for _, fsdev := range ls.fsDevs {
-		p, _ := fsdev.InoPaths.PathCount()
-		numPaths += p
-	}
-	ls.Results.FileCount = numPaths
-
 	// Phase 2: Link generation - with all the path and inode information
 	// collected, iterate over all the inode links sorted from highest
 	// nlink count to lowest, gathering accurate linking statistics,
 	// determine what link() pairs and in what order are needed to produce
 	// the desired result, and optionally link them if requested.
-	ls.Results.Phase = LinkPhase
+	if err := ls.ctx.Err(); err != nil {
+		return err // Stopped during the reports following the walk
+	}
+	// Without linking, the link phase changes the indexes to what they
+	// would be after linking, so the scan state is recorded before it.
+	if ls.scan != nil && !ls.Options.LinkingEnabled {
+		ls.scan.record(ls.fsDevs)
+	}
+	// A checkpoint after the walk lets a resumed Run skip it
+	if ls.ckpt != nil && resumePhase != LinkPhase {
+		if err := ls.ckpt.saveIfDue(LinkPhase); err != nil {
+			return err
+		}
+	}
+	ls.setPhase(LinkPhase)
 	for _, fsdev := range ls.fsDevs {
 		if err := fsdev.generateLinks(); err != nil {
 			return err
 		}
 	}
+	if err := ls.ctx.Err(); err != nil {
+		return err
+	}
+	if ls.scan != nil {
+		if ls.Options.LinkingEnabled {
+			ls.scan.record(ls.fsDevs)
+		}
+		if err := ls.scan.save(); err != nil {
+			return err
+		}
+	}
+	if ls.ckpt != nil {
+		ls.ckpt.remove()
+	}
 	ls.Results.runCompletedSuccessfully()
+	ls.observer.PhaseChanged(EndPhase)
 
 	return nil
 }
@@ -198,23 +209,27 @@ type devIno struct {
 // ValidateDirsAndFiles will ensure only dirs are provided, and remove
 // duplicates.  It is called by Run() to check the 'dirs' arg.
 func ValidateDirsAndFiles(dirsAndFiles []string) (dirs []string, files []string, err error) {
+	return validateDirsAndFiles(vfs.OS, dirsAndFiles)
+}
+
+func validateDirsAndFiles(fsys vfs.FS, dirsAndFiles []string) (dirs []string, files []string, err error) {
 	dirs = []string{}
 	files = []string{}
 	seenDirs := make(map[devIno]struct{})
 	seenFiles := make(map[string]struct{})
 	for _, name := range dirsAndFiles {
 		var fi os.FileInfo
-		fi, err = os.Lstat(name)
+		fi, err = fsys.Lstat(name)
 		if err != nil {
 			return
 		}
 		if fi.IsDir() {
-			statT, ok := fi.Sys().(*syscall.Stat_t)
+			statT, ok := vfs.StatOf(fi)
 			if !ok {
 				err = fmt.Errorf("Couldn't convert Stat_t for pathname: %s", name)
 				return
 			}
-			di := devIno{dev: uint64(statT.Dev), ino: uint64(statT.Ino)}
+			di := devIno{dev: statT.Dev, ino: statT.Ino}
 			if _, ok := seenDirs[di]; ok {
 				continue
 			}
@@ -237,3 +252,195 @@ func ValidateDirsAndFiles(dirsAndFiles []string) (dirs []string, files []string,
 	}
 	return
 }
+
+// walk performs the first phase of the Run, gathering the path and inode
+// information of the dirs and files.
+func (ls *linkableState) walk(dirs, files []string) error {
+	// Phase 1: Gather path and inode information by walking the dirs and
+	// files, looking for files that can be linked due to identical
+	// contents, and optionally equivalent inode parameters (time,
+	// permission, ownership, etc.)
+	ls.setPhase(WalkPhase)
+	var wc *walkCheckpoint
+	if ls.ckpt != nil {
+		wc = &ls.ckpt.walk
+	}
+	// The walk goroutine updates the Results, so it is stopped, and waited
+	// for (by draining its channel until closed), before returning
+	ctx, cancel := context.WithCancel(ls.ctx)
+	c := matchedPathnames(ctx, ls.fsys, *ls.Options, ls.Results, ls.pool, ls.scan, wc, dirs, files)
+	defer func() {
+		cancel()
+		for range c {
+		}
+	}()
+	for pe := range c {
+		if err := ls.ctx.Err(); err != nil {
+			return err
+		}
+		if pe.pause != nil {
+			err := ls.ckpt.walkPaused()
+			close(pe.pause)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// Handle early termination of the directory walk.  If
+		// IgnoreWalkErrors is set, we only get the skipped errors here.
+		if pe.err != nil {
+			ls.Results.addError(OpWalk, pe.pathname, pe.err)
+			if pe.skipped {
+				continue
+			}
+			return pe.err
+		}
+		if pe.dir {
+			ls.observer.DirEntered(pe.pathname)
+			continue
+		}
+		if pe.rejected != "" {
+			ls.observer.FileRejected(pe.pathname, pe.rejected)
+			continue
+		}
+
+		if err := ls.walkFile(pe.pathname, pe.cached); err != nil {
+			return err
+		}
+	}
+
+	if err := ls.ctx.Err(); err != nil {
+		return err // The walk was stopped
+	}
+	return nil
+}
+
+// report computes the Results that are gathered after the walk, and before
+// the link phase changes the indexes.
+func (ls *linkableState) report() error {
+	// Calculate and store the number of unique paths encountered by the
+	// walk, overwriting the possibly less accurate counts gathered during
+	// the walk (if files specified twice, for example, they will only be
+	// counted once here)
+	var numPaths int64
+	for _, fsdev := range ls.fsDevs {
+		p, _ := fsdev.InoPaths.PathCount()
+		numPaths += p
+		ls.Results.device(fsdev.Dev).FileCount = p
+	}
+	ls.Results.FileCount = numPaths
+
+	if ls.Options.DuplicatesTopN > 0 {
+		t := newDuplicateTally(ls.Options.DuplicatesTopN)
+		for _, fsdev := range ls.fsDevs {
+			fsdev.tallyDuplicates(t)
+		}
+		ls.Results.DuplicateReport = t.report()
+	}
+
+	if ls.Options.ReportNearDuplicates {
+		for _, fsdev := range ls.fsDevs {
+			if err := fsdev.findNearDuplicates(); err != nil {
+				return err
+			}
+		}
+		ls.Results.sortNearDuplicates()
+	}
+
+	if ls.Options.ReportCrossDevice {
+		if err := ls.findCrossDeviceDuplicates(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkFile stats a regular file found by the walk (unless its stat info is
+// cached) and, if it isn't rejected, adds it to the inode indexes of its
+// device.  Errors that shouldn't stop the Run are recorded in the Results,
+// and nil is returned.
+func (ls *linkableState) walkFile(pathname string, cached *fileState) error {
+	var di inode.DevStatInfo
+	var statErr error
+	if cached != nil {
+		di = cached.devStatInfo()
+		ls.Results.CachedFileCount++
+	} else {
+		di, statErr = inode.LStatInfo(ls.fsys, pathname)
+	}
+	if statErr != nil {
+		if !di.Mode.IsRegular() {
+			panic("walk returned a non-regular file, which is a bug.")
+		}
+		ls.Results.addError(OpStat, pathname, statErr)
+		ls.observer.FileRejected(pathname, RejectError)
+		if ls.Options.IgnoreWalkErrors {
+			ls.Results.SkippedFileErrCount++
+			if ls.Options.DebugLevel > 0 {
+				log.Printf("\r%v  Skipping...", statErr)
+			}
+			return nil
+		} else {
+			return statErr
+		}
+	}
+
+	// Ignore files with setuid/setgid bits.  Linking them could
+	// have security implications.
+	if di.Mode&os.ModeSetuid != 0 {
+		ls.Results.foundSetuidFile()
+		ls.observer.FileRejected(pathname, RejectSetuid)
+		return nil
+	}
+	if di.Mode&os.ModeSetgid != 0 {
+		ls.Results.foundSetgidFile()
+		ls.observer.FileRejected(pathname, RejectSetgid)
+		return nil
+	}
+
+	// Also exclude files with any other non-perm mode bits set
+	if di.Mode != (di.Mode & os.ModePerm) {
+		ls.Results.foundNonPermBitFile()
+		ls.observer.FileRejected(pathname, RejectNonPermBits)
+		return nil
+	}
+
+	// Ensure the files fall within the allowed Size range
+	pp := ls.policy.forPath(pathname)
+	if di.Size < pp.minFileSize {
+		ls.Results.foundFileTooSmall()
+		ls.observer.FileRejected(pathname, RejectTooSmall)
+		return nil
+	}
+	if pp.maxFileSize > 0 &&
+		di.Size > pp.maxFileSize {
+		ls.Results.foundFileTooLarge()
+		ls.observer.FileRejected(pathname, RejectTooLarge)
+		return nil
+	}
+	// If the file hasn't been rejected by this
+	// point, add it to the found count
+	ls.Results.foundFile()
+	ls.observer.FileAccepted(pathname, di.Size)
+
+	fsdev := ls.dev(di, pathname)
+	if cached != nil && cached.HasDigest {
+		fsdev.InoDigests.Add(inode.PathInfo{StatInfo: di.StatInfo}, cached.Digest)
+	}
+	cmpErr := fsdev.FindIdenticalFiles(di, pathname)
+	if err := ls.ctx.Err(); err != nil {
+		return err
+	}
+	if cmpErr != nil {
+		ls.Results.addError(errOp(cmpErr, OpRead), pathname, cmpErr)
+		if ls.Options.IgnoreWalkErrors {
+			ls.Results.SkippedFileErrCount++
+			if ls.Options.DebugLevel > 0 {
+				log.Printf("\r%v  Skipping...", cmpErr)
+			}
+		} else {
+			return cmpErr
+		}
+	}
+	return nil
+}
@@ -29,7 +29,7 @@ import (
 	"syscall"
 	"testing"
 
-	"github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 func inoVal(pathname string) uint64 {
@@ -56,7 +56,7 @@ func TestMaxNlinks(t *testing.T) {
 	m := pathContents{"f1": "X"}
 	simpleFileMaker(t, m)
 
-	N := inode.MaxNlinkVal("f1")
+	N := vfs.OS.MaxNlink("f1")
 	if N > (1<<15 - 1) {
 		t.Skip("Skipping MaxNlink test because Nlink max is greater than 32767")
 	}
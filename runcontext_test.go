@@ -0,0 +1,165 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// checkGoroutines fails the test if the number of goroutines is more than the
+// given count (ie. a stopped Run left goroutines running)
+func checkGoroutines(name string, t *testing.T, want int) {
+	if n := runtime.NumGoroutine(); n > want {
+		t.Errorf("%v: Expected %v goroutines, got: %v", name, want, n)
+	}
+}
+
+// cancelObserver cancels the Run when the given dir is entered
+type cancelObserver struct {
+	NopObserver
+	dir    string
+	cancel context.CancelFunc
+}
+
+func (o cancelObserver) DirEntered(pathname string) {
+	if pathname == o.dir {
+		o.cancel()
+	}
+}
+
+func TestRunContextCancelled(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	name := "testname: 'RunContext cancelled'"
+
+	m := pathContents{"a/f1": "X", "a/f2": "X", "b/f3": "X"}
+	simpleFileMaker(t, m)
+
+	numGoroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := RunContext(ctx, []string{"."}, SetupOptions(LinkingEnabled))
+	if err != context.Canceled {
+		t.Errorf("%v: Expected context.Canceled error, got: %v", name, err)
+	}
+	if result.Phase != WalkPhase || result.RunSuccessful {
+		t.Errorf("%v: Expected unsuccessful run stopped in walk phase, got: %v %v",
+			name, result.Phase, result.RunSuccessful)
+	}
+	if result.EndTime.IsZero() {
+		t.Errorf("%v: Expected partial Results to be completed", name)
+	}
+	checkGoroutines(name, t, numGoroutines)
+	verifyContents(name, t, m)
+}
+
+func TestRunContextCancelledWalk(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	name := "testname: 'RunContext cancelled during walk'"
+
+	m := pathContents{}
+	for _, d := range []string{"a", "b", "c", "d", "e"} {
+		for _, f := range []string{"f1", "f2", "f3"} {
+			m[d+"/"+f] = "X"
+		}
+	}
+	simpleFileMaker(t, m)
+
+	// The walk goroutine must be finished when RunContext returns, or it
+	// races with the copying of the Results (with -race)
+	for i := 0; i < 20; i++ {
+		numGoroutines := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		opts := SetupOptions()
+		opts.Observer = cancelObserver{dir: "a", cancel: cancel}
+		result, err := RunContext(ctx, []string{"."}, opts)
+		if err != context.Canceled || result.Phase != WalkPhase {
+			t.Fatalf("%v: Expected a cancelled walk, got: %v %v", name, err, result.Phase)
+		}
+		checkGoroutines(name, t, numGoroutines)
+	}
+}
+
+func TestGenerateLinksCancelled(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	name := "testname: 'Link generation cancelled'"
+
+	m := pathContents{"f1": "X", "f2": "X", "f3": "X", "g1": "Y", "g2": "Y"}
+	simpleFileMaker(t, m)
+
+	numGoroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := SetupOptions(LinkingEnabled)
+	ls := newLinkableState(&opts)
+	ls.ctx = ctx
+	for pathname := range m {
+		di, err := inode.LStatInfo(vfs.OS, pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsdev := ls.dev(di, pathname)
+		if err := fsdev.FindIdenticalFiles(di, pathname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	for _, fsdev := range ls.fsDevs {
+		if err := fsdev.generateLinks(); err != context.Canceled {
+			t.Errorf("%v: Expected context.Canceled error, got: %v", name, err)
+		}
+	}
+	if ls.Results.NewLinkCount != 0 {
+		t.Errorf("%v: Expected no links after cancel, got: %v", name, ls.Results.NewLinkCount)
+	}
+	checkGoroutines(name, t, numGoroutines)
+	verifyContents(name, t, m)
+	for pathname := range m {
+		if n := nlinkVal(pathname); n != 1 {
+			t.Errorf("%v: Expected nlink 1 for %v, got: %v", name, pathname, n)
+		}
+	}
+}
+
+func TestFileContentsEqualCancelled(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	simpleFileMaker(t, pathContents{"f1": "X", "f2": "X"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ls := newLinkableState(&Options{})
+	ls.ctx = ctx
+	cancel()
+	if _, err := areFileContentsEqual(ls.status, "f1", "f2"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled error, got: %v", err)
+	}
+}
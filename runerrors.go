@@ -0,0 +1,110 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/xattr"
+)
+
+// The operations that can be recorded in a RunError
+const (
+	OpWalk       = "walk"
+	OpStat       = "stat"
+	OpOpen       = "open"
+	OpRead       = "read"
+	OpXAttr      = "xattr"
+	OpLink       = "link"
+	OpRename     = "rename"
+	OpChtimes    = "chtimes"
+	OpChown      = "chown"
+	OpCheckpoint = "checkpoint"
+)
+
+// RunError records a single error that was encountered during the Run(),
+// including the pathname, the attempted operation, and the phase of the Run
+// in which it occurred.  Errno is zero if the underlying error wasn't a
+// syscall error.
+type RunError struct {
+	Path  string    `json:"path"`
+	Op    string    `json:"op"`
+	Phase RunPhases `json:"phase"`
+	Errno int       `json:"errno"`
+	Err   string    `json:"error"`
+}
+
+// errInfo unwraps the given error to find the pathname, operation and errno
+// that caused it.  The given pathname is returned if the error doesn't carry
+// its own, and op is empty if the operation couldn't be determined.
+func errInfo(err error, pathname string) (string, string, syscall.Errno) {
+	var op string
+	for err != nil {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return pathname, op, e
+		case *os.PathError:
+			pathname, op = e.Path, pathErrOp(e.Op)
+			err = e.Err
+		case *os.LinkError:
+			// Keep the given pathname, since Old or New may be a
+			// temporary name
+			op = pathErrOp(e.Op)
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *xattr.Error:
+			pathname, op = e.Path, OpXAttr
+			err = e.Err
+		case interface{ Cause() error }: // github.com/pkg/errors
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return pathname, op, 0
+		}
+	}
+	return pathname, op, 0
+}
+
+// errOp returns the operation that caused the error, or defaultOp if it can't
+// be determined.
+func errOp(err error, defaultOp string) string {
+	if _, op, _ := errInfo(err, ""); op != "" {
+		return op
+	}
+	return defaultOp
+}
+
+// pathErrOp converts the Op of an os.PathError or os.LinkError to one of our
+// Op constants, or returns an empty string if it isn't a known operation.
+func pathErrOp(op string) string {
+	switch op {
+	case "open", "read", "link", "rename", "chtimes":
+		return op
+	case "lstat", "stat":
+		return OpStat
+	case "lchown", "chown":
+		return OpChown
+	}
+	return ""
+}
@@ -79,14 +79,22 @@ func appendReversedInos(toS []I.Ino, fromS ...I.Ino) []I.Ino {
 // (until the maximum nlink count is reached, at which point it proceeds to the
 // src inode with the next highest nlink count).
 func (f *fsDev) generateLinks() error {
-	for linkableSet := range f.LinkableInos.All() {
+	for linkableSet := range f.LinkableInos.All(f.ctx.Done()) {
 		// Sort links highest nlink to lowest
 		sortedInos := f.sortSetByNlink(linkableSet)
+		if f.plan != nil {
+			f.plan.addGroup(f, sortedInos)
+		}
 		if err := f.genLinksHelper(sortedInos); err != nil {
 			return err
 		}
+		if f.ckpt != nil {
+			if err := f.ckpt.linkSetDone(f.Dev, linkableSet); err != nil {
+				return err
+			}
+		}
 	}
-	return nil
+	return f.ctx.Err() // All() stops early when cancelled
 }
 
 // genLinksHelper operates on the set of matching inodes, sorted from highest
@@ -99,6 +107,13 @@ func (f *fsDev) generateLinks() error {
 func (f *fsDev) genLinksHelper(sortedInos []I.Ino) error {
 	remainingInos := make([]I.Ino, 0)
 
+	// With PolicyRules, the policies of the inodes are cached while
+	// linking the group
+	var lp *linkPolicies
+	if f.policy.hasRules() {
+		lp = newLinkPolicies()
+	}
+
 	// The remainingInos are the inodes at the far end of the sorted inode
 	// list, which were skipped over on a previous linking pass because
 	// of a restriction such as the optional "same name" linking
@@ -135,10 +150,14 @@ func (f *fsDev) genLinksHelper(sortedInos []I.Ino) error {
 			// linking to it, using the pathnames for linking,
 			// while respecting both the SameName option and the
 			// maximum src inode nlink count.
-			dstPaths := f.InoPaths.AllPaths(dstIno)
+			dstPaths := f.InoPaths.AllPaths(dstIno, f.ctx.Done())
 			for dstPath := range dstPaths {
+				// Stop between links when cancelled
+				if err := f.ctx.Err(); err != nil {
+					return err
+				}
 				var srcPath P.Pathsplit
-				if f.Options.SameName {
+				if f.Options.SameName && !f.policy.hasRules() {
 					// Skip to next destination inode path if dst filename
 					// isn't also found as a src filename
 					srcPaths := f.InoPaths[srcIno]
@@ -147,50 +166,35 @@ func (f *fsDev) genLinksHelper(sortedInos []I.Ino) error {
 						continue
 					}
 					srcPath = f.InoPaths.ArbitraryFilenamePath(srcIno, dstFilename)
+				} else if f.policy.hasRules() && f.InoPaths[srcIno].HasFilename(dstPath.Filename) {
+					// A src path with the same filename may be
+					// required by the policy of the paths
+					srcPath = f.InoPaths.ArbitraryFilenamePath(srcIno, dstPath.Filename)
 				} else {
 					srcPath = f.InoPaths.ArbitraryPath(srcIno)
 				}
 				srcPathInfo := I.PathInfo{Pathsplit: srcPath, StatInfo: *srcSI}
 				dstPathInfo := I.PathInfo{Pathsplit: dstPath, StatInfo: *dstSI}
 
-				// Abort if the filesystem is found to be "active" (ie. changing)
-				if f.Options.CheckQuiescence || f.Options.LinkingEnabled {
-					modifiedErr := f.haveNotBeenModified(srcPathInfo, dstPathInfo)
-					if modifiedErr != nil {
-						return modifiedErr
-					}
+				// The link group can join inodes that the policies of
+				// these two paths don't allow to be linked
+				if lp != nil && !f.policyAllowsLink(lp, srcPathInfo, dstPathInfo) {
+					f.Results.PolicySkippedLinkCount++
+					continue
 				}
 
-				// Perform the actual linking if requested, but abort all remaining
-				// linking if a linking error is encountered.
-				var linkingErr error
-				if f.Options.LinkingEnabled {
-					linkingErr = f.hardlinkFiles(srcPathInfo, dstPathInfo)
-					if linkingErr != nil {
-						if !f.Options.IgnoreLinkErrors {
-							return linkingErr
-						} else if f.Options.DebugLevel > 0 {
-							log.Printf("\r%v  Skipping...", linkingErr)
-						}
-					}
+				if err := f.linkPaths(srcPath, dstPath, srcSI, dstSI); err != nil {
+					return err
 				}
-
-				if linkingErr != nil {
-					f.Results.skippedNewLink(srcPath, dstPath)
-				} else {
-					f.Results.foundNewLink(srcPath, dstPath)
-
-					// Update cached StatInfo information for inodes
-					srcSI.Nlink++
-					dstSI.Nlink--
-					if dstSI.Nlink == 0 {
-						f.Results.foundRemovedInode(dstSI.Size)
-						delete(f.inoStatInfo, dstIno)
-					}
-					f.InoPaths.MovePath(dstPath, srcIno, dstIno)
+				if lp != nil && f.InoPaths.HasPath(srcIno, dstPath) {
+					f.movedPath(lp, dstPath, srcIno, dstIno)
 				}
 			}
-			// With SameName option, it's possible that the dstIno nLinks will not go
+			// AllPaths() stops early when cancelled
+			if err := f.ctx.Err(); err != nil {
+				return err
+			}
+			// With SameName option (or PolicyRules), it's possible that the dstIno nLinks will not go
 			// to zero (if not all links have a matching filename), so place on the
 			// remainingInos list to allow it to (possibly) be linked with other inodes
 			fp, ok := f.InoPaths[dstIno]
@@ -201,3 +205,80 @@ func (f *fsDev) genLinksHelper(sortedInos []I.Ino) error {
 	}
 	return nil
 }
+
+// linkPaths links the dst path to the src inode (when LinkingEnabled), after
+// checking that neither has been modified since they were indexed, and
+// updates the indexes and Results.  Nil is returned for links that are
+// skipped or vetoed, and for link errors when IgnoreLinkErrors is set.
+func (f *fsDev) linkPaths(srcPath, dstPath P.Pathsplit, srcSI, dstSI *I.StatInfo) error {
+	src := I.PathInfo{Pathsplit: srcPath, StatInfo: *srcSI}
+	dst := I.PathInfo{Pathsplit: dstPath, StatInfo: *dstSI}
+	srcIno, dstIno := srcSI.Ino, dstSI.Ino
+
+	// Abort if the filesystem is found to be "active" (ie. changing)
+	if f.Options.CheckQuiescence || f.Options.LinkingEnabled {
+		modifiedErr := f.haveNotBeenModified(src, dst)
+		if modifiedErr != nil && f.scan != nil &&
+			(f.scan.isCached(srcPath) || f.scan.isCached(dstPath)) {
+			// Files reused from the StateFile can be stale, so
+			// the link is skipped, and they're statted next time
+			f.Results.addError(OpLink, dstPath.Join(), modifiedErr)
+			f.Results.skippedNewLink(srcPath, dstPath)
+			f.scan.markStale(srcPath.Join())
+			f.scan.markStale(dstPath.Join())
+			return nil
+		}
+		if modifiedErr != nil {
+			return modifiedErr
+		}
+	}
+
+	// The observer can veto the link, leaving the dst path
+	// on its inode
+	if !f.observer.LinkPlanned(srcPath.Join(), dstPath.Join(), dstSI.Size) {
+		f.Results.VetoedLinkCount++
+		return nil
+	}
+
+	// Perform the actual linking if requested, but abort all remaining
+	// linking if a linking error is encountered.
+	var linkingErr error
+	if f.Options.LinkingEnabled {
+		linkingErr = f.hardlinkFiles(src, dst)
+	}
+
+	// The link is exported even when its error stops the linking
+	if f.sqlite != nil {
+		linked := f.Options.LinkingEnabled && linkingErr == nil
+		f.sqlite.addLink(f.Dev, srcPath, dstPath, dstSI.Size, linked, linkingErr != nil)
+	}
+	if linkingErr != nil {
+		f.Results.addError(errOp(linkingErr, OpLink), dstPath.Join(), linkingErr)
+		if !f.Options.IgnoreLinkErrors {
+			f.observer.LinkDone(srcPath.Join(), dstPath.Join(), dstSI.Size, linkingErr)
+			return linkingErr
+		} else if f.Options.DebugLevel > 0 {
+			log.Printf("\r%v  Skipping...", linkingErr)
+		}
+	}
+
+	if linkingErr != nil {
+		f.Results.skippedNewLink(srcPath, dstPath)
+	} else {
+		f.Results.foundNewLink(f.Dev, srcPath, dstPath, dstSI.Size)
+		if f.plan != nil {
+			f.plan.addLink(srcPath, dstPath, dstSI.Size)
+		}
+
+		// Update cached StatInfo information for inodes
+		srcSI.Nlink++
+		dstSI.Nlink--
+		if dstSI.Nlink == 0 {
+			f.Results.foundRemovedInode(f.Dev, dstPath, srcSI, dstSI)
+			delete(f.inoStatInfo, dstIno)
+		}
+		f.InoPaths.MovePath(dstPath, srcIno, dstIno)
+	}
+	f.observer.LinkDone(srcPath.Join(), dstPath.Join(), dstSI.Size, linkingErr)
+	return nil
+}
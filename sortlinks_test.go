@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 type byIno []I.Ino
@@ -45,7 +46,7 @@ func setupInoStatInfo(fsdev *fsDev, inoSet I.Set) {
 	fsdev.inoStatInfo = make(I.InoStatInfo)
 	for ino := range inoSet {
 		// Using any old StatInfo is fine
-		di, _ := I.LStatInfo(".")
+		di, _ := I.LStatInfo(vfs.OS, ".")
 		// Deliberately make it so that if Nlinks are sorted, Inos are
 		// sorted also (for easier testing of []I.Ino result)
 		di.Nlink = uint64(ino)*2 + 100
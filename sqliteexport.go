@@ -0,0 +1,210 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+)
+
+// SQLiteDriver is the name of the database/sql driver used to write the
+// SQLiteFile.  The library doesn't import a driver itself (go-sqlite3 requires
+// cgo), so programs that export to SQLite must import one that registers
+// this name, ie. github.com/mattn/go-sqlite3.
+const SQLiteDriver = "sqlite3"
+
+const sqliteSchema = `PRAGMA journal_mode = OFF;
+PRAGMA synchronous = OFF;
+CREATE TABLE devices (dev INTEGER PRIMARY KEY, max_nlinks INTEGER);
+CREATE TABLE inodes (dev INTEGER, ino INTEGER, size INTEGER, nlink INTEGER,
+	uid INTEGER, gid INTEGER, perm INTEGER, mode TEXT, mtime_ns INTEGER,
+	digest INTEGER, PRIMARY KEY (dev, ino));
+CREATE TABLE paths (dev INTEGER, ino INTEGER, path TEXT);
+CREATE TABLE duplicate_groups (group_id INTEGER, dev INTEGER, ino INTEGER);
+CREATE TABLE links (seq INTEGER PRIMARY KEY, dev INTEGER, src_path TEXT,
+	dst_path TEXT, size INTEGER, linked INTEGER, failed INTEGER);
+CREATE TABLE errors (path TEXT, op TEXT, phase TEXT, errno INTEGER, error TEXT);
+`
+
+const sqliteIndexes = `CREATE INDEX paths_ino ON paths (dev, ino);
+CREATE INDEX paths_path ON paths (path);
+CREATE INDEX duplicate_groups_ino ON duplicate_groups (dev, ino);
+`
+
+// sqliteExport writes the scan data to a SQLite database, in a single
+// transaction.  The database is built in a temporary file which is renamed
+// to the requested pathname when complete.
+type sqliteExport struct {
+	pathname string
+	tmpname  string
+	db       *sql.DB
+	tx       *sql.Tx
+	err      error // The first failed insert, returned by end()
+	groupID  int64
+	linkSeq  int64
+}
+
+// sqliteDriverRegistered returns true if the program imported a driver for
+// the SQLite export
+func sqliteDriverRegistered() bool {
+	for _, name := range sql.Drivers() {
+		if name == SQLiteDriver {
+			return true
+		}
+	}
+	return false
+}
+
+func newSQLiteExport(pathname string) *sqliteExport {
+	return &sqliteExport{pathname: pathname}
+}
+
+// begin creates the temporary database, and its tables
+func (e *sqliteExport) begin() error {
+	dir, base := filepath.Split(e.pathname)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	e.tmpname = f.Name()
+	err = f.Chmod(0644) // TempFile creates the file readable only by the owner
+	f.Close()           // An empty file is an empty database
+	if err == nil {
+		err = e.open()
+	}
+	if err != nil {
+		e.abort()
+		return fmt.Errorf("SQLite export failed: %v", err)
+	}
+	return nil
+}
+
+func (e *sqliteExport) open() error {
+	db, err := sql.Open(SQLiteDriver, e.tmpname)
+	if err != nil {
+		return err
+	}
+	e.db = db
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	e.tx, err = db.Begin()
+	return err
+}
+
+// abort closes the database, and removes the temporary file
+func (e *sqliteExport) abort() {
+	if e.tx != nil {
+		e.tx.Rollback()
+	}
+	if e.db != nil {
+		e.db.Close()
+	}
+	os.Remove(e.tmpname)
+	e.tx, e.db = nil, nil
+}
+
+// insert adds a row to the table, remembering the first error
+func (e *sqliteExport) insert(table string, values ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	q := "INSERT INTO " + table + " VALUES (?" + strings.Repeat(", ?", len(values)-1) + ")"
+	_, e.err = e.tx.Exec(q, values...)
+}
+
+// addDevice exports the inodes, paths and duplicate groups of the fsDev.  It
+// must be called after the walk, before the link phase modifies them.
+func (e *sqliteExport) addDevice(f *fsDev) {
+	// SQLite integers are signed, and database/sql doesn't accept uint64
+	// values with the high bit set, so they're stored as int64
+	dev := int64(f.Dev)
+	e.insert("devices", dev, int64(f.MaxNLinks))
+
+	inos := make([]I.Ino, 0, len(f.inoStatInfo))
+	for ino := range f.inoStatInfo {
+		inos = append(inos, ino)
+	}
+	sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+	for _, ino := range inos {
+		si := f.inoStatInfo[ino]
+		var digest interface{} // NULL when not computed
+		if d, ok := f.InoDigests.Get(ino); ok {
+			digest = int64(d)
+		}
+		e.insert("inodes", dev, int64(ino), int64(si.Size), int64(si.Nlink), si.Uid, si.Gid,
+			uint32(si.Mode.Perm()), si.Mode.String(), si.Mtim.UnixNano(), digest)
+		for _, p := range f.InoPaths[ino].PathsAsSlice() {
+			e.insert("paths", dev, int64(ino), p.Join())
+		}
+	}
+
+	for linkableSet := range f.LinkableInos.All(f.ctx.Done()) {
+		e.groupID++
+		for _, ino := range linkableSet.AsSlice() {
+			e.insert("duplicate_groups", e.groupID, dev, int64(ino))
+		}
+	}
+}
+
+// addLink exports a planned (or performed) link of dst to src
+func (e *sqliteExport) addLink(dev uint64, src, dst P.Pathsplit, size uint64, linked, failed bool) {
+	e.linkSeq++
+	e.insert("links", e.linkSeq, int64(dev), src.Join(), dst.Join(), int64(size), linked, failed)
+}
+
+// end exports the Results errors, and completes the database
+func (e *sqliteExport) end(r *Results) error {
+	if e.tx == nil {
+		return nil // Never began
+	}
+	for _, re := range r.Errors {
+		e.insert("errors", re.Path, re.Op, re.Phase.String(), re.Errno, re.Err)
+	}
+	err := e.err
+	if err == nil {
+		_, err = e.tx.Exec(sqliteIndexes)
+	}
+	if err == nil {
+		err = e.tx.Commit()
+		e.tx = nil
+	}
+	if err == nil {
+		err = e.db.Close()
+		e.db = nil
+	}
+	if err != nil {
+		e.abort()
+		return fmt.Errorf("SQLite export failed: %v", err)
+	}
+	return os.Rename(e.tmpname, e.pathname)
+}
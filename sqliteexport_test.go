@@ -0,0 +1,117 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// +build cgo
+
+package hardlinkable
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3" // Registers the SQLiteDriver
+)
+
+// querySQLite returns the result of a query with a single value
+func querySQLite(t *testing.T, dbname, query string) interface{} {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var v interface{}
+	if err := db.QueryRow(query).Scan(&v); err != nil {
+		t.Fatalf("Query %q failed: %v", query, err)
+	}
+	return v
+}
+
+func TestRunSQLiteExport(t *testing.T) {
+	topdir := setUp("Run", t)
+	defer os.RemoveAll(topdir)
+
+	dbname := filepath.Join(topdir, "scan.db")
+	opts := SetupOptions(ExportSQLite(dbname), LinkingEnabled)
+
+	name := "testname: 'SQLite export'"
+
+	m := pathContents{"a/f1": "X", "a/f2": "X", "b/it's": "X", "b/new\nline": "Z", "b/g1": "YY"}
+	simpleFileMaker(t, m)
+	simpleLinkMaker(t, "b/g1", "b/g2")
+	simpleRun(name, t, opts, 1, "a", "b")
+
+	tests := []struct {
+		query string
+		want  interface{}
+	}{
+		{"SELECT count(*) FROM devices", int64(1)},
+		{"SELECT count(*) FROM inodes", int64(5)},
+		{"SELECT count(*) FROM paths", int64(6)},
+		{"SELECT nlink FROM inodes JOIN paths USING (dev, ino) WHERE path = 'b/g2'", int64(2)},
+		{"SELECT count(*) FROM duplicate_groups", int64(3)},
+		{"SELECT count(DISTINCT group_id) FROM duplicate_groups", int64(1)},
+		{"SELECT count(*) FROM links WHERE linked = 1 AND failed = 0", int64(2)},
+		{"SELECT count(*) FROM paths WHERE path = 'b/it''s'", int64(1)},
+		{"SELECT count(*) FROM paths WHERE path = 'b/new' || char(10) || 'line'", int64(1)},
+		{"SELECT count(*) FROM errors", int64(0)},
+	}
+	for _, tc := range tests {
+		if got := querySQLite(t, dbname, tc.query); got != tc.want {
+			t.Errorf("%v: %q expected: %v, got: %v", name, tc.query, tc.want, got)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(topdir, ".scan.db.tmp*"))
+	if len(matches) > 0 {
+		t.Errorf("%v: Temporary database left behind: %v", name, matches)
+	}
+}
+
+// TestSQLiteExportFailedLink checks that a link whose error stops the run is
+// exported, along with its error
+func TestSQLiteExportFailedLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hardlinkable-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbname := filepath.Join(dir, "scan.db")
+
+	m := newFaultMemFS(t)
+	fsys := &faultFS{FS: m, faults: []*fault{{op: OpLink, path: "a/g1", errno: syscall.EACCES}}}
+	opts := SetupOptions(ExportSQLite(dbname), LinkingEnabled)
+	opts.FS = fsys
+	if _, err := Run([]string{"a", "b"}, opts); err == nil {
+		t.Fatalf("Expected the link error to stop the run")
+	}
+
+	failed := "SELECT count(*) FROM links WHERE linked = 0 AND failed = 1 AND src_path = 'a/g1'"
+	if got := querySQLite(t, dbname, failed); got != int64(1) {
+		t.Errorf("Expected the failed link to be exported, got %v", got)
+	}
+	errors := "SELECT count(*) FROM errors WHERE op = 'link'"
+	if got := querySQLite(t, dbname, errors); got != int64(1) {
+		t.Errorf("Expected the link error to be exported, got %v", got)
+	}
+}
@@ -21,8 +21,11 @@
 package hardlinkable
 
 import (
+	"context"
+
 	"github.com/chadnetzer/hardlinkable/internal/inode"
 	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 const maxCmpBufSize = 8 * minCmpBufSize // Power of two multiplier
@@ -30,13 +33,20 @@ const minCmpBufSize = 4096
 const digestBufSize = 4096
 
 type status struct {
+	ctx       context.Context
+	fsys      vfs.FS
 	Options   *Options
 	Results   *Results
-	Progress  progress
+	observer  observers
 	cmpBuf1   []byte
 	cmpBuf2   []byte
 	digestBuf []byte
 	pool      *P.StringPool
+	sqlite    *sqliteExport
+	scan      *scanCache
+	ckpt      *checkpointer
+	policy    *policy
+	plan      *Plan // Recorded by Scan
 }
 
 type linkableState struct {
@@ -45,24 +55,45 @@ type linkableState struct {
 }
 
 func newLinkableState(opts *Options) *linkableState {
-	return &linkableState{
+	ls := linkableState{
 		status: status{
+			ctx:       context.Background(),
+			fsys:      opts.FS,
 			Options:   opts,
 			Results:   newResults(opts),
 			cmpBuf1:   make([]byte, minCmpBufSize, maxCmpBufSize),
 			cmpBuf2:   make([]byte, minCmpBufSize, maxCmpBufSize),
 			digestBuf: make([]byte, digestBufSize),
 			pool:      P.NewPool(),
+			observer:  newObservers(opts.Observer),
+			policy:    newPolicy(opts),
 		},
 		fsDevs: make(map[uint64]fsDev),
 	}
+	if ls.fsys == nil {
+		ls.fsys = vfs.OS
+	}
+	if opts.StateFile != "" {
+		ls.scan = newScanCache(ls.fsys, opts.StateFile, ls.Results)
+	}
+	if opts.SQLiteFile != "" {
+		ls.sqlite = newSQLiteExport(opts.SQLiteFile)
+	}
+	return &ls
+}
+
+// setPhase moves the Results to the next phase, and notifies the observers
+func (ls *linkableState) setPhase(p RunPhases) {
+	ls.Results.setPhase(p)
+	ls.observer.PhaseChanged(p)
 }
 
 func (ls *linkableState) dev(di inode.DevStatInfo, pathname string) fsDev {
 	if fsdev, ok := ls.fsDevs[di.Dev]; ok {
 		return fsdev
 	}
-	fsdev := newFSDev(ls.status, di.Dev, inode.MaxNlinkVal(pathname))
+	fsdev := newFSDev(ls.status, di.Dev, ls.fsys.MaxNlink(pathname))
 	ls.fsDevs[di.Dev] = fsdev
+	ls.Results.foundDevice(di.Dev)
 	return fsdev
 }
@@ -0,0 +1,336 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+const stateFileVersion = 1
+
+// scanState is the data saved in the StateFile.  Dirs are keyed by the
+// walked pathname, and Devices holds a dir on each device, which is used to
+// detect devices that were renumbered (ie. after a reboot).
+type scanState struct {
+	Version int
+	Started time.Time
+	Devices map[uint64]string
+	Dirs    map[string]*dirState
+}
+
+type dirState struct {
+	Dev     uint64
+	Ino     uint64
+	Mtime   time.Time
+	Entries map[string]entryState
+}
+
+// entryState holds the dirent type, and the stat info of regular files that
+// were indexed by the run.
+type entryState struct {
+	ModeType os.FileMode
+	File     *fileState
+}
+
+type fileState struct {
+	Dev       uint64
+	Nlink     uint64
+	Size      uint64
+	Ino       I.Ino
+	Uid       uint32
+	Gid       uint32
+	Mode      os.FileMode
+	Mtime     time.Time
+	Digest    I.Digest
+	HasDigest bool
+}
+
+func (fs *fileState) devStatInfo() I.DevStatInfo {
+	return I.DevStatInfo{
+		Dev: fs.Dev,
+		StatInfo: I.StatInfo{
+			Size:  fs.Size,
+			Ino:   fs.Ino,
+			Nlink: fs.Nlink,
+			Uid:   fs.Uid,
+			Gid:   fs.Gid,
+			Mode:  fs.Mode,
+			Mtim:  fs.Mtime,
+		},
+	}
+}
+
+// scanCache reuses the dir entries and file stat info from the previous
+// run's StateFile (for dirs that are unchanged), and gathers the state to
+// be saved for the next run.
+type scanCache struct {
+	pathname string
+	prev     *scanState // nil if there is no usable previous state
+	next     *scanState
+	reused   map[string]*dirState // Unchanged dirs from prev
+	stale    map[string]struct{}  // Reused files found to be modified
+}
+
+// newScanCache loads the previous state, if any, and records whether it
+// could be used in the Results.  An unusable state file isn't an error; all
+// the dirs are just walked again.
+func newScanCache(fsys vfs.FS, pathname string, r *Results) *scanCache {
+	sc := &scanCache{
+		pathname: pathname,
+		next: &scanState{
+			Version: stateFileVersion,
+			Started: time.Now(),
+			Devices: make(map[uint64]string),
+			Dirs:    make(map[string]*dirState),
+		},
+		reused: make(map[string]*dirState),
+		stale:  make(map[string]struct{}),
+	}
+	prev, err := loadScanState(pathname)
+	switch {
+	case os.IsNotExist(err):
+		r.StateFileStatus = "created"
+	case err != nil:
+		r.StateFileStatus = "discarded (" + err.Error() + ")"
+	case !devicesUnchanged(fsys, prev):
+		r.StateFileStatus = "discarded (devices have changed)"
+	default:
+		r.StateFileStatus = "loaded"
+		sc.prev = prev
+	}
+	return sc
+}
+
+func loadScanState(pathname string) (*scanState, error) {
+	var s scanState
+	if err := loadGob(pathname, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != stateFileVersion {
+		return nil, fmt.Errorf("version %d", s.Version)
+	}
+	return &s, nil
+}
+
+// devicesUnchanged returns true if the recorded dir on each device still has
+// the same device and inode numbers.  Otherwise the cached stat info can't be
+// trusted, since (for example) the device numbers may have been reassigned.
+func devicesUnchanged(fsys vfs.FS, s *scanState) bool {
+	for dev, dirname := range s.Devices {
+		d, ok := s.Dirs[dirname]
+		if !ok {
+			return false
+		}
+		fi, err := fsys.Lstat(dirname)
+		if err != nil {
+			return false
+		}
+		st, ok := vfs.StatOf(fi)
+		if !ok || st.Dev != dev || st.Ino != d.Ino {
+			return false
+		}
+	}
+	return true
+}
+
+// readDir is used by the walk instead of vfs.FS.ReadDir.  The entries of a
+// dir that is unchanged since the previous run (ie. same device, inode and
+// mtime) are returned from the saved state.
+func (sc *scanCache) readDir(fsys vfs.FS, dirname string, r *Results) ([]vfs.Dirent, error) {
+	fi, err := fsys.Lstat(dirname)
+	if err != nil {
+		return nil, err
+	}
+	st, _ := vfs.StatOf(fi)
+	mtime := fi.ModTime()
+
+	// A dir modified while the previous run was reading it could have
+	// an unchanged mtime, so those aren't trusted.
+	if sc.prev != nil {
+		d, ok := sc.prev.Dirs[dirname]
+		if ok && d.Dev == st.Dev && d.Ino == st.Ino && d.Mtime.Equal(mtime) &&
+			mtime.Before(sc.prev.Started) {
+			sc.reused[dirname] = d
+			sc.next.Dirs[dirname] = d
+			r.CachedDirCount++ // Only updated in the walk goroutine
+			return d.dirents(), nil
+		}
+	}
+
+	dirents, err := fsys.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	d := &dirState{Dev: st.Dev, Ino: st.Ino, Mtime: mtime,
+		Entries: make(map[string]entryState, len(dirents))}
+	for _, de := range dirents {
+		d.Entries[de.Name] = entryState{ModeType: de.ModeType}
+	}
+	sc.next.Dirs[dirname] = d
+	return dirents, nil
+}
+
+func (d *dirState) dirents() []vfs.Dirent {
+	dirents := make([]vfs.Dirent, 0, len(d.Entries))
+	for name, e := range d.Entries {
+		dirents = append(dirents, vfs.Dirent{Name: name, ModeType: e.ModeType})
+	}
+	sort.Slice(dirents, func(i, j int) bool { return dirents[i].Name < dirents[j].Name })
+	return dirents
+}
+
+// cachedFile returns the saved stat info for a file in an unchanged dir, or
+// nil if it must be statted.
+func (sc *scanCache) cachedFile(dirname, name string) *fileState {
+	if d, ok := sc.reused[dirname]; ok {
+		return d.Entries[name].File
+	}
+	return nil
+}
+
+// isCached returns true if the stat info of the pathname was reused from the
+// previous state, rather than statted during this run
+func (sc *scanCache) isCached(ps P.Pathsplit) bool {
+	pathname := ps.Join()
+	return sc.cachedFile(filepath.Dir(pathname), filepath.Base(pathname)) != nil
+}
+
+// markStale prevents the stat info of a reused file that was found to be
+// modified from being saved again
+func (sc *scanCache) markStale(pathname string) {
+	sc.stale[pathname] = struct{}{}
+}
+
+// record stores the current stat info of the indexed files in the state
+// to be saved, replacing any previously recorded.
+func (sc *scanCache) record(fsDevs map[uint64]fsDev) {
+	s := sc.next
+	for _, d := range s.Dirs {
+		for name, e := range d.Entries {
+			if e.File != nil {
+				d.Entries[name] = entryState{ModeType: e.ModeType}
+			}
+		}
+	}
+	for dev, fsdev := range fsDevs {
+		for ino, fp := range fsdev.InoPaths {
+			si, ok := fsdev.inoStatInfo[ino]
+			if !ok {
+				continue
+			}
+			digest, hasDigest := fsdev.InoDigests.Get(ino)
+			fs := &fileState{
+				Dev: dev, Nlink: si.Nlink, Size: si.Size, Ino: si.Ino,
+				Uid: si.Uid, Gid: si.Gid, Mode: si.Mode, Mtime: si.Mtim,
+				Digest: digest, HasDigest: hasDigest,
+			}
+			for _, ps := range fp.PathsAsSlice() {
+				d, ok := s.Dirs[filepath.Clean(ps.Dirname)]
+				if !ok {
+					continue // Not a walked dir
+				}
+				if _, ok := sc.stale[ps.Join()]; ok {
+					continue
+				}
+				if e, ok := d.Entries[ps.Filename]; ok {
+					d.Entries[ps.Filename] = entryState{ModeType: e.ModeType, File: fs}
+				}
+			}
+		}
+	}
+}
+
+// save writes the walked dirs, and the recorded stat info of the indexed
+// files, to the StateFile.  It is written to a temp file which is renamed
+// over any previous one.
+func (sc *scanCache) save() error {
+	s := sc.next
+	// The shortest walked path on each device is used to detect renumbering
+	for dirname, d := range s.Dirs {
+		if cur, ok := s.Devices[d.Dev]; !ok || len(dirname) < len(cur) ||
+			(len(dirname) == len(cur) && dirname < cur) {
+			s.Devices[d.Dev] = dirname
+		}
+	}
+
+	return saveGob(sc.pathname, s)
+}
+
+// loadGob decodes the gzipped gob file into v
+func loadGob(pathname string, v interface{}) error {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("unreadable: %v", err)
+	}
+	if err := gob.NewDecoder(zr).Decode(v); err != nil {
+		return fmt.Errorf("unreadable: %v", err)
+	}
+	return nil
+}
+
+// saveGob writes v as a gzipped gob file.  It is written to a temp file
+// which is renamed over any previous one, so that a crash while saving
+// leaves the previous file intact.
+func saveGob(pathname string, v interface{}) error {
+	dir, base := filepath.Split(pathname)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+	defer os.Remove(tmpname) // Fails harmlessly after the rename
+
+	w := bufio.NewWriter(f)
+	zw := gzip.NewWriter(w)
+	if err = gob.NewEncoder(zw).Encode(v); err == nil {
+		if err = zw.Close(); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
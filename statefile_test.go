@@ -0,0 +1,208 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// lstatCountFS counts the Lstat calls of regular files
+type lstatCountFS struct {
+	vfs.FS
+	fileLstats int
+}
+
+func (c *lstatCountFS) Lstat(pathname string) (os.FileInfo, error) {
+	fi, err := c.FS.Lstat(pathname)
+	if err == nil && fi.Mode().IsRegular() {
+		c.fileLstats++
+	}
+	return fi, err
+}
+
+func stateRun(t *testing.T, opts Options) (*Results, int) {
+	fsys := &lstatCountFS{FS: vfs.OS}
+	opts.FS = fsys
+	r, err := Run([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return &r, fsys.fileLstats
+}
+
+func TestRunStateFile(t *testing.T) {
+	topdir := setUp("StateFile", t)
+	defer os.RemoveAll(topdir)
+
+	// The state file is kept outside the walked dir
+	stateFile := topdir + ".state"
+	defer os.Remove(stateFile)
+	if err := os.Mkdir("walk", 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir("walk")
+	simpleFileMaker(t, pathContents{"A/f1": "X", "A/f2": "X", "B/g1": "Y", "B/g2": "Y"})
+	opts := SetupOptions(UseStateFile(stateFile))
+
+	r, lstats := stateRun(t, opts)
+	if r.StateFileStatus != "created" || r.CachedDirCount != 0 || r.CachedFileCount != 0 {
+		t.Errorf("First run: status %q, cached dirs %v, files %v",
+			r.StateFileStatus, r.CachedDirCount, r.CachedFileCount)
+	}
+	if r.NewLinkCount != 2 || lstats == 0 {
+		t.Errorf("First run: expected 2 new links and file stats, got %v and %v", r.NewLinkCount, lstats)
+	}
+
+	// Nothing changed, so no files are statted
+	r, lstats = stateRun(t, opts)
+	if r.StateFileStatus != "loaded" || r.CachedDirCount != 3 || r.CachedFileCount != 4 {
+		t.Errorf("Unchanged run: status %q, cached dirs %v, files %v",
+			r.StateFileStatus, r.CachedDirCount, r.CachedFileCount)
+	}
+	if r.NewLinkCount != 2 || lstats != 0 {
+		t.Errorf("Unchanged run: expected 2 new links and no file stats, got %v and %v", r.NewLinkCount, lstats)
+	}
+
+	// A new file changes its dir, which is read again
+	simpleFileMaker(t, pathContents{"B/g3": "Y"})
+	os.Chtimes("B/g3", mustModTime(t, "B/g1"), mustModTime(t, "B/g1"))
+	r, lstats = stateRun(t, opts)
+	if r.CachedDirCount != 2 || r.CachedFileCount != 2 || r.NewLinkCount != 3 || lstats != 3 {
+		t.Errorf("Changed dir run: cached dirs %v, files %v, new links %v, file stats %v",
+			r.CachedDirCount, r.CachedFileCount, r.NewLinkCount, lstats)
+	}
+
+	// A renumbered device discards the state
+	s, err := loadScanState(stateFile)
+	if err != nil {
+		t.Fatalf("Couldn't load state file: %v", err)
+	}
+	for dev, dirname := range s.Devices {
+		delete(s.Devices, dev)
+		s.Devices[dev+1] = dirname
+	}
+	writeScanState(t, stateFile, s)
+	r, _ = stateRun(t, opts)
+	if r.StateFileStatus != "discarded (devices have changed)" || r.CachedDirCount != 0 {
+		t.Errorf("Renumbered run: status %q, cached dirs %v", r.StateFileStatus, r.CachedDirCount)
+	}
+	if r.NewLinkCount != 3 {
+		t.Errorf("Renumbered run: expected 3 new links, got %v", r.NewLinkCount)
+	}
+}
+
+func TestRunStateFileStale(t *testing.T) {
+	topdir := setUp("StateFile", t)
+	defer os.RemoveAll(topdir)
+
+	stateFile := topdir + ".state"
+	defer os.Remove(stateFile)
+	os.Mkdir("walk", 0755)
+	os.Chdir("walk")
+	simpleFileMaker(t, pathContents{"A/f1": "X", "A/f2": "Z"})
+	opts := SetupOptions(LinkingEnabled, IgnoreTime, UseStateFile(stateFile))
+	stateRun(t, opts)
+
+	// Rewriting a file in place doesn't change its dir, so the saved stat
+	// info is stale.  The link is skipped, rather than stopping the run.
+	simpleFileMaker(t, pathContents{"A/f2": "X"})
+	r, _ := stateRun(t, opts)
+	if r.CachedFileCount != 2 || r.NewLinkCount != 0 || r.SkippedLinkErrCount != 1 {
+		t.Errorf("Stale run: cached files %v, new links %v, skipped links %v",
+			r.CachedFileCount, r.NewLinkCount, r.SkippedLinkErrCount)
+	}
+
+	// The stale files are statted on the next run, and linked
+	r, _ = stateRun(t, opts)
+	if r.CachedFileCount != 0 || r.NewLinkCount != 1 {
+		t.Errorf("Next run: cached files %v, new links %v", r.CachedFileCount, r.NewLinkCount)
+	}
+	if nlinkVal("A/f1") != 2 {
+		t.Errorf("A/f1 wasn't linked")
+	}
+}
+
+// touchObserver changes the mtime of a file when the link phase begins
+type touchObserver struct {
+	NopObserver
+	t        *testing.T
+	pathname string
+}
+
+func (o touchObserver) PhaseChanged(phase RunPhases) {
+	if phase == LinkPhase {
+		mtime := mustModTime(o.t, o.pathname).Add(time.Hour)
+		if err := os.Chtimes(o.pathname, mtime, mtime); err != nil {
+			o.t.Fatal(err)
+		}
+	}
+}
+
+func TestRunStateFileModifiedFresh(t *testing.T) {
+	topdir := setUp("StateFile", t)
+	defer os.RemoveAll(topdir)
+
+	stateFile := topdir + ".state"
+	defer os.Remove(stateFile)
+	os.Mkdir("walk", 0755)
+	os.Chdir("walk")
+	simpleFileMaker(t, pathContents{"A/f1": "X", "A/f2": "X"})
+
+	// The files are statted during the run (there is no previous state), so
+	// a modified file still aborts the link phase
+	opts := SetupOptions(LinkingEnabled, UseStateFile(stateFile))
+	opts.Observer = touchObserver{t: t, pathname: "A/f2"}
+	r, err := Run([]string{"."}, opts)
+	if err == nil {
+		t.Fatalf("Expected the modified file to abort the run")
+	}
+	if r.NewLinkCount != 0 || nlinkVal("A/f1") != 1 {
+		t.Errorf("Expected no links, got %v new links", r.NewLinkCount)
+	}
+}
+
+func mustModTime(t *testing.T, pathname string) time.Time {
+	fi, err := os.Lstat(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.ModTime()
+}
+
+func writeScanState(t *testing.T, pathname string, s *scanState) {
+	f, err := os.Create(filepath.Clean(pathname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if err := gob.NewEncoder(zw).Encode(s); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+}
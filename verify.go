@@ -0,0 +1,151 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+// Discrepancy is a difference between the filesystem and the Results of a
+// linking Run
+type Discrepancy struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// VerifyResults checks that the filesystem is in the state claimed by the
+// Results of a linking Run (as read with LoadResultsFile): that each linked
+// dst path shares the inode of its src path, that the removed inodes no longer
+// exist below the Run's roots, and that no temporary link files were left
+// behind.  The relative pathnames of the Results are relative to the current
+// dir.  An error is returned if the Results can't be verified.
+func VerifyResults(r Results) ([]Discrepancy, error) {
+	if !r.Opts.LinkingEnabled {
+		return nil, errors.New("Results are from a run without linking enabled")
+	}
+	if r.NewLinkCount > 0 && len(r.LinkPaths) == 0 {
+		return nil, errors.New("Results don't include the linked paths")
+	}
+	fsys := r.Opts.FS
+	if fsys == nil {
+		fsys = vfs.OS
+	}
+
+	d := []Discrepancy{}
+	dsts := make(map[string]struct{})
+	for _, paths := range r.LinkPaths {
+		src := paths[0]
+		srcDSI, err := I.LStatInfo(fsys, src)
+		if err != nil {
+			d = append(d, Discrepancy{src, err.Error()})
+		}
+		for _, dst := range paths[1:] {
+			dsts[dst] = struct{}{}
+			if err != nil {
+				continue
+			}
+			dstDSI, dstErr := I.LStatInfo(fsys, dst)
+			if dstErr != nil {
+				d = append(d, Discrepancy{dst, dstErr.Error()})
+			} else if dstDSI.Dev != srcDSI.Dev || dstDSI.Ino != srcDSI.Ino {
+				d = append(d, Discrepancy{dst, "not linked to " + src})
+			}
+		}
+	}
+
+	removed := make(map[devIno]RemovedInode)
+	for _, ri := range r.RemovedInodes {
+		removed[devIno{ri.Dev, ri.Ino}] = ri
+	}
+	for _, root := range r.Roots {
+		err := walkTree(fsys, root, walkOptions{
+			Callback: func(pathname string, de vfs.Dirent) error {
+				if !de.IsRegular() {
+					return nil
+				}
+				if isTmpLinkName(pathname, dsts) {
+					d = append(d, Discrepancy{pathname, "leftover temporary link file"})
+				}
+				if len(removed) == 0 {
+					return nil
+				}
+				dsi, err := I.LStatInfo(fsys, pathname)
+				if err != nil {
+					return err
+				}
+				// Inode numbers can be reused by new files, so
+				// the size and mtime must also match
+				ri, ok := removed[devIno{dsi.Dev, uint64(dsi.Ino)}]
+				if ok && ri.Size == dsi.Size && ri.Mtime.Equal(dsi.Mtim) {
+					d = append(d, Discrepancy{pathname,
+						fmt.Sprintf("removed inode %v still exists", ri.Ino)})
+				}
+				return nil
+			},
+			ErrorCallback: func(pathname string, err error) walkAction {
+				d = append(d, Discrepancy{pathname, err.Error()})
+				return walkSkipNode
+			},
+		})
+		if os.IsNotExist(err) {
+			d = append(d, Discrepancy{root, "root dir not found"})
+		} else if err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+// isTmpLinkName returns true if the pathname has the form of the temporary
+// name used when linking one of the dst paths
+func isTmpLinkName(pathname string, dsts map[string]struct{}) bool {
+	i := strings.LastIndex(pathname, ".tmp")
+	if i < 0 {
+		return false
+	}
+	if _, ok := dsts[pathname[:i]]; !ok {
+		return false
+	}
+	_, err := strconv.ParseUint(pathname[i+len(".tmp"):], 36, 64)
+	return err == nil
+}
+
+// OutputDiscrepancies shows in text form the found discrepancies
+func OutputDiscrepancies(d []Discrepancy) {
+	if len(d) == 0 {
+		fmt.Println("No discrepancies found")
+		return
+	}
+	s := make([]string, 0)
+	s = append(s, "Discrepancies found")
+	s = append(s, "-------------------")
+	for _, disc := range d {
+		s = append(s, fmt.Sprintf("%v: %v", disc.Path, disc.Problem))
+	}
+	fmt.Println(strings.Join(s, "\n"))
+}
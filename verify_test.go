@@ -0,0 +1,90 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"strconv"
+	"testing"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+)
+
+func TestVerifyResults(t *testing.T) {
+	m := planMemFS(t)
+	opts := SetupOptions()
+	opts.FS = m
+	opts.LinkingEnabled = true
+	r, err := Run([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(r.RemovedInodes) != int(r.InodeRemovedCount) {
+		t.Fatalf("Expected %v removed inodes, got %v", r.InodeRemovedCount, len(r.RemovedInodes))
+	}
+	d, err := VerifyResults(r)
+	if err != nil || len(d) != 0 {
+		t.Fatalf("Expected no discrepancies, got %v (%v)", d, err)
+	}
+
+	// Relink a dst to a new inode, and leave a temp file behind
+	dst := r.LinkPaths[0][1]
+	if err := m.Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile(dst, []byte("replaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpName := dst + ".tmp" + strconv.FormatUint(12345, 36)
+	if err := m.WriteFile(tmpName, []byte("leftover"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An inode that still exists is claimed to be removed
+	dsi, err := I.LStatInfo(m, "c/f3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemovedInodes = append(r.RemovedInodes, RemovedInode{
+		Dev: dsi.Dev, Ino: uint64(dsi.Ino), Size: dsi.Size, Mtime: dsi.Mtim,
+	})
+
+	d, err = VerifyResults(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		dst:     "not linked to " + r.LinkPaths[0][0],
+		tmpName: "leftover temporary link file",
+		"c/f3":  "removed inode " + strconv.FormatUint(uint64(dsi.Ino), 10) + " still exists",
+	}
+	if len(d) != len(expected) {
+		t.Fatalf("Expected %v discrepancies, got %v", len(expected), d)
+	}
+	for _, disc := range d {
+		if expected[disc.Path] != disc.Problem {
+			t.Errorf("Unexpected discrepancy: %+v", disc)
+		}
+	}
+
+	r.Opts.LinkingEnabled = false
+	if _, err := VerifyResults(r); err == nil {
+		t.Errorf("Expected an error for the Results of a dry run")
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/xattr"
+)
+
+// DefaultMemLinkMax is the LinkMax of a new MemFS (the ext4 limit)
+const DefaultMemLinkMax = 65000
+
+// MemFS is an in-memory FS with simulated inodes, which allows exercising
+// large synthetic trees and exact inode topologies without touching the disk.
+// Pathnames are all relative to its root (so "/a", "./a" and "a" are the
+// same file).  Symlinks aren't supported.  It is safe for concurrent use.
+//
+// New files get the mtime of the MemFS creation, so that files with equal
+// contents are linkable by default.  Rewriting a file sets its mtime to the
+// current time, as on a real filesystem.
+type MemFS struct {
+	// Dev is the device number of all the inodes
+	Dev uint64
+	// LinkMax is the maximum nlink count of an inode
+	LinkMax uint64
+
+	mu      sync.Mutex
+	root    *memInode
+	nextIno uint64
+	created time.Time
+}
+
+type memInode struct {
+	ino     uint64
+	nlink   uint64
+	mode    os.FileMode
+	uid     uint32
+	gid     uint32
+	mtime   time.Time
+	data    []byte
+	xattrs  map[string][]byte
+	entries map[string]*memInode // Only for directories
+}
+
+// NewMemFS returns an empty MemFS, with just a root directory
+func NewMemFS() *MemFS {
+	m := &MemFS{Dev: 1, LinkMax: DefaultMemLinkMax, created: time.Now()}
+	m.root = m.newInode(os.ModeDir | 0755)
+	m.root.nlink = 2
+	return m
+}
+
+func (m *MemFS) newInode(mode os.FileMode) *memInode {
+	m.nextIno++
+	n := &memInode{
+		ino:    m.nextIno,
+		nlink:  1,
+		mode:   mode,
+		uid:    uint32(os.Getuid()),
+		gid:    uint32(os.Getgid()),
+		mtime:  m.created,
+		xattrs: make(map[string][]byte),
+	}
+	if mode.IsDir() {
+		n.entries = make(map[string]*memInode)
+	}
+	return n
+}
+
+// split returns the cleaned components of pathname
+func split(pathname string) []string {
+	p := strings.Trim(path.Clean("/"+pathname), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// parent returns the directory holding the last component of pathname, and
+// that component's name.  The name is empty for the root.
+func (m *MemFS) parent(pathname string) (*memInode, string, syscall.Errno) {
+	parts := split(pathname)
+	if len(parts) == 0 {
+		return nil, "", 0
+	}
+	dir := m.root
+	for _, name := range parts[:len(parts)-1] {
+		n, ok := dir.entries[name]
+		if !ok {
+			return nil, "", syscall.ENOENT
+		}
+		if !n.mode.IsDir() {
+			return nil, "", syscall.ENOTDIR
+		}
+		dir = n
+	}
+	return dir, parts[len(parts)-1], 0
+}
+
+// lookup returns the inode of pathname
+func (m *MemFS) lookup(pathname string) (*memInode, syscall.Errno) {
+	dir, name, errno := m.parent(pathname)
+	if errno != 0 {
+		return nil, errno
+	}
+	if dir == nil {
+		return m.root, 0
+	}
+	n, ok := dir.entries[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n, 0
+}
+
+func pathErr(op, pathname string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: pathname, Err: errno}
+}
+
+func linkErr(op, oldname, newname string, errno syscall.Errno) error {
+	return &os.LinkError{Op: op, Old: oldname, New: newname, Err: errno}
+}
+
+// MkdirAll creates the directory pathname, along with any missing parents
+func (m *MemFS) MkdirAll(pathname string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.mkdirAll(pathname, perm)
+	return err
+}
+
+func (m *MemFS) mkdirAll(pathname string, perm os.FileMode) (*memInode, error) {
+	dir := m.root
+	for _, name := range split(pathname) {
+		n, ok := dir.entries[name]
+		if !ok {
+			n = m.newInode(os.ModeDir | perm.Perm())
+			n.nlink = 2
+			dir.entries[name] = n
+			dir.nlink++
+		} else if !n.mode.IsDir() {
+			return nil, pathErr("mkdir", pathname, syscall.ENOTDIR)
+		}
+		dir = n
+	}
+	return dir, nil
+}
+
+// WriteFile creates (or replaces the content of) the file pathname, along
+// with any missing parent directories.  A new file gets the MemFS creation
+// time as its mtime, and a rewritten one gets the current time.
+func (m *MemFS) WriteFile(pathname string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parts := split(pathname)
+	if len(parts) == 0 {
+		return pathErr("open", pathname, syscall.EISDIR)
+	}
+	dir, err := m.mkdirAll(path.Join(parts[:len(parts)-1]...), 0755)
+	if err != nil {
+		return err
+	}
+	name := parts[len(parts)-1]
+	n, ok := dir.entries[name]
+	if !ok {
+		n = m.newInode(perm.Perm())
+		dir.entries[name] = n
+	} else if n.mode.IsDir() {
+		return pathErr("open", pathname, syscall.EISDIR)
+	} else {
+		n.mtime = time.Now()
+	}
+	// Replaced rather than modified, so that open files aren't changed
+	n.data = append([]byte(nil), data...)
+	return nil
+}
+
+// Chmod sets the mode bits (including setuid, setgid and sticky) of pathname
+func (m *MemFS) Chmod(pathname string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return pathErr("chmod", pathname, errno)
+	}
+	n.mode = n.mode&os.ModeType | mode&^os.ModeType
+	return nil
+}
+
+// SetXattr sets an extended attribute of pathname
+func (m *MemFS) SetXattr(pathname, name string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return &xattr.Error{Op: "xattr.LSet", Path: pathname, Name: name, Err: errno}
+	}
+	n.xattrs[name] = append([]byte(nil), value...)
+	return nil
+}
+
+// ReadDir returns the directory entries, sorted by name
+func (m *MemFS) ReadDir(dirname string) ([]Dirent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(dirname)
+	if errno != 0 {
+		return nil, pathErr("open", dirname, errno)
+	}
+	if !n.mode.IsDir() {
+		return nil, pathErr("readdirent", dirname, syscall.ENOTDIR)
+	}
+	d := make([]Dirent, 0, len(n.entries))
+	for name, child := range n.entries {
+		d = append(d, Dirent{Name: name, ModeType: child.mode & os.ModeType})
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i].Name < d[j].Name })
+	return d, nil
+}
+
+// memFileInfo is a snapshot of an inode, as an os.FileInfo
+type memFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	stat  Stat
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return &fi.stat }
+
+func (m *MemFS) Lstat(pathname string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return nil, pathErr("lstat", pathname, errno)
+	}
+	return &memFileInfo{
+		name:  path.Base(pathname),
+		size:  int64(len(n.data)),
+		mode:  n.mode,
+		mtime: n.mtime,
+		stat:  Stat{Dev: m.Dev, Ino: n.ino, Nlink: n.nlink, Uid: n.uid, Gid: n.gid},
+	}, nil
+}
+
+type memFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memFile) Name() string { return f.name }
+func (f *memFile) Close() error { return nil }
+
+func (m *MemFS) Open(pathname string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return nil, pathErr("open", pathname, errno)
+	}
+	if n.mode.IsDir() {
+		return nil, pathErr("read", pathname, syscall.EISDIR)
+	}
+	return &memFile{Reader: bytes.NewReader(n.data), name: pathname}, nil
+}
+
+// ListXattr returns the extended attribute names, sorted
+func (m *MemFS) ListXattr(pathname string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return nil, &xattr.Error{Op: "xattr.LList", Path: pathname, Err: errno}
+	}
+	names := make([]string, 0, len(n.xattrs))
+	for name := range n.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemFS) GetXattr(pathname, name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return nil, &xattr.Error{Op: "xattr.LGet", Path: pathname, Name: name, Err: errno}
+	}
+	v, ok := n.xattrs[name]
+	if !ok {
+		return nil, &xattr.Error{Op: "xattr.LGet", Path: pathname, Name: name, Err: xattr.ENOATTR}
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(oldname)
+	if errno != 0 {
+		return linkErr("link", oldname, newname, errno)
+	}
+	if n.mode.IsDir() {
+		return linkErr("link", oldname, newname, syscall.EPERM)
+	}
+	dir, name, errno := m.parent(newname)
+	if errno != 0 {
+		return linkErr("link", oldname, newname, errno)
+	}
+	if dir == nil {
+		return linkErr("link", oldname, newname, syscall.EEXIST) // The root
+	}
+	if _, ok := dir.entries[name]; ok {
+		return linkErr("link", oldname, newname, syscall.EEXIST)
+	}
+	if n.nlink >= m.LinkMax {
+		return linkErr("link", oldname, newname, syscall.EMLINK)
+	}
+	dir.entries[name] = n
+	n.nlink++
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldDir, oldName, errno := m.parent(oldname)
+	if errno == 0 && oldDir == nil {
+		errno = syscall.EBUSY // The root
+	}
+	if errno != 0 {
+		return linkErr("rename", oldname, newname, errno)
+	}
+	n, ok := oldDir.entries[oldName]
+	if !ok {
+		return linkErr("rename", oldname, newname, syscall.ENOENT)
+	}
+	newDir, newName, errno := m.parent(newname)
+	if errno == 0 && newDir == nil {
+		errno = syscall.EBUSY
+	}
+	if errno != 0 {
+		return linkErr("rename", oldname, newname, errno)
+	}
+	if n.mode.IsDir() {
+		// Moving a dir would require checking for cycles
+		return linkErr("rename", oldname, newname, syscall.EPERM)
+	}
+	if target, ok := newDir.entries[newName]; ok {
+		if target == n {
+			return nil // Renaming a link to the same inode does nothing
+		}
+		if target.mode.IsDir() {
+			return linkErr("rename", oldname, newname, syscall.EISDIR)
+		}
+		target.nlink--
+	}
+	delete(oldDir.entries, oldName)
+	newDir.entries[newName] = n
+	return nil
+}
+
+func (m *MemFS) Remove(pathname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, name, errno := m.parent(pathname)
+	if errno == 0 && dir == nil {
+		errno = syscall.EBUSY
+	}
+	if errno != 0 {
+		return pathErr("remove", pathname, errno)
+	}
+	n, ok := dir.entries[name]
+	if !ok {
+		return pathErr("remove", pathname, syscall.ENOENT)
+	}
+	if n.mode.IsDir() {
+		if len(n.entries) > 0 {
+			return pathErr("remove", pathname, syscall.ENOTEMPTY)
+		}
+		dir.nlink--
+	}
+	delete(dir.entries, name)
+	n.nlink--
+	return nil
+}
+
+func (m *MemFS) Chtimes(pathname string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return pathErr("chtimes", pathname, errno)
+	}
+	n.mtime = mtime
+	return nil
+}
+
+func (m *MemFS) Lchown(pathname string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, errno := m.lookup(pathname)
+	if errno != 0 {
+		return pathErr("lchown", pathname, errno)
+	}
+	// As with chown, -1 leaves the id unchanged
+	if uid != -1 {
+		n.uid = uint32(uid)
+	}
+	if gid != -1 {
+		n.gid = uint32(gid)
+	}
+	return nil
+}
+
+func (m *MemFS) MaxNlink(pathname string) uint64 { return m.LinkMax }
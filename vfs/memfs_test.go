@@ -0,0 +1,168 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func memStat(t *testing.T, m *MemFS, pathname string) Stat {
+	fi, err := m.Lstat(pathname)
+	if err != nil {
+		t.Fatalf("Lstat(%v) failed: %v", pathname, err)
+	}
+	s, ok := StatOf(fi)
+	if !ok {
+		t.Fatalf("StatOf(%v) failed", pathname)
+	}
+	return s
+}
+
+func errnoOf(err error) syscall.Errno {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err.(syscall.Errno)
+	case *os.LinkError:
+		return e.Err.(syscall.Errno)
+	}
+	return 0
+}
+
+func TestMemFSLinks(t *testing.T) {
+	m := NewMemFS()
+	m.LinkMax = 3
+	if err := m.WriteFile("/a/f1", []byte("XXX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("a/b/f2", []byte("XXX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Link("a/f1", "a/b/f3"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	s1, s3 := memStat(t, m, "./a/f1"), memStat(t, m, "a/b/f3")
+	if s1.Ino != s3.Ino || s1.Nlink != 2 {
+		t.Errorf("Expected linked inodes with nlink 2, got: %+v %+v", s1, s3)
+	}
+	if errno := errnoOf(m.Link("a/f1", "a/b/f2")); errno != syscall.EEXIST {
+		t.Errorf("Expected EEXIST linking to an existing file, got: %v", errno)
+	}
+	if err := m.Link("a/f1", "a/f4"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if errno := errnoOf(m.Link("a/f1", "a/f5")); errno != syscall.EMLINK {
+		t.Errorf("Expected EMLINK beyond LinkMax, got: %v", errno)
+	}
+
+	// Renaming over f2 removes its inode's only link
+	if err := m.Rename("a/f4", "a/b/f2"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if s := memStat(t, m, "a/b/f2"); s.Ino != s1.Ino || s.Nlink != 3 {
+		t.Errorf("Expected renamed link to f1 inode with nlink 3, got: %+v", s)
+	}
+	if _, err := m.Lstat("a/f4"); errnoOf(err) != syscall.ENOENT {
+		t.Errorf("Expected ENOENT for renamed file, got: %v", err)
+	}
+
+	if err := m.Remove("a/b/f3"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if s := memStat(t, m, "a/f1"); s.Nlink != 2 {
+		t.Errorf("Expected nlink 2 after Remove, got: %v", s.Nlink)
+	}
+	if errno := errnoOf(m.Remove("a/b")); errno != syscall.ENOTEMPTY {
+		t.Errorf("Expected ENOTEMPTY removing a dir, got: %v", errno)
+	}
+
+	d, err := m.ReadDir("a")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	want := []Dirent{{Name: "b", ModeType: os.ModeDir}, {Name: "f1"}}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Expected ReadDir %v, got: %v", want, d)
+	}
+}
+
+func TestMemFSAttrs(t *testing.T) {
+	m := NewMemFS()
+	if err := m.WriteFile("f1", []byte("contents"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.Open("f1")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil || string(b) != "contents" {
+		t.Errorf("Expected to read 'contents', got: %q %v", b, err)
+	}
+	f.Close()
+
+	mtime := time.Unix(1000, 0)
+	if err := m.Chtimes("f1", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lchown("f1", 10, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Chmod("f1", os.ModeSetuid|0755); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := m.Lstat("f1")
+	s := memStat(t, m, "f1")
+	if !fi.ModTime().Equal(mtime) || fi.Size() != 8 || fi.Mode() != os.ModeSetuid|0755 ||
+		s.Uid != 10 || s.Gid != uint32(os.Getgid()) || s.Dev != m.Dev {
+		t.Errorf("Unexpected Lstat: %v %v %v %+v", fi.ModTime(), fi.Size(), fi.Mode(), s)
+	}
+
+	// A same-size rewrite is seen as a change of mtime
+	if err := m.WriteFile("f1", []byte("CONTENTS"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := m.Lstat("f1"); fi.ModTime().Equal(mtime) || fi.Size() != 8 {
+		t.Errorf("Expected a rewrite to change the mtime, got: %v", fi.ModTime())
+	}
+
+	if err := m.SetXattr("f1", "user.b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetXattr("f1", "user.a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	names, err := m.ListXattr("f1")
+	if err != nil || !reflect.DeepEqual(names, []string{"user.a", "user.b"}) {
+		t.Errorf("Unexpected ListXattr: %v %v", names, err)
+	}
+	if v, err := m.GetXattr("f1", "user.b"); err != nil || string(v) != "2" {
+		t.Errorf("Unexpected GetXattr: %q %v", v, err)
+	}
+	if _, err := m.GetXattr("f1", "user.c"); err == nil {
+		t.Errorf("Expected error getting a missing xattr")
+	}
+}
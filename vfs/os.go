@@ -18,21 +18,69 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package inode
+package vfs
 
 import (
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/xattr"
 )
 
-// MaxNlinkVal returns the maximum number of supported NLinks to pathname.
+// OS is the FS of the operating system
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) ReadDir(dirname string) ([]Dirent, error) {
+	des, err := godirwalk.ReadDirents(dirname, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := make([]Dirent, len(des))
+	for i, de := range des {
+		d[i] = Dirent{Name: de.Name(), ModeType: de.ModeType()}
+	}
+	return d, nil
+}
+
+func (osFS) Lstat(pathname string) (os.FileInfo, error) { return os.Lstat(pathname) }
+
+func (osFS) Open(pathname string) (File, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err // Avoid returning a nil *os.File as a non-nil File
+	}
+	return f, nil
+}
+
+func (osFS) ListXattr(pathname string) ([]string, error) { return xattr.LList(pathname) }
+
+func (osFS) GetXattr(pathname, name string) ([]byte, error) {
+	return xattr.LGet(pathname, name)
+}
+
+func (osFS) Link(oldname, newname string) error   { return os.Link(oldname, newname) }
+func (osFS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+func (osFS) Remove(pathname string) error         { return os.Remove(pathname) }
+
+func (osFS) Chtimes(pathname string, atime, mtime time.Time) error {
+	return os.Chtimes(pathname, atime, mtime)
+}
+
+func (osFS) Lchown(pathname string, uid, gid int) error { return os.Lchown(pathname, uid, gid) }
+
+// MaxNlink returns the maximum number of supported NLinks to pathname.
 // Since the syscall interface to Pathconf isn't supported on all unixes (such
 // as Linux, for some reason), we instead call out to the getconf program,
 // which should always be available as a basic command on both BSDs and Linux,
 // to obtain the value.  Since this only needs to be done once per device (ie.
 // once per Stat_t.Dev), it isn't a performance concern.
-func MaxNlinkVal(pathname string) uint64 {
+func (osFS) MaxNlink(pathname string) uint64 {
 	var returnVal uint64
 	var cmdPath string
 	var err error
@@ -18,19 +18,19 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package inode
+package vfs
 
 import "testing"
 
-func TestMaxNlinkVal(t *testing.T) {
-	if MaxNlinkVal("") != 8 {
-		t.Errorf("Invalid MaxNlinkVal for empty path")
+func TestOSMaxNlink(t *testing.T) {
+	if OS.MaxNlink("") != 8 {
+		t.Errorf("Invalid MaxNlink for empty path")
 	}
-	if MaxNlinkVal("/some/made/up/path") != 8 {
-		t.Errorf("Invalid MaxNlinkVal for invalid path")
+	if OS.MaxNlink("/some/made/up/path") != 8 {
+		t.Errorf("Invalid MaxNlink for invalid path")
 	}
-	if MaxNlinkVal(".") <= 8 {
+	if OS.MaxNlink(".") <= 8 {
 		// Assumes max nlinks will be higher than POSIX minimum
-		t.Errorf("Invalid MaxNlinkVal for valid path")
+		t.Errorf("Invalid MaxNlink for valid path")
 	}
 }
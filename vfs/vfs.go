@@ -0,0 +1,108 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package vfs defines the filesystem operations used by hardlinkable, so that
+// it can be run against the operating system's filesystems (OS), or against
+// an in-memory filesystem with simulated inodes (MemFS).
+package vfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// FS is the interface to the filesystem operations needed to walk, stat,
+// compare and link files.  The errors should be the same types as returned
+// by the os package (ie. *os.PathError and *os.LinkError wrapping a
+// syscall.Errno), so that they can be reported accurately.
+type FS interface {
+	// ReadDir returns the entries of the named directory, in any order
+	ReadDir(dirname string) ([]Dirent, error)
+
+	// Lstat returns the FileInfo of the named file, without following
+	// symlinks.  Its Sys() value must be usable with StatOf.
+	Lstat(pathname string) (os.FileInfo, error)
+
+	// Open opens the named file for reading
+	Open(pathname string) (File, error)
+
+	// ListXattr returns the names of the extended attributes of the named
+	// file, and GetXattr returns the value of one (without following
+	// symlinks)
+	ListXattr(pathname string) ([]string, error)
+	GetXattr(pathname, name string) ([]byte, error)
+
+	Link(oldname, newname string) error
+	Rename(oldname, newname string) error
+	Remove(pathname string) error
+	Chtimes(pathname string, atime, mtime time.Time) error
+	Lchown(pathname string, uid, gid int) error
+
+	// MaxNlink returns the maximum nlink count for files on the device
+	// holding pathname
+	MaxNlink(pathname string) uint64
+}
+
+// File is an open file, as returned by FS.Open
+type File interface {
+	io.ReadCloser
+	Name() string
+}
+
+// Dirent is a directory entry, as returned by FS.ReadDir
+type Dirent struct {
+	Name     string
+	ModeType os.FileMode // Only the os.ModeType bits
+}
+
+// IsDir returns true if the entry is a directory
+func (de Dirent) IsDir() bool { return de.ModeType&os.ModeDir != 0 }
+
+// IsRegular returns true if the entry is a regular file
+func (de Dirent) IsRegular() bool { return de.ModeType&os.ModeType == 0 }
+
+// Stat holds the inode fields that aren't available from os.FileInfo
+type Stat struct {
+	Dev   uint64
+	Ino   uint64
+	Nlink uint64
+	Uid   uint32
+	Gid   uint32
+}
+
+// StatOf returns the Stat fields of a FileInfo returned by FS.Lstat, with
+// either a *syscall.Stat_t or a *Stat Sys() value.
+func StatOf(fi os.FileInfo) (Stat, bool) {
+	switch s := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return Stat{
+			Dev:   uint64(s.Dev),
+			Ino:   uint64(s.Ino),
+			Nlink: uint64(s.Nlink),
+			Uid:   uint32(s.Uid),
+			Gid:   uint32(s.Gid),
+		}, true
+	case *Stat:
+		return *s, true
+	}
+	return Stat{}, false
+}
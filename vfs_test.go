@@ -0,0 +1,111 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+func memNlink(t *testing.T, m *vfs.MemFS, pathname string) uint64 {
+	fi, err := m.Lstat(pathname)
+	if err != nil {
+		t.Fatalf("Lstat(%v) failed: %v", pathname, err)
+	}
+	s, _ := vfs.StatOf(fi)
+	return s.Nlink
+}
+
+func TestRunMemFS(t *testing.T) {
+	m := vfs.NewMemFS()
+	pc := map[string]string{
+		"a/f1": "XXX", "a/f2": "XXX", "b/f3": "XXX",
+		"a/g1": "YYYY", "b/g2": "YYYY",
+		"b/h1": "ZZZ",
+	}
+	for pathname, content := range pc {
+		if err := m.WriteFile(pathname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Link("a/f1", "b/f4"); err != nil {
+		t.Fatal(err)
+	}
+	// An unequal mtime prevents g2 being linked
+	newer := time.Now().Add(time.Hour)
+	if err := m.Chtimes("b/g2", newer, newer); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := SetupOptions(LinkingEnabled)
+	opts.FS = m
+	name := "testname: 'MemFS'"
+	result := simpleRun(name, t, opts, 1, "a", "b")
+
+	if result.DirCount != 2 || result.FileCount != 7 {
+		t.Errorf("%v: Expected 2 dirs and 7 files, got: %v %v", name, result.DirCount, result.FileCount)
+	}
+	if result.ExistingLinkCount != 1 || result.InodeRemovedCount != 2 {
+		t.Errorf("%v: Expected 1 existing link and 2 removed inodes, got: %v %v",
+			name, result.ExistingLinkCount, result.InodeRemovedCount)
+	}
+	for _, pathname := range []string{"a/f1", "a/f2", "b/f3", "b/f4"} {
+		if n := memNlink(t, m, pathname); n != 4 {
+			t.Errorf("%v: Expected nlink 4 for %v, got: %v", name, pathname, n)
+		}
+	}
+	for _, pathname := range []string{"a/g1", "b/g2", "b/h1"} {
+		if n := memNlink(t, m, pathname); n != 1 {
+			t.Errorf("%v: Expected nlink 1 for %v, got: %v", name, pathname, n)
+		}
+	}
+}
+
+func TestRunMemFSLarge(t *testing.T) {
+	m := vfs.NewMemFS()
+	const numDirs, numFiles, numContents = 20, 500, 50
+	for d := 0; d < numDirs; d++ {
+		for f := 0; f < numFiles; f++ {
+			pathname := fmt.Sprintf("d%v/f%v", d, f)
+			content := fmt.Sprintf("content %v", f%numContents)
+			if err := m.WriteFile(pathname, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	opts := SetupOptions()
+	opts.FS = m
+	opts.StoreNewLinkResults = false
+	result, err := Run([]string{"."}, opts)
+	if err != nil {
+		t.Fatalf("Run() returned error: %v", err)
+	}
+	if result.FileCount != numDirs*numFiles {
+		t.Errorf("Expected %v files, got: %v", numDirs*numFiles, result.FileCount)
+	}
+	if result.InodeRemovedCount != numDirs*numFiles-numContents {
+		t.Errorf("Expected %v removable inodes, got: %v", numDirs*numFiles-numContents, result.InodeRemovedCount)
+	}
+}
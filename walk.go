@@ -21,57 +21,140 @@
 package hardlinkable
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 
 	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
-
-	"github.com/karrick/godirwalk"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 type pathErr struct {
 	pathname string
 	err      error
+	skipped  bool          // err was skipped, and the walk continues
+	dir      bool          // pathname is a walked directory
+	rejected string        // pathname is a file rejected for this reason
+	cached   *fileState    // Saved stat info from the StateFile, if unchanged
+	pause    chan struct{} // The walk is paused for a checkpoint until closed
+}
+
+// walkCheckpoint lets the walk skip the dirs that were completed before a
+// resumed checkpoint, and pause after completing a dir when a checkpoint is
+// due (so that the checkpoint is consistent with the walk position).
+type walkCheckpoint struct {
+	doneDirs map[string]struct{} // Only accessed by the walk, unless paused
+	interval time.Duration
+	last     time.Time
 }
 
-// Return allowed pathnames through the given channel.  An empty pathname
-// indicates the walk returned before completion.
-func matchedPathnames(opts Options, r *Results, pool *P.StringPool, dirs []string, files []string) <-chan pathErr {
+// Return allowed pathnames through the given channel, along with the walked
+// directories and excluded files.  An empty pathname indicates the walk
+// returned before completion.  Errors that are skipped
+// (when IgnoreWalkErrors is set) are also passed back, so that they can be
+// recorded in the Results.  The walk stops (and the channel is closed) when
+// the context is done.
+func matchedPathnames(ctx context.Context, fsys vfs.FS, opts Options, r *Results, pool *P.StringPool, sc *scanCache, wc *walkCheckpoint, dirs []string, files []string) <-chan pathErr {
 	// Options is a copy to prevent being changed during walk.
 	out := make(chan pathErr)
+	pol := newPolicy(&opts)
 	go func() {
 		defer close(out)
+		send := func(pe pathErr) bool {
+			select {
+			case out <- pe:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		var postChildren func(string) error
+		if wc != nil {
+			postChildren = func(dirname string) error {
+				wc.doneDirs[dirname] = struct{}{}
+				if time.Since(wc.last) < wc.interval {
+					return nil
+				}
+				pause := make(chan struct{})
+				if !send(pathErr{pathname: dirname, pause: pause}) {
+					return ctx.Err()
+				}
+				select {
+				case <-pause:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				wc.last = time.Now()
+				return nil
+			}
+		}
+		var readDir func(string) ([]vfs.Dirent, error)
+		if sc != nil {
+			readDir = func(dirname string) ([]vfs.Dirent, error) {
+				return sc.readDir(fsys, dirname, r)
+			}
+		}
 		uniqueDirs := make(map[string]struct{})
 		for _, dir := range dirs {
-			err := godirwalk.Walk(dir, &godirwalk.Options{
-				Unsorted: true,
-				Callback: func(osPathname string, de *godirwalk.Dirent) error {
-					if de.ModeType().IsDir() {
+			err := walkTree(fsys, dir, walkOptions{
+				ReadDir:      readDir,
+				PostChildren: postChildren,
+				Callback: func(osPathname string, de vfs.Dirent) error {
+					if de.IsDir() {
 						// DirCount updated here only, so doesn't race w/ other goroutines.
 						if _, ok := uniqueDirs[osPathname]; !ok {
 							dirname := pool.Intern(osPathname)
 							uniqueDirs[dirname] = struct{}{}
 
+							// Skip the dirs completed before the resumed checkpoint
+							if wc != nil {
+								if _, ok := wc.doneDirs[osPathname]; ok {
+									return filepath.SkipDir
+								}
+							}
+
 							// Do not exclude dirs provided explicitly by the user
-							if dir != osPathname && isMatched(de.Name(), opts.DirExcludes) {
+							// (unless excluded by a policy rule)
+							if (dir != osPathname && isMatched(de.Name, opts.DirExcludes)) ||
+								pol.excluded(osPathname) {
 								r.ExcludedDirCount++ // Only updated in this goroutine
 								return filepath.SkipDir
 							}
 							r.DirCount++
+							if !send(pathErr{pathname: osPathname, dir: true}) {
+								return ctx.Err()
+							}
 						} else {
 							// Skip already walked directories
 							return filepath.SkipDir
 						}
-					} else if de.ModeType().IsRegular() {
-						if isFileIncluded(de.Name(), &opts, r) {
-							out <- pathErr{pathname: osPathname, err: nil}
+					} else if de.IsRegular() {
+						pe := pathErr{pathname: osPathname, err: nil}
+						if isPolicyExcluded(pol, osPathname, r) || !isFileIncluded(de.Name, &opts, r) {
+							pe.rejected = RejectExcluded
+						} else if sc != nil {
+							pe.cached = sc.cachedFile(filepath.Dir(osPathname), de.Name)
+						}
+						if !send(pe) {
+							return ctx.Err()
 						}
 					}
 					return nil
 				},
-				ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
+				ErrorCallback: func(osPathname string, err error) walkAction {
+					if ctx.Err() != nil {
+						return walkHalt
+					}
 					r.SkippedDirErrCount++
+					if opts.IgnoreWalkErrors {
+						if !send(pathErr{pathname: osPathname, err: err, skipped: true}) {
+							return walkHalt
+						}
+					}
 					if osPathname == dir {
 						if opts.IgnoreWalkErrors && opts.DebugLevel > 0 {
 							log.Printf("\r%v  Skipping...", err)
@@ -79,20 +162,23 @@ func matchedPathnames(opts Options, r *Results, pool *P.StringPool, dirs []strin
 						// Halt when we can't walk the top level directory, so
 						// that it gets reported as an error (even if we are
 						// ignoring file errors)
-						return godirwalk.Halt
+						return walkHalt
 					}
 					if opts.IgnoreWalkErrors {
 						if opts.DebugLevel > 0 {
 							log.Printf("\r%v  Skipping...", err)
 						}
-						return godirwalk.SkipNode
+						return walkSkipNode
 					}
-					return godirwalk.Halt
+					return walkHalt
 				},
 			})
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
 				if !opts.IgnoreWalkErrors {
-					out <- pathErr{pathname: "", err: err}
+					send(pathErr{pathname: "", err: err})
 					return
 				}
 			}
@@ -100,8 +186,12 @@ func matchedPathnames(opts Options, r *Results, pool *P.StringPool, dirs []strin
 		// Also pass back some or all (depending on includes and
 		// excludes) of the passed in file pathnames.
 		for _, pathname := range files {
-			if isFileIncluded(pathname, &opts, r) {
-				out <- pathErr{pathname: pathname, err: nil}
+			pe := pathErr{pathname: pathname, err: nil}
+			if isPolicyExcluded(pol, pathname, r) || !isFileIncluded(pathname, &opts, r) {
+				pe.rejected = RejectExcluded
+			}
+			if !send(pe) {
+				return
 			}
 		}
 	}()
@@ -141,3 +231,88 @@ func isFileIncluded(name string, opts *Options, r *Results) bool {
 	r.ExcludedFileCount++
 	return false
 }
+
+// isPolicyExcluded returns true if the file is excluded by a policy rule
+func isPolicyExcluded(pol *policy, pathname string, r *Results) bool {
+	if pol.excluded(pathname) {
+		r.ExcludedFileCount++
+		return true
+	}
+	return false
+}
+
+// walkAction is returned by a walkOptions.ErrorCallback, to either halt the
+// walk, or skip the erroring node and continue
+type walkAction int
+
+const (
+	walkHalt walkAction = iota
+	walkSkipNode
+)
+
+type walkOptions struct {
+	Callback      func(osPathname string, de vfs.Dirent) error
+	ErrorCallback func(osPathname string, err error) walkAction
+	ReadDir       func(osPathname string) ([]vfs.Dirent, error) // Optional
+	PostChildren  func(osPathname string) error                 // Optional
+}
+
+// walkTree calls the Callback for the root dir and (recursively) every entry
+// below it, in no particular order, without following symlinks.  It follows
+// the godirwalk.Walk conventions: the Callback can return filepath.SkipDir to
+// skip a directory, the ErrorCallback is called for other Callback and
+// ReadDir errors, to decide whether the walk halts, and the PostChildren
+// callback is called after all the entries of a directory were walked.
+func walkTree(fsys vfs.FS, root string, opts walkOptions) error {
+	root = filepath.Clean(root)
+	fi, err := fsys.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("cannot walk non-directory: %s", root)
+	}
+	de := vfs.Dirent{Name: filepath.Base(root), ModeType: fi.Mode() & os.ModeType}
+	err = walkNode(fsys, root, de, opts)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkNode(fsys vfs.FS, osPathname string, de vfs.Dirent, opts walkOptions) error {
+	if err := opts.Callback(osPathname, de); err != nil {
+		if err == filepath.SkipDir {
+			return err
+		}
+		if opts.ErrorCallback(osPathname, err) == walkSkipNode {
+			return nil
+		}
+		return err
+	}
+	if !de.IsDir() {
+		return nil
+	}
+
+	readDir := fsys.ReadDir
+	if opts.ReadDir != nil {
+		readDir = opts.ReadDir
+	}
+	children, err := readDir(osPathname)
+	if err != nil {
+		if opts.ErrorCallback(osPathname, err) == walkSkipNode {
+			return nil
+		}
+		return err
+	}
+	for _, child := range children {
+		err := walkNode(fsys, filepath.Join(osPathname, child.Name), child, opts)
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	if opts.PostChildren != nil {
+		return opts.PostChildren(osPathname)
+	}
+	return nil
+}
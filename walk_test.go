@@ -21,6 +21,7 @@
 package hardlinkable
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
@@ -28,6 +29,7 @@ import (
 	"testing"
 
 	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+	"github.com/chadnetzer/hardlinkable/vfs"
 )
 
 type testIncludesExcludes struct {
@@ -83,11 +85,14 @@ func TestWalkFileIncludes(t *testing.T) {
 		s.Options.FileIncludes = v.in
 		s.Options.FileExcludes = v.ex
 
-		c := matchedPathnames(*s.Options, s.Results, s.pool, dirs, []string{})
+		c := matchedPathnames(context.Background(), vfs.OS, *s.Options, s.Results, s.pool, nil, nil, dirs, []string{})
 		n := 0
 		var filenames []string
 		foundMatch := false
 		for pe := range c {
+			if pe.dir || pe.rejected != "" {
+				continue
+			}
 			n++
 			_, filename := path.Split(pe.pathname)
 			filenames = append(filenames, filename)
@@ -0,0 +1,445 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	I "github.com/chadnetzer/hardlinkable/internal/inode"
+	P "github.com/chadnetzer/hardlinkable/internal/pathpool"
+	"github.com/chadnetzer/hardlinkable/vfs"
+)
+
+const DefaultWatchSettleTime = 5 * time.Second
+const DefaultWatchStatsInterval = 10 * time.Minute
+
+// WatchOptions controls the incremental linking done by Watch, after the
+// initial scan.
+type WatchOptions struct {
+	// SettleTime is how long a written file must be left unchanged before
+	// it is compared with the indexed files, and linked.
+	SettleTime time.Duration
+
+	// StatsInterval is how often the linking stats are logged (never, if
+	// zero).
+	StatsInterval time.Duration
+
+	// Logger receives the stats and any errors (log.Printf style output
+	// to stderr, if nil).
+	Logger *log.Logger
+}
+
+// Watch scans the given directories and links their identical files (as
+// with RunContext), and then keeps watching the directories for files that
+// are written or moved into them.  Once a file has settled, it is compared
+// with the files already seen, and linked to an identical one.  Watch only
+// returns when the context is done (returning its error and the Results
+// accumulated since the initial scan), or if the initial scan fails.
+//
+// Linking must be enabled in the Options, and watching is only supported on
+// Linux (using inotify) with the OS filesystem.
+func Watch(ctx context.Context, dirs []string, opts Options, wo WatchOptions) (Results, error) {
+	ls := newLinkableState(&opts)
+	ls.ctx = ctx
+
+	if err := opts.Validate(); err != nil {
+		return *ls.Results, err
+	}
+	if !opts.LinkingEnabled {
+		return *ls.Results, fmt.Errorf("Watch requires LinkingEnabled")
+	}
+	if opts.FS != nil && opts.FS != vfs.OS {
+		return *ls.Results, fmt.Errorf("Watch only supports the OS filesystem")
+	}
+	_, files, err := validateDirsAndFiles(ls.fsys, dirs)
+	if err != nil {
+		return *ls.Results, err
+	}
+	if len(files) > 0 {
+		return *ls.Results, fmt.Errorf("Watch only accepts directories: %v", files[0])
+	}
+
+	n, err := newNotifier()
+	if err != nil {
+		return *ls.Results, err
+	}
+	defer n.close()
+
+	w := newWatcher(ctx, ls, n, wo)
+	err = w.run(dirs)
+	return *ls.Results, err
+}
+
+// watchEventKind is the type of filesystem change that was noticed
+type watchEventKind int
+
+const (
+	fileWritten watchEventKind = iota // Closed after writing, or moved in
+	fileRemoved                       // Deleted, or moved away
+	dirCreated                        // Created, or moved in
+	dirRemoved                        // Deleted, or moved away
+	eventsLost                        // Events were dropped by the kernel
+)
+
+type watchEvent struct {
+	pathname string
+	kind     watchEventKind
+}
+
+// notifier reports the changes to files in the directories that are added
+// to it.  Events are queued as they arrive, and signalled on the ready
+// channel, so that they aren't lost while the watcher is busy.
+type notifier interface {
+	addDir(dirname string) error
+	numDirs() int
+	ready() <-chan struct{}
+	events() []watchEvent // Removes the queued events
+	close() error
+}
+
+// watcher keeps the fsDev indexes from the initial scan up to date with the
+// changed files, and links the new files that are found to be identical.
+type watcher struct {
+	ctx    context.Context
+	ls     *linkableState
+	n      notifier
+	opts   WatchOptions
+	logger *log.Logger
+
+	pending map[string]time.Time   // Written files, and when last changed
+	paths   map[P.Pathsplit]devIno // The inode of each indexed path
+
+	checkedCount  int64 // Files checked since the initial scan
+	initialLinks  int64
+	initialSaving uint64
+}
+
+func newWatcher(ctx context.Context, ls *linkableState, n notifier, wo WatchOptions) *watcher {
+	if wo.SettleTime <= 0 {
+		wo.SettleTime = DefaultWatchSettleTime
+	}
+	logger := wo.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &watcher{
+		ctx:     ctx,
+		ls:      ls,
+		n:       n,
+		opts:    wo,
+		logger:  logger,
+		pending: make(map[string]time.Time),
+		paths:   make(map[P.Pathsplit]devIno),
+	}
+}
+
+// dirWatcher adds the dirs entered by the initial scan to the notifier
+type dirWatcher struct {
+	NopObserver
+	w *watcher
+}
+
+func (d dirWatcher) DirEntered(pathname string) {
+	if err := d.w.n.addDir(pathname); err != nil {
+		d.w.logger.Printf("Cannot watch %v: %v", pathname, err)
+	}
+}
+
+func (w *watcher) run(dirs []string) error {
+	ls := w.ls
+	ls.observer = append(ls.observer, dirWatcher{w: w})
+	if err := runHelper(dirs, ls); err != nil {
+		return err
+	}
+
+	// runHelper cancels its own context when returning, so the fsDevs
+	// are switched back to the Watch context.
+	ls.ctx = w.ctx
+	for dev, fsdev := range ls.fsDevs {
+		fsdev.ctx = w.ctx
+		ls.fsDevs[dev] = fsdev
+		fsdev.rehash()
+		for ino, fp := range fsdev.InoPaths {
+			for _, ps := range fp.PathsAsSlice() {
+				w.paths[ps] = devIno{dev: dev, ino: uint64(ino)}
+			}
+		}
+	}
+	w.initialLinks = ls.Results.NewLinkCount
+	w.initialSaving = ls.Results.InodeRemovedByteAmount
+	w.logger.Printf("Initial scan linked %d files, saving %v.  Watching %d dirs...",
+		w.initialLinks, Humanize(w.initialSaving), w.n.numDirs())
+
+	interval := w.opts.SettleTime / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	settleTicker := time.NewTicker(interval)
+	defer settleTicker.Stop()
+	var statsC <-chan time.Time
+	if w.opts.StatsInterval > 0 {
+		statsTicker := time.NewTicker(w.opts.StatsInterval)
+		defer statsTicker.Stop()
+		statsC = statsTicker.C
+	}
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			ls.Results.end()
+			return w.ctx.Err()
+		case <-w.n.ready():
+			w.handleEvents(w.n.events())
+		case now := <-settleTicker.C:
+			w.processSettled(now)
+		case <-statsC:
+			w.logStats()
+		}
+	}
+}
+
+func (w *watcher) handleEvents(events []watchEvent) {
+	now := time.Now()
+	for _, e := range events {
+		switch e.kind {
+		case fileWritten:
+			if !isPolicyExcluded(w.ls.policy, e.pathname, w.ls.Results) &&
+				isFileIncluded(filepath.Base(e.pathname), w.ls.Options, w.ls.Results) {
+				w.pending[e.pathname] = now
+			}
+		case fileRemoved:
+			delete(w.pending, e.pathname)
+			w.forget(P.Split(e.pathname, w.ls.pool))
+		case dirCreated:
+			w.addDirTree(e.pathname, now)
+		case dirRemoved:
+			w.forgetDirTree(e.pathname)
+		case eventsLost:
+			w.logger.Printf("Watch events were lost.  Some new files may not be linked until the next full scan.")
+		}
+	}
+}
+
+// addDirTree watches a new directory (and its subdirs) and marks the
+// included files in it as pending.
+func (w *watcher) addDirTree(dirname string, now time.Time) {
+	opts := w.ls.Options
+	err := walkTree(w.ls.fsys, dirname, walkOptions{
+		Callback: func(osPathname string, de vfs.Dirent) error {
+			if de.IsDir() {
+				if isMatched(de.Name, opts.DirExcludes) || w.ls.policy.excluded(osPathname) {
+					w.ls.Results.ExcludedDirCount++
+					return filepath.SkipDir
+				}
+				w.ls.Results.DirCount++
+				w.ls.observer.DirEntered(osPathname)
+			} else if de.IsRegular() {
+				if !isPolicyExcluded(w.ls.policy, osPathname, w.ls.Results) &&
+					isFileIncluded(de.Name, opts, w.ls.Results) {
+					w.pending[osPathname] = now
+				} else {
+					w.ls.observer.FileRejected(osPathname, RejectExcluded)
+				}
+			}
+			return nil
+		},
+		ErrorCallback: func(osPathname string, err error) walkAction {
+			w.ls.Results.addError(OpWalk, osPathname, err)
+			w.ls.Results.SkippedDirErrCount++
+			return walkSkipNode
+		},
+	})
+	if err != nil && !os.IsNotExist(err) {
+		w.logger.Printf("Cannot watch %v: %v", dirname, err)
+	}
+}
+
+// processSettled indexes the pending files that haven't changed within the
+// settle time, and then links any that were found to be identical to an
+// indexed file.
+func (w *watcher) processSettled(now time.Time) {
+	var settled []string
+	for pathname, t := range w.pending {
+		if now.Sub(t) >= w.opts.SettleTime {
+			settled = append(settled, pathname)
+		}
+	}
+	if len(settled) == 0 {
+		return
+	}
+	sort.Strings(settled)
+	for _, pathname := range settled {
+		delete(w.pending, pathname)
+		if w.ctx.Err() != nil {
+			return
+		}
+		w.index(pathname)
+	}
+	w.link()
+}
+
+// index adds the given file to the fsDev indexes, replacing any previous
+// information about the path (or its inode, if it was rewritten in place).
+func (w *watcher) index(pathname string) {
+	ps := P.Split(pathname, w.ls.pool)
+	di, err := I.LStatInfo(w.ls.fsys, pathname)
+	if err != nil {
+		w.forget(ps) // Removed since the event
+		return
+	}
+
+	toAdd := []P.Pathsplit{ps}
+	if old, ok := w.paths[ps]; ok {
+		fsdev := w.ls.fsDevs[old.dev]
+		ino := I.Ino(old.ino)
+		if old.dev == di.Dev && ino == di.Ino {
+			si, ok := fsdev.inoStatInfo[ino]
+			if ok && !statChanged(si, &di.StatInfo) {
+				return // Nothing new, such as our own linking
+			}
+			// The inode was rewritten, so all of its paths are
+			// indexed again with the new content.
+			toAdd = fsdev.forgetIno(ino)
+			for _, p := range toAdd {
+				delete(w.paths, p)
+			}
+		} else {
+			w.forget(ps)
+		}
+	}
+
+	for _, p := range toAdd {
+		w.checkedCount++
+		if err := w.ls.walkFile(p.Join(), nil); err != nil {
+			if w.ctx.Err() == nil {
+				w.logger.Printf("%v", err)
+			}
+			continue
+		}
+		if di, err := I.LStatInfo(w.ls.fsys, p.Join()); err == nil {
+			if fsdev, ok := w.ls.fsDevs[di.Dev]; ok && fsdev.InoPaths.HasPath(di.Ino, p) {
+				w.paths[p] = devIno{dev: di.Dev, ino: uint64(di.Ino)}
+			}
+		}
+	}
+}
+
+// forget removes the given path from the indexes
+func (w *watcher) forget(ps P.Pathsplit) {
+	old, ok := w.paths[ps]
+	if !ok {
+		return
+	}
+	delete(w.paths, ps)
+	fsdev := w.ls.fsDevs[old.dev]
+	ino := I.Ino(old.ino)
+	fp, ok := fsdev.InoPaths[ino]
+	if !ok {
+		return
+	}
+	fp.Remove(ps)
+	if fp.IsEmpty() {
+		fsdev.forgetIno(ino)
+		return
+	}
+	// Refresh the nlink count from one of the remaining paths, so that the
+	// inode isn't considered modified when it is next linked.
+	si := fsdev.inoStatInfo[ino]
+	if di, err := I.LStatInfo(w.ls.fsys, fp.Any().Join()); err == nil && di.Ino == ino && si != nil {
+		si.Nlink = di.Nlink
+	}
+}
+
+// forgetDirTree removes the pending and indexed files within a directory that
+// was removed (or moved away) from the indexes
+func (w *watcher) forgetDirTree(dirname string) {
+	prefix := dirname + string(filepath.Separator)
+	for pathname := range w.pending {
+		if strings.HasPrefix(pathname, prefix) {
+			delete(w.pending, pathname)
+		}
+	}
+	var removed []P.Pathsplit
+	for ps := range w.paths {
+		if strings.HasPrefix(ps.Join(), prefix) {
+			removed = append(removed, ps)
+		}
+	}
+	for _, ps := range removed {
+		w.forget(ps)
+	}
+}
+
+// link performs the linking of the newly indexed files
+func (w *watcher) link() {
+	for _, fsdev := range w.ls.fsDevs {
+		affected, err := fsdev.linkNewFiles()
+		if err != nil && w.ctx.Err() == nil {
+			w.logger.Printf("%v", err)
+		}
+		for _, ino := range affected {
+			if fp, ok := fsdev.InoPaths[ino]; ok {
+				for _, ps := range fp.PathsAsSlice() {
+					w.paths[ps] = devIno{dev: fsdev.Dev, ino: uint64(ino)}
+				}
+			}
+		}
+	}
+}
+
+func (w *watcher) logStats() {
+	r := w.ls.Results
+	w.logger.Printf("Checked %d new files, linked %d, saving %v.  %d pending.",
+		w.checkedCount, r.NewLinkCount-w.initialLinks,
+		Humanize(r.InodeRemovedByteAmount-w.initialSaving), len(w.pending))
+}
+
+// linkNewFiles links the inodes found to be linkable since the last call,
+// and updates their hashes.  The affected inodes are returned.
+func (f *fsDev) linkNewFiles() ([]I.Ino, error) {
+	var affected []I.Ino
+	for ino := range f.LinkableInos {
+		affected = append(affected, ino)
+		if si, ok := f.inoStatInfo[ino]; ok {
+			f.removeInoHash(ino, si)
+		}
+	}
+	if len(affected) == 0 {
+		return nil, nil
+	}
+	err := f.generateLinks()
+	for _, ino := range affected {
+		if si, ok := f.inoStatInfo[ino]; ok {
+			f.addInoHash(ino, si)
+		} else {
+			f.InoDigests.Remove(ino)
+		}
+		delete(f.LinkableInos, ino)
+	}
+	return affected, err
+}
@@ -0,0 +1,160 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// inotifier is the Linux notifier, reading inotify events in a goroutine
+type inotifier struct {
+	f      *os.File
+	fd     int
+	mu     sync.Mutex
+	dirs   map[int32]string // Watch descriptor to dirname
+	queue  []watchEvent
+	signal chan struct{}
+}
+
+func newNotifier() (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotifier{
+		// A non-blocking fd uses the runtime poller, so that closing
+		// it stops the blocked Read
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		dirs:   make(map[int32]string),
+		signal: make(chan struct{}, 1),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifier) addDir(dirname string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dirname, inotifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.mu.Lock()
+	n.dirs[int32(wd)] = dirname
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotifier) numDirs() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.dirs)
+}
+
+func (n *inotifier) ready() <-chan struct{} { return n.signal }
+
+func (n *inotifier) events() []watchEvent {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	events := n.queue
+	n.queue = nil
+	return events
+}
+
+func (n *inotifier) close() error { return n.f.Close() }
+
+func (n *inotifier) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		count, err := n.f.Read(buf)
+		if err != nil {
+			return // Closed
+		}
+		n.mu.Lock()
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			n.queueEvent(raw.Wd, raw.Mask, name)
+		}
+		n.mu.Unlock()
+
+		select {
+		case n.signal <- struct{}{}:
+		default: // Already signalled
+		}
+	}
+}
+
+// queueEvent converts an inotify event, and is called with the lock held
+func (n *inotifier) queueEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		n.queue = append(n.queue, watchEvent{kind: eventsLost})
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(n.dirs, wd) // The dir was removed
+		return
+	}
+	dirname, ok := n.dirs[wd]
+	if !ok || name == "" {
+		return
+	}
+	e := watchEvent{pathname: filepath.Join(dirname, name)}
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		e.kind = dirCreated
+	case isDir && mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		e.kind = dirRemoved
+		n.removeDirWatches(e.pathname)
+	case isDir:
+		return
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		e.kind = fileWritten
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		e.kind = fileRemoved
+	default:
+		return // A created file is handled when closed
+	}
+	n.queue = append(n.queue, e)
+}
+
+// removeDirWatches stops watching a dir that was moved away (and its subdirs),
+// whose events would otherwise be reported under the old pathnames.  It is
+// called with the lock held.
+func (n *inotifier) removeDirWatches(dirname string) {
+	for wd, d := range n.dirs {
+		if d == dirname || strings.HasPrefix(d, dirname+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(n.fd, uint32(wd))
+			delete(n.dirs, wd)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright © 2018 Chad Netzer <chad.netzer@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hardlinkable
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// isLinked returns true if the files are the same inode
+func isLinked(t *testing.T, p1, p2 string) bool {
+	fi1, err1 := os.Lstat(p1)
+	fi2, err2 := os.Lstat(p2)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Couldn't stat %v or %v: %v %v", p1, p2, err1, err2)
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+// waitFor polls the condition, until it is true or times out
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestWatch(t *testing.T) {
+	topdir := setUp("Watch", t)
+	defer os.RemoveAll(topdir)
+
+	simpleFileMaker(t, pathContents{"A/f1": "X", "A/f2": "X", "A/g1": "Y"})
+
+	opts := SetupOptions(LinkingEnabled, IgnoreTime)
+	wo := WatchOptions{
+		SettleTime: 50 * time.Millisecond,
+		Logger:     log.New(ioutil.Discard, "", 0),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var results Results
+	var err error
+	go func() {
+		results, err = Watch(ctx, []string{topdir}, opts, wo)
+		close(done)
+	}()
+
+	// The initial scan links the existing files
+	if !waitFor(func() bool { return nlinkVal("A/f1") == 2 }) {
+		t.Fatalf("Initial scan didn't link A/f1 and A/f2")
+	}
+
+	// New files, including those in new dirs, are linked once settled
+	simpleFileMaker(t, pathContents{"A/f3": "X", "B/C/f4": "X", "B/g2": "Y", "B/h1": "Z"})
+	linked := func() bool {
+		return isLinked(t, "A/f1", "A/f3") && isLinked(t, "A/f1", "B/C/f4") &&
+			isLinked(t, "A/g1", "B/g2")
+	}
+	if !waitFor(linked) {
+		t.Errorf("New files weren't linked: f1/f3 %v, f1/f4 %v, g1/g2 %v",
+			isLinked(t, "A/f1", "A/f3"), isLinked(t, "A/f1", "B/C/f4"),
+			isLinked(t, "A/g1", "B/g2"))
+	}
+
+	// A file rewritten in place is indexed again with its new content
+	if err := ioutil.WriteFile("B/h1", []byte("W"), 0644); err != nil {
+		t.Fatalf("Couldn't rewrite B/h1: %v", err)
+	}
+	simpleFileMaker(t, pathContents{"B/h2": "W"})
+	if !waitFor(func() bool { return isLinked(t, "B/h1", "B/h2") }) {
+		t.Errorf("Rewritten file B/h1 wasn't linked to B/h2")
+	}
+
+	// Removed files are forgotten, so their inode isn't linked to
+	os.Remove("A/g1")
+	os.Remove("B/g2")
+	simpleFileMaker(t, pathContents{"B/g3": "Y"})
+	time.Sleep(200 * time.Millisecond)
+	if nlinkVal("B/g3") != 1 {
+		t.Errorf("B/g3 was unexpectedly linked")
+	}
+
+	cancel()
+	<-done
+	if err != context.Canceled {
+		t.Errorf("Expected Watch to return context.Canceled, got: %v", err)
+	}
+	if results.NewLinkCount != 5 {
+		t.Errorf("Expected 5 new links, got %v", results.NewLinkCount)
+	}
+	verifyContents("Watch", t, pathContents{"A/f1": "X", "A/f3": "X", "B/C/f4": "X", "B/h1": "W", "B/g3": "Y"})
+}
+
+func TestWatchRemovedDir(t *testing.T) {
+	topdir := setUp("Watch", t)
+	defer os.RemoveAll(topdir)
+
+	simpleFileMaker(t, pathContents{"A/f1": "X", "D/E/d1": "Q", "G/g1": "Y"})
+
+	opts := SetupOptions(LinkingEnabled, IgnoreTime)
+	wo := WatchOptions{
+		SettleTime: 50 * time.Millisecond,
+		Logger:     log.New(ioutil.Discard, "", 0),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var results Results
+	go func() {
+		results, _ = Watch(ctx, []string{topdir}, opts, wo)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond) // The initial scan
+
+	// The files in a moved dir are indexed under its new name, and those
+	// in a removed dir are forgotten, so new files are linked to neither
+	// of the old paths
+	if err := os.Rename("D", "M"); err != nil {
+		t.Fatalf("Couldn't move D: %v", err)
+	}
+	if err := os.RemoveAll("G"); err != nil {
+		t.Fatalf("Couldn't remove G: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	simpleFileMaker(t, pathContents{"A/q1": "Q", "A/g2": "Y"})
+	if !waitFor(func() bool { return isLinked(t, "M/E/d1", "A/q1") }) {
+		t.Errorf("A/q1 wasn't linked to the moved M/E/d1")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if nlinkVal("A/g2") != 1 {
+		t.Errorf("A/g2 was unexpectedly linked")
+	}
+
+	cancel()
+	<-done
+	if len(results.Errors) != 0 {
+		t.Errorf("Expected no errors, got: %v", results.Errors)
+	}
+}
+
+func TestWatchRequiresLinking(t *testing.T) {
+	topdir := setUp("Watch", t)
+	defer os.RemoveAll(topdir)
+
+	_, err := Watch(context.Background(), []string{topdir}, SetupOptions(), WatchOptions{})
+	if err == nil {
+		t.Errorf("Expected error when watching without LinkingEnabled")
+	}
+}